@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Professional games are often recorded with the players' names in Chinese,
+// Japanese or Korean script, while online records and English sources use
+// romanizations, each in several spellings. The name_aliases table maps every
+// form of a name, keyed by normalizeName, to the one name the player goes by
+// in queries and statistics, which each player row keeps as its
+// canonical_name.
+
+// Where an alias came from: the nameSeeds or the user.
+const (
+	aliasSeed = "seed"
+	aliasUser = "user"
+)
+
+// nameSeeds are the names of well known professionals, each with the other
+// forms of it found in game records. The romanizations with and without
+// hyphens or spaces compare equal under normalizeName, so only one of them is
+// needed.
+var nameSeeds = []struct {
+	name    string
+	aliases []string
+}{
+	{"Lee Sedol", []string{"이세돌", "李世乭", "李世石", "Yi Se-tol", "Lee Se-dol"}},
+	{"Lee Changho", []string{"이창호", "李昌鎬", "李昌镐", "Yi Chang-ho"}},
+	{"Cho Hunhyun", []string{"조훈현", "曺薰鉉", "曹薰铉", "曹薰鉉", "Jo Hun-hyeon"}},
+	{"Yoo Changhyuk", []string{"유창혁", "劉昌赫", "刘昌赫", "Yu Chang-hyeok"}},
+	{"Park Junghwan", []string{"박정환", "朴廷桓", "Bak Jeong-hwan"}},
+	{"Shin Jinseo", []string{"신진서", "申真谞", "申眞諝", "Sin Jin-seo"}},
+	{"Kim Jiseok", []string{"김지석", "金志錫", "金志锡"}},
+	{"Choi Jeong", []string{"최정", "崔精"}},
+	{"Ke Jie", []string{"커제", "柯洁", "柯潔"}},
+	{"Gu Li", []string{"구리", "古力"}},
+	{"Chang Hao", []string{"창하오", "常昊"}},
+	{"Nie Weiping", []string{"녜웨이핑", "聂卫平", "聶衛平"}},
+	{"Ma Xiaochun", []string{"马晓春", "馬曉春"}},
+	{"Mi Yuting", []string{"미위팅", "芈昱廷"}},
+	{"Lian Xiao", []string{"连笑", "連笑"}},
+	{"Yang Dingxin", []string{"杨鼎新", "楊鼎新"}},
+	{"Rui Naiwei", []string{"루이나이웨이", "芮乃伟", "芮乃偉"}},
+	{"Go Seigen", []string{"吳清源", "呉清源", "吴清源", "오청원", "Wu Qingyuan"}},
+	{"Cho Chikun", []string{"조치훈", "趙治勲", "赵治勋", "Cho Chi-hun"}},
+	{"Iyama Yuta", []string{"井山裕太", "이야마 유타", "Yuta Iyama"}},
+	{"Takemiya Masaki", []string{"武宮正樹", "武宫正树", "Masaki Takemiya"}},
+	{"Kobayashi Koichi", []string{"小林光一", "Koichi Kobayashi"}},
+	{"Otake Hideo", []string{"大竹英雄", "Hideo Otake"}},
+	{"Sakata Eio", []string{"坂田栄男", "Eio Sakata"}},
+	{"Yoda Norimoto", []string{"依田紀基", "Norimoto Yoda"}},
+	{"Shibano Toramaru", []string{"芝野虎丸", "Toramaru Shibano"}},
+	{"Ichiriki Ryo", []string{"一力遼", "Ryo Ichiriki"}},
+	{"Fujisawa Rina", []string{"藤沢里菜", "Rina Fujisawa"}},
+	{"Honinbo Shusaku", []string{"本因坊秀策", "Kuwahara Shusaku"}},
+}
+
+// seedNameAliases fills in the nameSeeds and the canonical names of the
+// existing players.
+func seedNameAliases(tx *sql.Tx) error {
+	for _, s := range nameSeeds {
+		for _, alias := range append([]string{s.name}, s.aliases...) {
+			_, err := tx.Exec(
+				"insert or ignore into name_aliases (alias_key, alias, name, source) values (?, ?, ?, ?)",
+				normalizeName(alias), alias, s.name, aliasSeed,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return refreshCanonicalNames(tx)
+}
+
+// canonicalName is the name a player goes by, through name_aliases, or their
+// own name when they have no alias.
+func canonicalName(db queryer, name string) (string, error) {
+	var canonical string
+	err := db.QueryRow("select name from name_aliases where alias_key = ?", normalizeName(name)).Scan(&canonical)
+	if err == sql.ErrNoRows {
+		return name, nil
+	}
+	return canonical, err
+}
+
+// canonicalNames returns the canonical names of the names.
+func canonicalNames(db queryer, names []string) (map[string]bool, error) {
+	canonical := make(map[string]bool)
+	for _, n := range names {
+		c, err := canonicalName(db, n)
+		if err != nil {
+			return nil, err
+		}
+		canonical[c] = true
+	}
+	return canonical, nil
+}
+
+// refreshCanonicalNames sets every player's canonical name again, after the
+// aliases have changed.
+func refreshCanonicalNames(db queryer) error {
+	rows, err := db.Query("select id, name, coalesce(canonical_name, '') from players")
+	if err != nil {
+		return err
+	}
+	type player struct {
+		id              int64
+		name, canonical string
+	}
+	var players []player
+	for rows.Next() {
+		var p player
+		if err := rows.Scan(&p.id, &p.name, &p.canonical); err != nil {
+			rows.Close()
+			return err
+		}
+		players = append(players, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	changed := make(map[int64]string)
+	for _, p := range players {
+		c, err := canonicalName(db, p.name)
+		if err != nil {
+			return err
+		}
+		if c != p.canonical {
+			changed[p.id] = c
+		}
+	}
+	for id, c := range changed {
+		if _, err := db.Exec("update players set canonical_name = ? where id = ?", c, id); err != nil {
+			return err
+		}
+		// the games are indexed under the names of their players
+		_, err := db.Exec("delete from search where docid in (select id from games where black_id = ? or white_id = ?)", id, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexName drops the games of the players going by name from the search
+// index, to be indexed again under the forms of it there are now.
+func unindexName(db queryer, name string) error {
+	_, err := db.Exec(`
+		delete from search where docid in (
+			select id from games
+			where black_id in (select id from players where canonical_name = ?)
+				or white_id in (select id from players where canonical_name = ?)
+		)`,
+		name, name,
+	)
+	return err
+}
+
+// playersNamed returns a query for the ids of the players going by any of the
+// names, whichever form of them they were recorded under, or which players
+// of the names were merged into, with its arguments.
+func playersNamed(names []string) (string, []interface{}) {
+	forms := make([]string, len(names))
+	merged := make([]string, len(names))
+	var args, mergedArgs []interface{}
+	for i, n := range names {
+		forms[i] = "coalesce((select a.name from name_aliases a where a.alias_key = ?), ?)"
+		args = append(args, normalizeName(n), n)
+		merged[i] = "?"
+		mergedArgs = append(mergedArgs, n)
+	}
+	return "select id from players where coalesce(canonical_name, name) in (" + strings.Join(forms, ", ") + ")" +
+		" union select player_id from player_merges where name in (" + strings.Join(merged, ", ") + ")", append(args, mergedArgs...)
+}
+
+// addAlias maps a form of a name to the name a player goes by.
+func addAlias(db queryer, alias, name string) error {
+	key := normalizeName(alias)
+	if key == "" {
+		return fmt.Errorf("%q has no letters or digits to match on", alias)
+	}
+	// an alias of an alias points at the name that one goes by
+	name, err := canonicalName(db, name)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		"insert or replace into name_aliases (alias_key, alias, name, source) values (?, ?, ?, ?)",
+		key, alias, name, aliasUser,
+	)
+	if err == nil && name != alias {
+		// and the forms which went by the alias go by the name too
+		_, err = db.Exec("update name_aliases set name = ? where name = ?", name, alias)
+	}
+	if err == nil {
+		err = unindexName(db, name)
+	}
+	if err != nil {
+		return err
+	}
+	return refreshCanonicalNames(db)
+}
+
+// removeAlias drops the alias matching a form of a name, reporting whether
+// there was one.
+func removeAlias(db queryer, alias string) (bool, error) {
+	name, err := canonicalName(db, alias)
+	if err != nil {
+		return false, err
+	}
+	if err := unindexName(db, name); err != nil {
+		return false, err
+	}
+	res, err := db.Exec("delete from name_aliases where alias_key = ?", normalizeName(alias))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	return true, refreshCanonicalNames(db)
+}
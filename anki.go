@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const ankiUsage = `usage:
+  anki [-db-path PATH] [filters] (-move N | -noted | -blunders POINTS) -out DIR
+
+anki writes flash cards of positions from the games for importing into Anki.
+Each card shows the board before a move on the front and the move played,
+with its comment and notes, on the back. -move picks the same move of every
+game, -noted picks every move with a note and -blunders every move which
+lost at least POINTS by the engine's analysis of the games from the worker
+command. Games analyzed by the worker also show the engine's choice of move
+and the points the move played lost on the back.
+
+DIR gets cards.txt, to import with File > Import, and an SVG image per card,
+which need copying into Anki's collection.media folder first.`
+
+func ankiCommand(args []string) {
+	fs := flag.NewFlagSet("anki", flag.ExitOnError)
+	var (
+		dbPath   = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		out      = fs.String("out", "", "The directory to write the cards and images to")
+		move     = fs.Int("move", 0, "Make a card for this move of each game")
+		noted    = fs.Bool("noted", false, "Make a card for each move with a note")
+		blunders = fs.Float64("blunders", 0, "Make a card for each move which lost at least this many points")
+		filter   gameFilter
+	)
+	filter.register(fs)
+	fs.Parse(args)
+
+	if *out == "" || (*move < 1 && !*noted && *blunders <= 0) || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, ankiUsage)
+		os.Exit(2)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	ids, err := filteredGameIDs(db, &filter)
+	if err != nil {
+		log.Fatalf("error finding the games: %s\n", err)
+	}
+	err = os.MkdirAll(*out, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var cards []string
+	for _, id := range ids {
+		moves, err := cardMoves(db, id, *move, *noted)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(moves) == 0 && *blunders <= 0 {
+			continue
+		}
+		root, err := loadGameTree(db, id)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		evaluations, err := storedEvaluations(db, id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		analysis := newCardAnalysis(root, evaluations)
+		if *blunders > 0 {
+			moves = analysis.addBlunders(moves, *blunders)
+		}
+		for _, m := range moves {
+			c, ok, err := ankiCard(db, id, root, m, analysis)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !ok {
+				continue
+			}
+			err = ioutil.WriteFile(filepath.Join(*out, c.image), []byte(c.svg), 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cards = append(cards, c.line())
+		}
+	}
+
+	header := "#separator:tab\n#html:true\n#tags column:3\n"
+	err = ioutil.WriteFile(filepath.Join(*out, "cards.txt"), []byte(header+strings.Join(cards, "")), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d cards to %s\n", len(cards), *out)
+}
+
+// cardMoves returns the moves of a game to make cards of.
+func cardMoves(db *sql.DB, id int64, move int, noted bool) ([]int, error) {
+	var moves []int
+	if move > 0 {
+		moves = append(moves, move)
+	}
+	if !noted {
+		return moves, nil
+	}
+	rows, err := db.Query(
+		"select distinct move_number from notes where game_id = ? and move_number is not null and move_number != ? order by move_number",
+		id, move,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m int
+		if err := rows.Scan(&m); err != nil {
+			return nil, err
+		}
+		moves = append(moves, m)
+	}
+	return moves, rows.Err()
+}
+
+// cardAnalysis is what the engine made of the positions of a game.
+type cardAnalysis struct {
+	// bestMoves are the engine's choices by the number of moves before the
+	// position, and losses the points lost by move number
+	bestMoves map[int]string
+	losses    map[int]float64
+}
+
+func newCardAnalysis(root *sgfNode, evaluations []evaluation) cardAnalysis {
+	a := cardAnalysis{bestMoves: make(map[int]string), losses: make(map[int]float64)}
+	for _, ev := range evaluations {
+		if ev.bestMove != "" {
+			a.bestMoves[ev.moveNumber] = ev.bestMove
+		}
+	}
+	for _, l := range moveLosses(root, evaluations) {
+		a.losses[l.move] = l.points
+	}
+	return a
+}
+
+// addBlunders adds the moves which lost at least points to moves, keeping
+// them in order and without repeats.
+func (a cardAnalysis) addBlunders(moves []int, points float64) []int {
+	picked := make(map[int]bool)
+	for _, m := range moves {
+		picked[m] = true
+	}
+	for m, lost := range a.losses {
+		if lost >= points && !picked[m] {
+			moves = append(moves, m)
+		}
+	}
+	sort.Ints(moves)
+	return moves
+}
+
+type flashCard struct {
+	front, back string
+	tags        []string
+	image, svg  string
+}
+
+// line is the card as a line of a tab separated Anki import file.
+func (c flashCard) line() string {
+	field := func(s string) string {
+		return strings.NewReplacer("\t", " ", "\r\n", "<br>", "\n", "<br>").Replace(s)
+	}
+	return field(c.front) + "\t" + field(c.back) + "\t" + strings.Join(c.tags, " ") + "\n"
+}
+
+// ankiCard makes the card for a move of the main line, returning false when
+// the game is shorter than that.
+func ankiCard(db *sql.DB, id int64, root *sgfNode, move int, analysis cardAnalysis) (flashCard, bool, error) {
+	var node *sgfNode
+	var played int
+	for _, n := range root.mainLine() {
+		if hasMove(n) {
+			played++
+			if played == move {
+				node = n
+				break
+			}
+		}
+	}
+	if node == nil {
+		return flashCard{}, false, nil
+	}
+	size := boardSize(root)
+	b, _ := position(root, move-1)
+
+	color, answer := "Black", "pass"
+	value := node.get("B")
+	if _, ok := node.props["W"]; ok {
+		color, value = "White", node.get("W")
+	}
+	if p, ok := parsePoint(value, size); ok {
+		answer = pointName(p, size)
+	}
+
+	c := flashCard{
+		image: fmt.Sprintf("sgf-game-%d-move-%d.svg", id, move),
+		svg:   b.svg(),
+		tags:  []string{"go", fmt.Sprintf("game-%d", id)},
+	}
+	c.front = fmt.Sprintf(`<img src="%s"><br>%s to play (move %d)<br>%s`,
+		c.image, color, move, xmlEscape(gameTitle(root)))
+
+	answer = "Played: " + answer
+	if lost, ok := analysis.losses[move]; ok {
+		answer += fmt.Sprintf(" (lost %.1f points)", lost)
+	}
+	back := []string{answer}
+	if best, ok := analysis.bestMoves[move-1]; ok {
+		back = append(back, "Engine: "+best)
+	}
+	if comment := node.get("C"); comment != "" {
+		back = append(back, xmlEscape(comment))
+	}
+	rows, err := db.Query("select body from notes where game_id = ? and move_number = ? order by id", id, move)
+	if err != nil {
+		return flashCard{}, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var body string
+		if err := rows.Scan(&body); err != nil {
+			return flashCard{}, false, err
+		}
+		back = append(back, xmlEscape(body))
+	}
+	c.back = strings.Join(back, "<br><br>")
+	return c, true, rows.Err()
+}
+
+// gameTitle names a game by its players and date.
+func gameTitle(root *sgfNode) string {
+	name := func(id string) string {
+		if v := root.get(id); v != "" {
+			return v
+		}
+		return "(unknown)"
+	}
+	title := name("PB") + " vs " + name("PW")
+	if dt := root.get("DT"); dt != "" {
+		title += ", " + dt
+	}
+	return title
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apiarian/sgf-library-to-sqlite/extract"
+)
+
+const exportUsage = `usage:
+  export [-db-path PATH] [-anonymize] -o PATH
+
+export writes a copy of the database, and of its partitions if it has any.
+With -anonymize player names are replaced by pseudonyms, which stay the same
+from one export to the next, and comments, notes and anything else which could
+identify a player are removed: events, rounds, places, teams, sources,
+copyrights and game names, the files games came from and the tables
+extractors fill in. What's kept is the moves, dates, ranks, rules, results
+and the networks the players are on.`
+
+func exportCommand(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		dbPath    = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to export")
+		out       = fs.String("o", "", "The path to write the copy to")
+		anonymize = fs.Bool("anonymize", false, "Replace player names with pseudonyms and strip comments and notes")
+	)
+	fs.Parse(args)
+
+	if *out == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, exportUsage)
+		os.Exit(2)
+	}
+	if outExists, err := exists(*out); err != nil || outExists {
+		log.Fatalf("%s already exists\n", *out)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parts, err := listPartitions(db, *dbPath)
+	db.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// vacuum into makes a consistent copy of each file without the space
+	// left by deleted rows
+	files := map[string]string{*dbPath: *out}
+	for _, p := range parts {
+		files[p.path] = filepath.Join(filepath.Dir(*out), partitionFileName(*out, p))
+	}
+	for from, to := range files {
+		err := vacuumInto(from, to)
+		if err != nil {
+			log.Fatalf("error copying %s: %s\n", from, err)
+		}
+	}
+	copied, err := sql.Open("sqlite3", *out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer copied.Close()
+	for _, p := range parts {
+		_, err := copied.Exec("update partitions set path = ? where name = ?", partitionFileName(*out, p), p.name)
+		if err != nil {
+			log.Fatalf("error recording the partitions of the copy: %s\n", err)
+		}
+	}
+
+	if *anonymize {
+		key, err := pseudonymKey()
+		if err != nil {
+			log.Fatalf("error reading the pseudonym key: %s\n", err)
+		}
+		names, err := anonymizePlayers(copied, key)
+		if err != nil {
+			log.Fatalf("error anonymizing the players: %s\n", err)
+		}
+		// vacuuming afterwards leaves none of the old text behind in free
+		// pages of the files
+		err = anonymizeGames(copied, names)
+		if err == nil {
+			_, err = copied.Exec("vacuum")
+		}
+		if err != nil {
+			log.Fatalf("error anonymizing the games: %s\n", err)
+		}
+		for _, p := range parts {
+			pdb, err := sql.Open("sqlite3", files[p.path])
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = anonymizeGames(pdb, names)
+			if err == nil {
+				_, err = pdb.Exec("vacuum")
+			}
+			pdb.Close()
+			if err != nil {
+				log.Fatalf("error anonymizing the games of %s: %s\n", p.name, err)
+			}
+		}
+	}
+	log.Println("wrote", *out)
+}
+
+// partitionFileName is the name of a partition's file next to a copy of its
+// database at out.
+func partitionFileName(out string, p partition) string {
+	return filepath.Base(partitionPath(out, strings.TrimPrefix(p.name, "y")))
+}
+
+func vacuumInto(from, to string) error {
+	db, err := sql.Open("sqlite3", from)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec("vacuum into ?", to)
+	return err
+}
+
+// pseudonymKey returns the secret pseudonyms are made with, creating it the
+// first time. Keeping it secret stops the names being recovered by hashing
+// guesses, and keeping it at all makes pseudonyms stable across exports.
+func pseudonymKey() ([]byte, error) {
+	path := filepath.Join(dataDir(), "pseudonym.key")
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(path, key, 0600)
+}
+
+func pseudonym(key []byte, name, network string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(network + "\x00" + name))
+	return "player-" + hex.EncodeToString(mac.Sum(nil))[:10]
+}
+
+// anonymizePlayers renames every player but the guests and removes what
+// would identify them, returning the new names by player id.
+func anonymizePlayers(db *sql.DB, key []byte) (map[int64]string, error) {
+	rows, err := db.Query("select id, name, coalesce(network, ''), is_guest from players")
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int64]string)
+	for rows.Next() {
+		var (
+			id            int64
+			name, network string
+			guest         bool
+		)
+		if err := rows.Scan(&id, &name, &network, &guest); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if guest {
+			names[id] = name
+		} else {
+			names[id] = pseudonym(key, name, network)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	for id, name := range names {
+		// the canonical names are real names, and the aliases leading to them
+		// go below
+		_, err := tx.Exec("update players set name = ?, canonical_name = null where id = ?", name, id)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	for _, q := range []string{
+		"delete from player_profiles",
+		"delete from notes",
+		"delete from files",
+		"delete from import_checkpoints",
+		"delete from search",
+		"delete from quarantine",
+		"delete from name_aliases",
+		"delete from player_dupe_dismissals",
+		"delete from player_merges",
+		"delete from digest_runs",
+		"delete from digest_ratings",
+		// the summaries name the files which failed
+		"update import_runs set summary = '{}'",
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	// extractors may copy any of the text, and can't say which is safe
+	for _, e := range extract.Registered() {
+		for _, table := range e.GameTables {
+			var n int
+			err := tx.QueryRow("select count(*) from sqlite_master where type = 'table' and name = ?", table).Scan(&n)
+			if err == nil && n > 0 {
+				_, err = tx.Exec("delete from " + table)
+			}
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+	return names, tx.Commit()
+}
+
+// identifyingProperties are removed from every node of anonymized games.
+// Events, rounds, places and teams name the clubs and leagues players belong
+// to.
+var identifyingProperties = []string{"C", "GC", "AN", "US", "SO", "GN", "CP", "EV", "RO", "PC", "BT", "WT"}
+
+// anonymizeGames strips the games and moves of one database file, using the
+// pseudonyms from the main database for the player names in the SGF text.
+func anonymizeGames(db *sql.DB, names map[int64]string) error {
+	rows, err := db.Query("select id, black_id, white_id, sgf from games where sgf is not null")
+	if err != nil {
+		return err
+	}
+	sources := make(map[int64]string)
+	for rows.Next() {
+		var (
+			id               int64
+			blackID, whiteID sql.NullInt64
+			source           string
+		)
+		if err := rows.Scan(&id, &blackID, &whiteID, &source); err != nil {
+			rows.Close()
+			return err
+		}
+		games, err := readCollection([]byte(source))
+		if err != nil || len(games) == 0 {
+			// unreadable text can't be cleaned, so it isn't shared
+			sources[id] = ""
+			continue
+		}
+		root := games[0].root
+		root.set("PB", names[blackID.Int64])
+		root.set("PW", names[whiteID.Int64])
+		if !blackID.Valid {
+			root.del("PB")
+		}
+		if !whiteID.Valid {
+			root.del("PW")
+		}
+		var strip func(n *sgfNode)
+		strip = func(n *sgfNode) {
+			for _, p := range identifyingProperties {
+				n.del(p)
+			}
+			for _, c := range n.children {
+				strip(c)
+			}
+		}
+		strip(root)
+		var buf bytes.Buffer
+		writeGameTree(&buf, root)
+		sources[id] = buf.String()
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for id, source := range sources {
+		_, err := tx.Exec("update games set sgf = ? where id = ?", nullIfEmpty(source), id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(`
+		update games set path = null, source_url = null, source = null, user = null,
+			annotator = null, copyright = null, game_comment = null, game_name = null,
+			place = null, black_team = null, white_team = null`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("update moves set comment = null")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"time"
+)
+
+const benchUsage = `usage:
+  bench -sgf-dir DIR [-store sqlite|memory] [-cpuprofile PATH] [-memprofile PATH]
+
+bench imports DIR into a scratch database, one file at a time, and reports
+how long the walk, the parsing and the writing each took. With -store memory
+the games are kept in memory instead, leaving out the database's share.`
+
+func benchCommand(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var (
+		sgfDir     = fs.String("sgf-dir", "", "The directory of SGF files to import")
+		storeKind  = fs.String("store", "sqlite", "Where to write the games: sqlite or memory")
+		cpuProfile = fs.String("cpuprofile", "", "Write a CPU profile of the run to this file")
+		memProfile = fs.String("memprofile", "", "Write a heap profile at the end of the run to this file")
+	)
+	fs.Parse(args)
+
+	if *sgfDir == "" || (*storeKind != "sqlite" && *storeKind != "memory") || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, benchUsage)
+		os.Exit(2)
+	}
+
+	var st store = newMemoryStore()
+	if *storeKind == "sqlite" {
+		dir, err := ioutil.TempDir("", "sgflib-bench-")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dbPath := filepath.Join(dir, "bench.db")
+		db, err := sql.Open("sqlite3", sqliteDSN(dbPath))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		err = migrate(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s, err := newSQLiteStore(db, dbPath, false)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer s.close()
+		st = s
+	}
+
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		err = pprof.StartCPUProfile(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	b := runBench(*sgfDir, st)
+	b.print(os.Stdout)
+
+	if *memProfile != "" {
+		f, err := os.Create(*memProfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		runtime.GC()
+		err = pprof.WriteHeapProfile(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+type benchResult struct {
+	files, games, failed int
+	bytes                int64
+	walk                 time.Duration
+	// parse and write hold the time each file took in that stage
+	parse, write []time.Duration
+}
+
+// runBench walks, parses and writes the files in turn, without overlapping
+// the stages, so each is timed on its own.
+func runBench(dir string, st store) benchResult {
+	var b benchResult
+	done := make(chan struct{})
+	defer close(done)
+
+	start := time.Now()
+	paths, errc := walkFiles(done, func(string) bool { return false }, newWalkProgress(), dir)
+	var files []walkedFile
+	for f := range paths {
+		files = append(files, f)
+	}
+	if err := <-errc; err != nil {
+		log.Fatal(err)
+	}
+	b.walk = time.Since(start)
+
+	im := &importer{
+		store:        st,
+		summary:      newImportSummary(),
+		networkZones: make(map[string]*time.Location),
+		now:          func() string { return time.Now().Format(time.RFC3339) },
+	}
+	limits := readLimits{maxFileSize: 1 << 40, budget: newMemoryBudget(1 << 40)}
+	for _, f := range files {
+		if info, err := os.Stat(f.path); err == nil {
+			b.bytes += info.Size()
+		}
+		start := time.Now()
+		fr := readFile(f, nil, limits)
+		b.parse = append(b.parse, time.Since(start))
+
+		start = time.Now()
+		im.importFile(fr)
+		b.write = append(b.write, time.Since(start))
+		limits.budget.done(fr.seq, fr.reserved)
+	}
+	b.files = len(files)
+	b.games = im.summary.GamesInserted
+	b.failed = im.summary.GamesFailed
+	return b
+}
+
+func (b benchResult) print(w io.Writer) {
+	parse, write := sumDurations(b.parse), sumDurations(b.write)
+	fmt.Fprintf(w, "files:  %d (%.1f MB), %d games, %d failed\n", b.files, float64(b.bytes)/(1<<20), b.games, b.failed)
+	fmt.Fprintf(w, "walk:   %s\n", b.walk)
+	fmt.Fprintf(w, "parse:  %s, %.1f files/s, %.1f MB/s, per file %s\n",
+		parse, perSecond(float64(b.files), parse), perSecond(float64(b.bytes)/(1<<20), parse), latencies(b.parse))
+	fmt.Fprintf(w, "write:  %s, %.1f games/s, per file %s\n",
+		write, perSecond(float64(b.games), write), latencies(b.write))
+}
+
+func sumDurations(ds []time.Duration) time.Duration {
+	var total time.Duration
+	for _, d := range ds {
+		total += d
+	}
+	return total
+}
+
+func perSecond(n float64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return n / d.Seconds()
+}
+
+// latencies describes the spread of the durations by their median, 95th
+// percentile and maximum.
+func latencies(ds []time.Duration) string {
+	if len(ds) == 0 {
+		return "-"
+	}
+	sorted := append([]time.Duration{}, ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))]
+	}
+	return fmt.Sprintf("p50 %s, p95 %s, max %s", at(0.5), at(0.95), sorted[len(sorted)-1])
+}
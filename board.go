@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type stone byte
+
+const (
+	empty stone = iota
+	black
+	white
+)
+
+func (s stone) opponent() stone {
+	switch s {
+	case black:
+		return white
+	case white:
+		return black
+	}
+	return empty
+}
+
+type point struct {
+	x, y int
+}
+
+// board is a go board which a game can be replayed onto.
+type board struct {
+	size   int
+	points []stone
+	last   *point
+}
+
+func newBoard(size int) *board {
+	return &board{size: size, points: make([]stone, size*size)}
+}
+
+func (b *board) at(p point) stone {
+	return b.points[p.y*b.size+p.x]
+}
+
+func (b *board) put(p point, s stone) {
+	b.points[p.y*b.size+p.x] = s
+}
+
+func (b *board) onBoard(p point) bool {
+	return p.x >= 0 && p.y >= 0 && p.x < b.size && p.y < b.size
+}
+
+func (b *board) neighbors(p point) []point {
+	var ns []point
+	for _, n := range []point{{p.x - 1, p.y}, {p.x + 1, p.y}, {p.x, p.y - 1}, {p.x, p.y + 1}} {
+		if b.onBoard(n) {
+			ns = append(ns, n)
+		}
+	}
+	return ns
+}
+
+// group returns the stones connected to p and whether they have a liberty.
+func (b *board) group(p point) ([]point, bool) {
+	color := b.at(p)
+	seen := map[point]bool{p: true}
+	stack := []point{p}
+	var stones []point
+	var free bool
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		stones = append(stones, c)
+		for _, n := range b.neighbors(c) {
+			switch b.at(n) {
+			case empty:
+				free = true
+			case color:
+				if !seen[n] {
+					seen[n] = true
+					stack = append(stack, n)
+				}
+			}
+		}
+	}
+	return stones, free
+}
+
+// play places a stone and removes any groups it captures, returning the
+// number of stones captured. Suicide removes the played group.
+func (b *board) play(p point, s stone) int {
+	b.put(p, s)
+	b.last = &p
+	var captured int
+	for _, n := range b.neighbors(p) {
+		if b.at(n) != s.opponent() {
+			continue
+		}
+		stones, free := b.group(n)
+		if !free {
+			for _, c := range stones {
+				b.put(c, empty)
+			}
+			captured += len(stones)
+		}
+	}
+	if stones, free := b.group(p); !free {
+		for _, c := range stones {
+			b.put(c, empty)
+		}
+	}
+	return captured
+}
+
+// boardSize reads the SZ property of a root node, defaulting to 19.
+func boardSize(root *sgfNode) int {
+	sz := root.get("SZ")
+	if i := strings.Index(sz, ":"); i >= 0 {
+		sz = sz[:i]
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(sz))
+	if err != nil || n < 1 || n > 52 {
+		return 19
+	}
+	return n
+}
+
+// parsePoint converts an SGF point such as "dd" to board coordinates. Empty
+// values and "tt" on boards up to 19x19 are passes.
+func parsePoint(v string, size int) (point, bool) {
+	if len(v) != 2 || (v == "tt" && size <= 19) {
+		return point{}, false
+	}
+	coord := func(c byte) int {
+		if c >= 'a' && c <= 'z' {
+			return int(c - 'a')
+		}
+		if c >= 'A' && c <= 'Z' {
+			return int(c-'A') + 26
+		}
+		return -1
+	}
+	p := point{coord(v[0]), coord(v[1])}
+	if p.x < 0 || p.y < 0 || p.x >= size || p.y >= size {
+		return point{}, false
+	}
+	return p, true
+}
+
+// columnLabels skips I, as is traditional.
+const columnLabels = "ABCDEFGHJKLMNOPQRSTUVWXYZ"
+
+// pointName returns the conventional name of a point, like "D4".
+func pointName(p point, size int) string {
+	if p.x < len(columnLabels) {
+		return fmt.Sprintf("%c%d", columnLabels[p.x], size-p.y)
+	}
+	return fmt.Sprintf("%d-%d", p.x+1, size-p.y)
+}
+
+// position replays the main line of a game up to and including the given
+// move, returning the board and the number of moves actually played.
+func position(root *sgfNode, move int) (*board, int) {
+	size := boardSize(root)
+	b := newBoard(size)
+	var played int
+	for _, n := range root.mainLine() {
+		if played >= move && hasMove(n) {
+			break
+		}
+		for _, v := range n.props["AE"] {
+			for _, p := range expandPoints(v, size) {
+				b.put(p, empty)
+			}
+		}
+		for _, v := range n.props["AB"] {
+			for _, p := range expandPoints(v, size) {
+				b.put(p, black)
+			}
+		}
+		for _, v := range n.props["AW"] {
+			for _, p := range expandPoints(v, size) {
+				b.put(p, white)
+			}
+		}
+		for _, c := range []struct {
+			id string
+			s  stone
+		}{{"B", black}, {"W", white}} {
+			if vs, ok := n.props[c.id]; ok {
+				played++
+				if p, ok := parsePoint(vs[0], size); ok {
+					b.play(p, c.s)
+				} else {
+					b.last = nil
+				}
+			}
+		}
+	}
+	return b, played
+}
+
+func hasMove(n *sgfNode) bool {
+	_, b := n.props["B"]
+	_, w := n.props["W"]
+	return b || w
+}
+
+// expandPoints handles the compressed "aa:cc" rectangles allowed in setup
+// properties.
+func expandPoints(v string, size int) []point {
+	parts := strings.SplitN(v, ":", 2)
+	from, ok := parsePoint(parts[0], size)
+	if !ok {
+		return nil
+	}
+	if len(parts) == 1 {
+		return []point{from}
+	}
+	to, ok := parsePoint(parts[1], size)
+	if !ok {
+		return nil
+	}
+	var ps []point
+	for x := from.x; x <= to.x; x++ {
+		for y := from.y; y <= to.y; y++ {
+			ps = append(ps, point{x, y})
+		}
+	}
+	return ps
+}
+
+// render draws the board with Unicode stones, one string per line.
+func (b *board) render() []string {
+	var lines []string
+	header := "   "
+	for x := 0; x < b.size; x++ {
+		if x < len(columnLabels) {
+			header += string(columnLabels[x]) + " "
+		} else {
+			header += "? "
+		}
+	}
+	lines = append(lines, header)
+	for y := 0; y < b.size; y++ {
+		var line strings.Builder
+		fmt.Fprintf(&line, "%2d ", b.size-y)
+		for x := 0; x < b.size; x++ {
+			p := point{x, y}
+			line.WriteString(b.glyph(p))
+			if x < b.size-1 {
+				if b.at(p) == empty && b.at(point{x + 1, y}) == empty {
+					line.WriteString("─")
+				} else {
+					line.WriteString(" ")
+				}
+			}
+		}
+		fmt.Fprintf(&line, " %d", b.size-y)
+		lines = append(lines, line.String())
+	}
+	lines = append(lines, header)
+	return lines
+}
+
+func (b *board) glyph(p point) string {
+	last := b.last != nil && *b.last == p
+	switch b.at(p) {
+	case black:
+		if last {
+			return "◉"
+		}
+		return "●"
+	case white:
+		if last {
+			return "◎"
+		}
+		return "○"
+	}
+	if b.isStarPoint(p) {
+		return "╋"
+	}
+	top, bottom, left, right := p.y == 0, p.y == b.size-1, p.x == 0, p.x == b.size-1
+	switch {
+	case top && left:
+		return "┌"
+	case top && right:
+		return "┐"
+	case bottom && left:
+		return "└"
+	case bottom && right:
+		return "┘"
+	case top:
+		return "┬"
+	case bottom:
+		return "┴"
+	case left:
+		return "├"
+	case right:
+		return "┤"
+	}
+	return "┼"
+}
+
+func (b *board) isStarPoint(p point) bool {
+	var edge int
+	switch {
+	case b.size >= 13:
+		edge = 3
+	case b.size >= 9:
+		edge = 2
+	default:
+		return false
+	}
+	far := b.size - 1 - edge
+	mid := b.size / 2
+	isEdge := func(v int) bool { return v == edge || v == far }
+	if isEdge(p.x) && isEdge(p.y) {
+		return true
+	}
+	if b.size%2 == 0 {
+		return false
+	}
+	if p.x == mid && p.y == mid {
+		return true
+	}
+	return b.size >= 19 && (isEdge(p.x) && p.y == mid || p.x == mid && isEdge(p.y))
+}
+
+// svgCell is the distance between lines in svg renderings of a board.
+const svgCell = 24
+
+// svg draws the board as an SVG image with coordinates around the edge and
+// the last move marked.
+func (b *board) svg() string {
+	margin := svgCell
+	width := margin*2 + svgCell*(b.size-1)
+	at := func(v int) int { return margin + v*svgCell }
+	var s strings.Builder
+	fmt.Fprintf(&s, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="10">`+"\n", width, width)
+	fmt.Fprintf(&s, `<rect width="100%%" height="100%%" fill="#dcb35c"/>`+"\n")
+	for i := 0; i < b.size; i++ {
+		fmt.Fprintf(&s, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="black"/>`+"\n", at(0), at(i), at(b.size-1), at(i))
+		fmt.Fprintf(&s, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="black"/>`+"\n", at(i), at(0), at(i), at(b.size-1))
+		if i < len(columnLabels) {
+			fmt.Fprintf(&s, `<text x="%d" y="%d" text-anchor="middle">%c</text>`+"\n", at(i), margin/2, columnLabels[i])
+		}
+		fmt.Fprintf(&s, `<text x="%d" y="%d" text-anchor="middle" dominant-baseline="middle">%d</text>`+"\n", margin/2, at(i), b.size-i)
+	}
+	for y := 0; y < b.size; y++ {
+		for x := 0; x < b.size; x++ {
+			p := point{x, y}
+			fill, mark := "", ""
+			switch b.at(p) {
+			case black:
+				fill, mark = "black", "white"
+			case white:
+				fill, mark = "white", "black"
+			default:
+				if b.isStarPoint(p) {
+					fmt.Fprintf(&s, `<circle cx="%d" cy="%d" r="3"/>`+"\n", at(x), at(y))
+				}
+				continue
+			}
+			fmt.Fprintf(&s, `<circle cx="%d" cy="%d" r="%d" fill="%s" stroke="black"/>`+"\n", at(x), at(y), svgCell/2-1, fill)
+			if b.last != nil && *b.last == p {
+				fmt.Fprintf(&s, `<circle cx="%d" cy="%d" r="%d" fill="none" stroke="%s" stroke-width="2"/>`+"\n", at(x), at(y), svgCell/4, mark)
+			}
+		}
+	}
+	s.WriteString("</svg>\n")
+	return s.String()
+}
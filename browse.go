@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const browseUsage = `usage:
+  browse [-db-path PATH] [filters]
+
+browse lists the games in the terminal, newest first. Typing searches the
+list as you go, the arrow keys pick a game, whose information shows beside
+the list, and enter opens it to step through its moves on the board.
+
+Where the terminal can't be read a key at a time, as on Windows or when
+input is redirected, browse reads its commands a line at a time instead.`
+
+const browseHelp = `list:  TEXT narrows the list, / clears the search, ID opens a game,
+       ENTER shows more, q quits
+game:  ENTER or n steps forward, p steps back, a number jumps to that move,
+       e jumps to the end, q returns to the list`
+
+const browseKeysHelp = `list:  type to search, up and down pick a game, enter opens it,
+       ctrl-u clears the search, ctrl-c quits
+game:  right or n steps forward, left or p steps back, home or b goes to
+       the start, end or e to the end, q or backspace returns to the list`
+
+type browseEntry struct {
+	id      int64
+	summary string
+}
+
+// browseCommand is a terminal browser, which reads keys as they're pressed
+// where it can put the terminal into raw mode and lines where it can't.
+func browseCommand(args []string) {
+	fs := flag.NewFlagSet("browse", flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		filter gameFilter
+	)
+	filter.register(fs)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, browseUsage)
+		os.Exit(2)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	all, err := browseEntries(db, &filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if restore, ok := rawTerminal(); ok {
+		err := browseKeys(db, all)
+		restore()
+		clearScreen()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	browseLines(db, all)
+}
+
+// browseLines reads every command as a line, which works in any terminal.
+func browseLines(db *sql.DB, all []browseEntry) {
+	in := bufio.NewScanner(os.Stdin)
+	matches := all
+	var searches []string
+	offset := 0
+	const pageSize = 20
+	for {
+		clearScreen()
+		fmt.Printf("%d of %d games", len(matches), len(all))
+		if len(searches) > 0 {
+			fmt.Printf(" matching %q", strings.Join(searches, " "))
+		}
+		fmt.Println()
+		for i := offset; i < len(matches) && i < offset+pageSize; i++ {
+			fmt.Println(matches[i].summary)
+		}
+		fmt.Print("\n", browseHelp, "\n> ")
+		if !in.Scan() {
+			return
+		}
+		line := strings.TrimSpace(in.Text())
+		switch {
+		case line == "q":
+			return
+		case line == "":
+			offset += pageSize
+			if offset >= len(matches) {
+				offset = 0
+			}
+		case line == "/":
+			matches, searches, offset = all, nil, 0
+		default:
+			if id, err := strconv.ParseInt(line, 10, 64); err == nil {
+				err := browseGame(db, in, id)
+				if err != nil {
+					fmt.Println(err)
+					fmt.Print("press enter to continue")
+					in.Scan()
+				}
+				continue
+			}
+			searches = append(searches, line)
+			matches, offset = searchEntries(matches, line), 0
+		}
+	}
+}
+
+// searchEntries returns the entries whose summary holds text, ignoring case.
+func searchEntries(entries []browseEntry, text string) []browseEntry {
+	needle := strings.ToLower(text)
+	var matches []browseEntry
+	for _, e := range entries {
+		if strings.Contains(strings.ToLower(e.summary), needle) {
+			matches = append(matches, e)
+		}
+	}
+	return matches
+}
+
+// browseKeys reads keys as they're pressed, searching the list as the search
+// is typed and showing the information of the picked game beside it.
+func browseKeys(db *sql.DB, all []browseEntry) error {
+	in := bufio.NewReader(os.Stdin)
+	const pageSize = 20
+	var (
+		search   []rune
+		matches  = all
+		selected int
+		// the information of the picked game, which is read when the pick
+		// changes
+		infoID int64 = -1
+		info   []string
+	)
+	for {
+		if selected >= len(matches) {
+			selected = len(matches) - 1
+		}
+		if selected < 0 {
+			selected = 0
+		}
+		offset := selected / pageSize * pageSize
+		lines := []string{fmt.Sprintf("%d of %d games, search: %s_", len(matches), len(all), string(search)), ""}
+		for i := offset; i < len(matches) && i < offset+pageSize; i++ {
+			marker := "  "
+			if i == selected {
+				marker = "> "
+			}
+			lines = append(lines, marker+matches[i].summary)
+		}
+		if len(matches) > 0 && matches[selected].id != infoID {
+			infoID = matches[selected].id
+			info = nil
+			if root, err := loadGameTree(db, infoID); err == nil {
+				info = gameInfoLines(root)
+			} else {
+				info = []string{err.Error()}
+			}
+		}
+		if len(matches) == 0 {
+			info = nil
+		}
+		screen := sideBySide(lines, append([]string{"", ""}, info...))
+		drawScreen(append(screen, "", browseKeysHelp))
+
+		key, err := readKey(in)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "ctrl-c", "ctrl-d":
+			return nil
+		case "up":
+			selected--
+		case "down":
+			selected++
+		case "pgup":
+			selected -= pageSize
+		case "pgdown":
+			selected += pageSize
+		case "enter":
+			if len(matches) > 0 {
+				if err := browseGameKeys(db, in, matches[selected].id); err != nil {
+					return err
+				}
+			}
+		case "backspace":
+			if len(search) > 0 {
+				search = search[:len(search)-1]
+				matches, selected = searchEntries(all, string(search)), 0
+			}
+		case "ctrl-u":
+			search, matches, selected = nil, all, 0
+		default:
+			if r, size := utf8.DecodeRuneInString(key); size == len(key) && r >= ' ' {
+				search = append(search, r)
+				matches, selected = searchEntries(matches, string(search)), 0
+			}
+		}
+	}
+}
+
+// browseGameKeys steps through a game's moves a key at a time.
+func browseGameKeys(db *sql.DB, in *bufio.Reader, id int64) error {
+	root, err := loadGameTree(db, id)
+	if err != nil {
+		drawScreen([]string{err.Error(), "", "press any key to return to the list"})
+		_, err := readKey(in)
+		return err
+	}
+	_, total := position(root, math.MaxInt32)
+	info := gameInfoLines(root)
+	move := 0
+	for {
+		b, _ := position(root, move)
+		status := fmt.Sprintf("game %d, move %d of %d", id, move, total)
+		if b.last != nil {
+			status += ", last played at " + pointName(*b.last, b.size)
+		}
+		screen := sideBySide(b.render(), append([]string{status, ""}, info...))
+		drawScreen(append(screen, "", browseKeysHelp))
+
+		key, err := readKey(in)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "q", "backspace", "ctrl-c":
+			return nil
+		case "right", "n", " ", "enter":
+			if move < total {
+				move++
+			}
+		case "left", "p":
+			if move > 0 {
+				move--
+			}
+		case "home", "b":
+			move = 0
+		case "end", "e":
+			move = total
+		}
+	}
+}
+
+// readKey reads a key pressed in a raw mode terminal: a character, or the
+// name of a special key like "enter", "up" or "ctrl-c".
+func readKey(in *bufio.Reader) (string, error) {
+	r, _, err := in.ReadRune()
+	if err != nil {
+		return "", err
+	}
+	switch r {
+	case '\r', '\n':
+		return "enter", nil
+	case 127, '\b':
+		return "backspace", nil
+	case 3:
+		return "ctrl-c", nil
+	case 4:
+		return "ctrl-d", nil
+	case 21:
+		return "ctrl-u", nil
+	case 27:
+		// the arrow and paging keys send escape sequences like ESC [ A
+		if in.Buffered() == 0 {
+			return "esc", nil
+		}
+		b, err := in.ReadByte()
+		if err != nil || (b != '[' && b != 'O') {
+			return "esc", err
+		}
+		var seq []byte
+		for {
+			b, err := in.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			seq = append(seq, b)
+			if b >= 0x40 && b <= 0x7e {
+				break
+			}
+		}
+		switch string(seq) {
+		case "A":
+			return "up", nil
+		case "B":
+			return "down", nil
+		case "C":
+			return "right", nil
+		case "D":
+			return "left", nil
+		case "H", "1~", "7~":
+			return "home", nil
+		case "F", "4~", "8~":
+			return "end", nil
+		case "5~":
+			return "pgup", nil
+		case "6~":
+			return "pgdown", nil
+		}
+		return "esc", nil
+	}
+	return string(r), nil
+}
+
+// drawScreen clears the terminal and draws lines on it, with the carriage
+// returns a raw mode terminal needs.
+func drawScreen(lines []string) {
+	clearScreen()
+	fmt.Print(strings.Join(lines, "\r\n"))
+}
+
+func browseEntries(db *sql.DB, filter *gameFilter) ([]browseEntry, error) {
+	where, args := filter.where()
+	rows, err := db.Query(`
+		select g.id, coalesce(g.timestamp, ''), coalesce(b.name, '(unknown)'), coalesce(w.name, '(unknown)'), coalesce(winner.name || case when g.result = 'forfeit' then ' (forfeit)' else '' end, g.result, '')
+		from games g
+		left join players b on b.id = g.black_id
+		left join players w on w.id = g.white_id
+		left join players winner on winner.id = g.winner_id
+		where `+where+`
+		order by g.timestamp desc, g.id desc`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []browseEntry
+	for rows.Next() {
+		var (
+			id                              int64
+			timestamp, black, white, winner string
+		)
+		if err := rows.Scan(&id, &timestamp, &black, &white, &winner); err != nil {
+			return nil, err
+		}
+		entries = append(entries, browseEntry{
+			id:      id,
+			summary: fmt.Sprintf("%6d  %-10s  %s (B) vs %s (W)  winner: %s", id, dateOf(timestamp), black, white, winner),
+		})
+	}
+	return entries, rows.Err()
+}
+
+// loadGameTree reads the stored SGF text of a game.
+func loadGameTree(db queryer, id int64) (*sgfNode, error) {
+	var source sql.NullString
+	err := db.QueryRow("select sgf from games where id = ?", id).Scan(&source)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("there is no game with id %d", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !source.Valid {
+		return nil, fmt.Errorf("game %d was imported without its SGF text; re-import it to view it", id)
+	}
+	games, err := readCollection([]byte(source.String))
+	if err != nil {
+		return nil, fmt.Errorf("problem reading game %d: %s", id, err)
+	}
+	if len(games) == 0 {
+		return nil, fmt.Errorf("game %d has no game tree", id)
+	}
+	return games[0].root, nil
+}
+
+func browseGame(db *sql.DB, in *bufio.Scanner, id int64) error {
+	root, err := loadGameTree(db, id)
+	if err != nil {
+		return err
+	}
+	_, total := position(root, math.MaxInt32)
+	info := gameInfoLines(root)
+	move := 0
+	for {
+		b, _ := position(root, move)
+		clearScreen()
+		status := fmt.Sprintf("game %d, move %d of %d", id, move, total)
+		if b.last != nil {
+			status += ", last played at " + pointName(*b.last, b.size)
+		}
+		side := append([]string{status, ""}, info...)
+		fmt.Println(strings.Join(sideBySide(b.render(), side), "\n"))
+
+		fmt.Print("\n> ")
+		if !in.Scan() {
+			return nil
+		}
+		line := strings.TrimSpace(in.Text())
+		switch line {
+		case "q":
+			return nil
+		case "", "n":
+			if move < total {
+				move++
+			}
+		case "p":
+			if move > 0 {
+				move--
+			}
+		case "e":
+			move = total
+		default:
+			n, err := strconv.Atoi(line)
+			if err == nil && n >= 0 && n <= total {
+				move = n
+			}
+		}
+	}
+}
+
+// gameInfoLines describes the game information properties of a root node.
+func gameInfoLines(root *sgfNode) []string {
+	labels := []struct{ id, label string }{
+		{"PB", "Black"},
+		{"BR", "Black rank"},
+		{"BT", "Black team"},
+		{"PW", "White"},
+		{"WR", "White rank"},
+		{"WT", "White team"},
+		{"DT", "Date"},
+		{"RE", "Result"},
+		{"KM", "Komi"},
+		{"HA", "Handicap"},
+		{"EV", "Event"},
+		{"RO", "Round"},
+		{"GN", "Game name"},
+		{"PC", "Place"},
+		{"SO", "Source"},
+		{"AN", "Annotator"},
+		{"US", "Entered by"},
+		{"CP", "Copyright"},
+	}
+	var lines []string
+	for _, l := range labels {
+		if v := root.get(l.id); v != "" {
+			lines = append(lines, fmt.Sprintf("%-11s %s", l.label+":", v))
+		}
+	}
+	if u := sourceURL(root); u != "" {
+		lines = append(lines, fmt.Sprintf("%-11s %s", "Link:", u))
+	}
+	return lines
+}
+
+// sideBySide lays two blocks of lines out as columns.
+func sideBySide(left, right []string) []string {
+	width := 0
+	for _, l := range left {
+		if n := utf8.RuneCountInString(l); n > width {
+			width = n
+		}
+	}
+	var lines []string
+	for i := 0; i < len(left) || i < len(right); i++ {
+		var l, r string
+		if i < len(left) {
+			l = left[i]
+		}
+		if i < len(right) {
+			r = right[i]
+		}
+		lines = append(lines, l+strings.Repeat(" ", width-utf8.RuneCountInString(l))+"   "+r)
+	}
+	return lines
+}
+
+func clearScreen() {
+	fmt.Print("\033[H\033[2J")
+}
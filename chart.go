@@ -0,0 +1,311 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type chartPoint struct {
+	t time.Time
+	v float64
+}
+
+// lineChart is a single series plotted against time.
+type lineChart struct {
+	title   string
+	points  []chartPoint
+	formatY func(float64) string
+	// integerTicks places the y axis ticks on whole numbers
+	integerTicks bool
+}
+
+const (
+	chartWidth  = 800
+	chartHeight = 400
+	chartMargin = 60
+)
+
+func chartCommand(args []string) {
+	fs := flag.NewFlagSet("chart", flag.ExitOnError)
+	var (
+		dbPath  = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		metric  = fs.String("metric", "winrate", "What to chart: winrate (over a moving window of games), rating or quality (points lost per move by month)")
+		window  = fs.Int("window", 20, "The number of games the winrate metric is averaged over")
+		phase   = fs.String("phase", "", "The phase of the game the quality metric is for: opening, middle or endgame (defaults to every move)")
+		outPath = fs.String("o", "", "The .svg or .png file to write")
+		filter  gameFilter
+	)
+	filter.register(fs)
+	fs.Parse(args)
+
+	names, err := filter.perspective()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *outPath == "" {
+		log.Fatal("The -o argument must be specified")
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	games, err := playerGames(db, names, &filter)
+	if err != nil {
+		log.Fatalf("error reading games: %s\n", err)
+	}
+
+	var c lineChart
+	switch *metric {
+	case "winrate":
+		c = winRateChart(strings.Join(names, ", "), games, *window)
+	case "rating":
+		c = ratingChart(strings.Join(names, ", "), games)
+	case "quality":
+		if *phase != "" && *phase != phaseOpening && *phase != phaseMiddle && *phase != phaseEndgame {
+			log.Fatalf("unknown phase %q\n", *phase)
+		}
+		months, _, err := monthlyQuality(db, games)
+		if err != nil {
+			log.Fatalf("error reading move quality: %s\n", err)
+		}
+		c = qualityChart(strings.Join(names, ", "), months, *phase)
+	default:
+		log.Fatalf("unknown metric %q\n", *metric)
+	}
+	if len(c.points) < 2 {
+		log.Fatal("not enough dated games to draw a chart")
+	}
+
+	out, err := os.Create(*outPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+	switch strings.ToLower(filepath.Ext(*outPath)) {
+	case ".png":
+		err = c.writePNG(out)
+	default:
+		err = c.writeSVG(out)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func gameTime(timestamp string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	return t, err == nil
+}
+
+func winRateChart(player string, games []playerGame, window int) lineChart {
+	c := lineChart{
+		title:   fmt.Sprintf("%s: win rate over the last %d decided games", player, window),
+		formatY: func(v float64) string { return fmt.Sprintf("%.0f%%", v*100) },
+	}
+	var recent []bool
+	for _, g := range games {
+		if !g.outcome.decided() {
+			continue
+		}
+		recent = append(recent, g.outcome == outcomeWin)
+		if len(recent) > window {
+			recent = recent[1:]
+		}
+		t, ok := gameTime(g.timestamp)
+		if !ok || len(recent) < window {
+			continue
+		}
+		var wins int
+		for _, w := range recent {
+			if w {
+				wins++
+			}
+		}
+		c.points = append(c.points, chartPoint{t, float64(wins) / float64(len(recent))})
+	}
+	return c
+}
+
+func ratingChart(player string, games []playerGame) lineChart {
+	c := lineChart{
+		title:        fmt.Sprintf("%s: rank", player),
+		formatY:      formatRank,
+		integerTicks: true,
+	}
+	for _, g := range games {
+		if !g.rank.known {
+			continue
+		}
+		t, ok := gameTime(g.timestamp)
+		if !ok {
+			continue
+		}
+		c.points = append(c.points, chartPoint{t, g.rank.value})
+	}
+	return c
+}
+
+// bounds returns the ranges of the data, padded so lines don't sit on the
+// axes.
+func (c lineChart) bounds() (time.Time, time.Time, float64, float64) {
+	t0, t1 := c.points[0].t, c.points[0].t
+	v0, v1 := c.points[0].v, c.points[0].v
+	for _, p := range c.points {
+		if p.t.Before(t0) {
+			t0 = p.t
+		}
+		if p.t.After(t1) {
+			t1 = p.t
+		}
+		v0 = math.Min(v0, p.v)
+		v1 = math.Max(v1, p.v)
+	}
+	if t1.Equal(t0) {
+		t1 = t0.Add(24 * time.Hour)
+	}
+	if c.integerTicks {
+		v0, v1 = math.Floor(v0)-1, math.Ceil(v1)+1
+	} else if v1 == v0 {
+		v0, v1 = v0-1, v1+1
+	}
+	return t0, t1, v0, v1
+}
+
+// scale maps data to pixel coordinates.
+func (c lineChart) scale() func(chartPoint) (float64, float64) {
+	t0, t1, v0, v1 := c.bounds()
+	span := t1.Sub(t0).Seconds()
+	return func(p chartPoint) (float64, float64) {
+		x := chartMargin + (chartWidth-2*chartMargin)*p.t.Sub(t0).Seconds()/span
+		y := chartHeight - chartMargin - (chartHeight-2*chartMargin)*(p.v-v0)/(v1-v0)
+		return x, y
+	}
+}
+
+func (c lineChart) yTicks() []float64 {
+	_, _, v0, v1 := c.bounds()
+	var ticks []float64
+	if c.integerTicks {
+		step := math.Ceil((v1 - v0) / 10)
+		for v := v0; v <= v1; v += step {
+			ticks = append(ticks, v)
+		}
+		return ticks
+	}
+	for i := 0; i <= 5; i++ {
+		ticks = append(ticks, v0+(v1-v0)*float64(i)/5)
+	}
+	return ticks
+}
+
+// xTicks returns the starts of years, or of months for shorter spans, along
+// with the layout to label them with.
+func (c lineChart) xTicks() ([]time.Time, string) {
+	t0, t1, _, _ := c.bounds()
+	var ticks []time.Time
+	if t1.Sub(t0) > 2*365*24*time.Hour {
+		for y := t0.Year() + 1; y <= t1.Year(); y++ {
+			ticks = append(ticks, time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC))
+		}
+		return ticks, "2006"
+	}
+	step := int(t1.Sub(t0).Hours()/24/30/12) + 1
+	for m := time.Date(t0.Year(), t0.Month()+1, 1, 0, 0, 0, 0, time.UTC); m.Before(t1); m = m.AddDate(0, step, 0) {
+		ticks = append(ticks, m)
+	}
+	return ticks, "2006-01"
+}
+
+func (c lineChart) writeSVG(w io.Writer) error {
+	scale := c.scale()
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`+"\n", chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="white"/>`+"\n")
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="16">%s</text>`+"\n", chartMargin, chartMargin/2, xmlEscape(c.title))
+
+	for _, v := range c.yTicks() {
+		_, y := scale(chartPoint{c.points[0].t, v})
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/>`+"\n", chartMargin, y, chartWidth-chartMargin, y)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end" dominant-baseline="middle">%s</text>`+"\n", chartMargin-6, y, xmlEscape(c.formatY(v)))
+	}
+	ticks, layout := c.xTicks()
+	for _, t := range ticks {
+		x, _ := scale(chartPoint{t, 0})
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#ddd"/>`+"\n", x, chartMargin, x, chartHeight-chartMargin)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`+"\n", x, chartHeight-chartMargin+18, t.Format(layout))
+	}
+	fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="none" stroke="black"/>`+"\n", chartMargin, chartMargin, chartWidth-2*chartMargin, chartHeight-2*chartMargin)
+
+	var coords []string
+	for _, p := range c.points {
+		x, y := scale(p)
+		coords = append(coords, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="#1f77b4" stroke-width="2"/>`+"\n", strings.Join(coords, " "))
+	b.WriteString("</svg>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writePNG draws the chart without any text, which the standard library has
+// no way of rendering; use SVG output for a labelled chart.
+func (c lineChart) writePNG(w io.Writer) error {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	scale := c.scale()
+	grid := color.RGBA{0xdd, 0xdd, 0xdd, 0xff}
+	for _, v := range c.yTicks() {
+		_, y := scale(chartPoint{c.points[0].t, v})
+		drawLine(img, chartMargin, y, chartWidth-chartMargin, y, grid)
+	}
+	ticks, _ := c.xTicks()
+	for _, t := range ticks {
+		x, _ := scale(chartPoint{t, 0})
+		drawLine(img, x, chartMargin, x, chartHeight-chartMargin, grid)
+	}
+	axis := color.RGBA{0, 0, 0, 0xff}
+	drawLine(img, chartMargin, chartMargin, chartMargin, chartHeight-chartMargin, axis)
+	drawLine(img, chartMargin, chartHeight-chartMargin, chartWidth-chartMargin, chartHeight-chartMargin, axis)
+
+	series := color.RGBA{0x1f, 0x77, 0xb4, 0xff}
+	for i := 1; i < len(c.points); i++ {
+		x0, y0 := scale(c.points[i-1])
+		x1, y1 := scale(c.points[i])
+		drawLine(img, x0, y0, x1, y1, series)
+		drawLine(img, x0, y0+1, x1, y1+1, series)
+	}
+	return png.Encode(w, img)
+}
+
+// drawLine plots a straight line by stepping along its longer axis.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 float64, c color.RGBA) {
+	steps := math.Max(math.Abs(x1-x0), math.Abs(y1-y0))
+	if steps < 1 {
+		steps = 1
+	}
+	for i := 0.0; i <= steps; i++ {
+		x := x0 + (x1-x0)*i/steps
+		y := y0 + (y1-y0)*i/steps
+		img.SetRGBA(int(math.Round(x)), int(math.Round(y)), c)
+	}
+}
+
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(s)
+}
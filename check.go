@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// integrityChecks are queries which each select the ids of the rows breaking
+// one rule the rest of the program relies on.
+var integrityChecks = []struct {
+	problem string
+	query   string
+}{
+	// orphaned rows
+	{"games whose black player is missing", `
+		select g.id from games g where g.black_id not in (select id from players)`},
+	{"games whose white player is missing", `
+		select g.id from games g where g.white_id not in (select id from players)`},
+	{"games whose winner is missing", `
+		select g.id from games g where g.winner_id is not null and g.winner_id not in (select id from players)`},
+	{"tag links to missing games", `
+		select gt.game_id from game_tags gt where gt.game_id not in (select id from games)`},
+	{"tag links to missing tags", `
+		select gt.game_id from game_tags gt where gt.tag_id not in (select id from tags)`},
+	{"notes on missing games", `
+		select n.id from notes n where n.game_id not in (select id from games)`},
+	{"collection entries for missing games", `
+		select cg.game_id from collection_games cg where cg.game_id not in (select id from games)`},
+	{"collection entries in missing collections", `
+		select cg.game_id from collection_games cg where cg.collection_id not in (select id from collections)`},
+	{"moves of missing games", `
+		select distinct m.game_id from moves m where m.game_id not in (select id from games)`},
+	{"profiles of missing players", `
+		select pp.player_id from player_profiles pp where pp.player_id not in (select id from players)`},
+
+	// fields which should never be empty; a game's timestamp may be missing
+	// when its date couldn't be read
+	{"games with an empty timestamp", `
+		select g.id from games g where g.timestamp = ''`},
+	{"players without a name", `
+		select p.id from players p where trim(p.name) = ''`},
+
+	// impossible data
+	{"games won by neither player", `
+		select g.id from games g where g.winner_id is not null and g.winner_id not in (g.black_id, g.white_id)`},
+	{"drawn or void games with a winner", `
+		select g.id from games g where g.result in ('jigo', 'void') and g.winner_id is not null`},
+	{"games played against oneself", `
+		select g.id from games g where g.black_id = g.white_id`},
+	{"notes on negative moves", `
+		select n.id from notes n where n.move_number < 0`},
+}
+
+func checkCommand(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	dbPath := fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to check")
+	fs.Parse(args)
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	problems, err := checkIntegrity(db)
+	if err != nil {
+		log.Fatalf("error checking the database: %s\n", err)
+	}
+	if problems > 0 {
+		fmt.Printf("found %d problems\n", problems)
+		os.Exit(1)
+	}
+	fmt.Println("no problems found")
+}
+
+// checkIntegrity prints the rows breaking each of the integrity checks and
+// returns how many it found.
+func checkIntegrity(db *sql.DB) (int, error) {
+	var problems int
+	for _, c := range integrityChecks {
+		ids, err := queryIDs(db, c.query)
+		if err != nil {
+			return problems, fmt.Errorf("problem finding %s: %s", c.problem, err)
+		}
+		if len(ids) > 0 {
+			fmt.Printf("%d %s: %s\n", len(ids), c.problem, sampleIDs(ids))
+			problems += len(ids)
+		}
+	}
+
+	// dates which made it in but can't be read back
+	rows, err := db.Query("select id, timestamp from games where timestamp != ''")
+	if err != nil {
+		return problems, err
+	}
+	defer rows.Close()
+	var unreadable []int64
+	for rows.Next() {
+		var id int64
+		var ts string
+		if err := rows.Scan(&id, &ts); err != nil {
+			return problems, err
+		}
+		if _, err := time.Parse(time.RFC3339, ts); err != nil {
+			unreadable = append(unreadable, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return problems, err
+	}
+	if len(unreadable) > 0 {
+		fmt.Printf("%d games with unreadable timestamps: %s\n", len(unreadable), sampleIDs(unreadable))
+		problems += len(unreadable)
+	}
+	return problems, nil
+}
+
+func queryIDs(db queryer, query string) ([]int64, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// sampleIDs lists the first few ids of a problem, which is enough to start
+// looking without flooding the terminal.
+func sampleIDs(ids []int64) string {
+	const shown = 10
+	var s []string
+	for i, id := range ids {
+		if i == shown {
+			s = append(s, fmt.Sprintf("and %d more", len(ids)-shown))
+			break
+		}
+		s = append(s, fmt.Sprint(id))
+	}
+	return strings.Join(s, ", ")
+}
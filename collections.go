@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+const collectionUsage = `usage:
+  collection create [-db-path PATH] NAME
+  collection delete [-db-path PATH] NAME
+  collection add [-db-path PATH] [FILTERS] NAME [GAME_ID...]
+  collection remove [-db-path PATH] [FILTERS] NAME [GAME_ID...]
+  collection list [-db-path PATH] [NAME]
+  collection export [-db-path PATH] [-o FILE] [-normalize | CLEAN-UPS] NAME
+
+add and remove act on the listed games and on every game matching the
+filters, such as -tag. export takes the clean-ups of export-tree: -utf8,
+-fill-info, -strip-variations, -sort-properties or all of them with
+-normalize.`
+
+func collectionCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, collectionUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "create", "delete", "add", "remove", "list", "export":
+	default:
+		fmt.Fprintln(os.Stderr, collectionUsage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("collection "+args[0], flag.ExitOnError)
+	var (
+		dbPath  = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to use")
+		outPath = fs.String("o", "", "The file to export to (defaults to standard output)")
+		filter  gameFilter
+		norm    sgfNormalization
+	)
+	filter.register(fs)
+	norm.register(fs)
+	fs.Parse(args[1:])
+
+	if args[0] != "list" && fs.NArg() < 1 {
+		log.Fatalf("collection %s needs a collection name\n", args[0])
+	}
+	name := fs.Arg(0)
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "create":
+		_, err = db.Exec("insert into collections (name) values (?)", name)
+		if err != nil {
+			log.Fatalf("error creating collection %q: %s\n", name, err)
+		}
+	case "delete":
+		err = deleteCollection(db, name)
+	case "add", "remove":
+		var ids []int64
+		ids, err = parseGameIDs(fs.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !filter.empty() {
+			var matched []int64
+			matched, err = filteredGameIDs(db, &filter)
+			if err != nil {
+				log.Fatalf("error finding games: %s\n", err)
+			}
+			ids = append(ids, matched...)
+		} else if len(ids) == 0 {
+			log.Fatalf("collection %s needs game ids or filters\n", args[0])
+		}
+		var n int
+		n, err = changeCollection(db, name, ids, args[0] == "add")
+		if err == nil {
+			log.Printf("%sd %d games\n", args[0], n)
+		}
+	case "list":
+		if name == "" {
+			err = listCollections(db)
+		} else {
+			var ids []int64
+			ids, err = collectionGameIDs(db, name)
+			for _, id := range ids {
+				fmt.Println(id)
+			}
+		}
+	case "export":
+		var ids []int64
+		ids, err = collectionGameIDs(db, name)
+		if err != nil {
+			break
+		}
+		out := os.Stdout
+		if *outPath != "" {
+			out, err = os.Create(*outPath)
+			if err != nil {
+				break
+			}
+			defer out.Close()
+		}
+		err = writeSGFCollection(out, db, ids, norm)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func collectionID(q queryer, name string) (int64, error) {
+	var id int64
+	err := q.QueryRow("select id from collections where name = ?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("there is no collection named %q", name)
+	}
+	return id, err
+}
+
+func deleteCollection(db *sql.DB, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id, err := collectionID(tx, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from collection_games where collection_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from collections where id = ?", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// changeCollection adds the games to, or removes them from, the collection and
+// returns the number of memberships which changed.
+func changeCollection(db *sql.DB, name string, ids []int64, add bool) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	collection, err := collectionID(tx, name)
+	if err != nil {
+		return 0, err
+	}
+	query := "delete from collection_games where collection_id = ? and game_id = ?"
+	if add {
+		query = "insert or ignore into collection_games (collection_id, game_id) select ?, id from games where id = ?"
+	}
+	var changed int
+	for _, id := range ids {
+		result, err := tx.Exec(query, collection, id)
+		if err != nil {
+			return 0, fmt.Errorf("problem changing game %d: %s", id, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		changed += int(n)
+	}
+	return changed, tx.Commit()
+}
+
+func collectionGameIDs(db *sql.DB, name string) ([]int64, error) {
+	collection, err := collectionID(db, name)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`
+		select cg.game_id
+		from collection_games cg
+		join games g on g.id = cg.game_id
+		where cg.collection_id = ?
+		order by g.timestamp, g.id`,
+		collection,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func listCollections(db *sql.DB) error {
+	rows, err := db.Query(`
+		select c.name, count(cg.game_id)
+		from collections c
+		left join collection_games cg on cg.collection_id = c.id
+		group by c.id
+		order by c.name`,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name  string
+			count int
+		)
+		if err := rows.Scan(&name, &count); err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%d\n", name, count)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const compareUsage = `usage:
+  compare [-db-path PATH] -period-a PERIOD -period-b PERIOD [-json] [FILTERS]
+
+compare contrasts a player's games in two periods: their results, the
+average rank of their opponents, the first moves they chose and, over the
+games the worker command has analyzed, the points they lost per move and
+how many of their moves were blunders losing 3 points or more. A period is
+a year, a month or a day, like 2023, 2023-06 or 2023-06-30, or a range of
+them like 2023-01..2023-06. It is for -player, or the self names in the
+config file, and the other filters apply to both periods.`
+
+func compareCommand(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	var (
+		dbPath  = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		periodA = fs.String("period-a", "", "The first period, like 2023 or 2023-01..2023-06")
+		periodB = fs.String("period-b", "", "The second period, like 2024 or 2024-01..2024-06")
+		asJSON  = fs.Bool("json", false, "Write the comparison as JSON instead of Markdown")
+		filter  gameFilter
+	)
+	filter.register(fs)
+	fs.Parse(args)
+
+	if *periodA == "" || *periodB == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, compareUsage)
+		os.Exit(2)
+	}
+
+	names, err := filter.perspective()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	c := comparison{Player: strings.Join(names, ", ")}
+	var games [2][]playerGame
+	for i, period := range []string{*periodA, *periodB} {
+		f := filter
+		f.since, f.until = periodBounds(period)
+		games[i], err = playerGames(db, names, &f)
+		if err != nil {
+			log.Fatalf("error reading the games of %s: %s\n", period, err)
+		}
+	}
+	c.A, err = summarizePeriod(db, *periodA, games[0])
+	if err == nil {
+		c.B, err = summarizePeriod(db, *periodB, games[1])
+	}
+	if err != nil {
+		log.Fatalf("error reading the analysis of the games: %s\n", err)
+	}
+	c.Changes = comparePeriods(c.A, c.B, games[0], games[1])
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(c)
+	} else {
+		err = c.print(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// periodBounds turns a period into the -since and -until it stands for.
+func periodBounds(period string) (string, string) {
+	if i := strings.Index(period, ".."); i >= 0 {
+		return period[:i], period[i+2:]
+	}
+	return period, period
+}
+
+type periodSummary struct {
+	Period string `json:"period"`
+	Games  int    `json:"games"`
+	Wins   int    `json:"wins"`
+	Losses int    `json:"losses"`
+	Jigo   int    `json:"jigo"`
+	Void   int    `json:"void"`
+	// WinRate is the share of decided games which were won, or null when
+	// none were
+	WinRate *float64 `json:"win_rate"`
+	// OpponentRank is the average on parseRank's scale over the RankedGames
+	// whose opponent's rank is known
+	OpponentRank     *float64 `json:"average_opponent_rank"`
+	OpponentRankText string   `json:"average_opponent_rank_text,omitempty"`
+	RankedGames      int      `json:"ranked_games"`
+	// PointsLost is the points lost per move and BlunderRate the share of
+	// moves losing blunderPoints or more, over the AnalyzedMoves of the
+	// AnalyzedGames, or null when none were analyzed
+	PointsLost    *float64 `json:"points_lost_per_move"`
+	BlunderRate   *float64 `json:"blunder_rate"`
+	AnalyzedGames int      `json:"analyzed_games"`
+	AnalyzedMoves int      `json:"analyzed_moves"`
+}
+
+// blunderPoints is how many points a move loses to be a blunder.
+const blunderPoints = 3
+
+// openingChange compares how often a first move was chosen in each period,
+// as a share of the games played with that color.
+type openingChange struct {
+	Point  string  `json:"point"`
+	GamesA int     `json:"games_a"`
+	GamesB int     `json:"games_b"`
+	ShareA float64 `json:"share_a"`
+	ShareB float64 `json:"share_b"`
+	Change float64 `json:"change"`
+}
+
+type periodChanges struct {
+	Games        int             `json:"games"`
+	WinRate      *float64        `json:"win_rate"`
+	OpponentRank *float64        `json:"average_opponent_rank"`
+	PointsLost   *float64        `json:"points_lost_per_move"`
+	BlunderRate  *float64        `json:"blunder_rate"`
+	BlackOpening []openingChange `json:"openings_as_black"`
+	WhiteOpening []openingChange `json:"openings_as_white"`
+}
+
+type comparison struct {
+	Player  string        `json:"player"`
+	A       periodSummary `json:"period_a"`
+	B       periodSummary `json:"period_b"`
+	Changes periodChanges `json:"changes"`
+}
+
+func summarizePeriod(db *sql.DB, period string, games []playerGame) (periodSummary, error) {
+	s := periodSummary{Period: period}
+	var t tally
+	var rankSum float64
+	for _, g := range games {
+		t.add(g)
+		if g.opponentRank.known {
+			rankSum += g.opponentRank.value
+			s.RankedGames++
+		}
+	}
+	s.Games, s.Wins, s.Losses, s.Jigo, s.Void = t.games, t.wins, t.losses, t.jigo, t.void
+	if t.wins+t.losses > 0 {
+		rate := float64(t.wins) / float64(t.wins+t.losses)
+		s.WinRate = &rate
+	}
+	if s.RankedGames > 0 {
+		avg := rankSum / float64(s.RankedGames)
+		s.OpponentRank = &avg
+		s.OpponentRankText = formatRank(avg)
+	}
+
+	var (
+		lost      float64
+		blundered int
+	)
+	for _, g := range games {
+		if g.root == nil {
+			continue
+		}
+		evaluations, err := storedEvaluations(db, g.id)
+		if err != nil {
+			return s, err
+		}
+		if len(evaluations) == 0 {
+			continue
+		}
+		color := "B"
+		if g.color == white {
+			color = "W"
+		}
+		s.AnalyzedGames++
+		for _, l := range moveLosses(g.root, evaluations) {
+			if l.color != color {
+				continue
+			}
+			s.AnalyzedMoves++
+			lost += l.points
+			if l.points >= blunderPoints {
+				blundered++
+			}
+		}
+	}
+	if s.AnalyzedMoves > 0 {
+		perMove := lost / float64(s.AnalyzedMoves)
+		rate := float64(blundered) / float64(s.AnalyzedMoves)
+		s.PointsLost, s.BlunderRate = &perMove, &rate
+	}
+	return s, nil
+}
+
+func comparePeriods(a, b periodSummary, gamesA, gamesB []playerGame) periodChanges {
+	return periodChanges{
+		Games:        b.Games - a.Games,
+		WinRate:      difference(a.WinRate, b.WinRate),
+		OpponentRank: difference(a.OpponentRank, b.OpponentRank),
+		PointsLost:   difference(a.PointsLost, b.PointsLost),
+		BlunderRate:  difference(a.BlunderRate, b.BlunderRate),
+		BlackOpening: compareOpenings(gamesA, gamesB, black),
+		WhiteOpening: compareOpenings(gamesA, gamesB, white),
+	}
+}
+
+// difference is b less a, or nil when either is unknown.
+func difference(a, b *float64) *float64 {
+	if a == nil || b == nil {
+		return nil
+	}
+	d := *b - *a
+	return &d
+}
+
+// compareOpenings compares the first moves played with color in two sets of
+// games, most played first.
+func compareOpenings(gamesA, gamesB []playerGame, color stone) []openingChange {
+	count := func(games []playerGame) (map[string]int, int) {
+		counts := make(map[string]int)
+		var total int
+		for _, g := range games {
+			if g.color == color && g.root != nil {
+				counts[openingPoint(g.root, color)]++
+				total++
+			}
+		}
+		return counts, total
+	}
+	countsA, totalA := count(gamesA)
+	countsB, totalB := count(gamesB)
+	share := func(n, total int) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(n) / float64(total)
+	}
+	changes := []openingChange{}
+	seen := make(map[string]bool)
+	for _, counts := range []map[string]int{countsA, countsB} {
+		for point := range counts {
+			if seen[point] {
+				continue
+			}
+			seen[point] = true
+			o := openingChange{
+				Point:  point,
+				GamesA: countsA[point],
+				GamesB: countsB[point],
+				ShareA: share(countsA[point], totalA),
+				ShareB: share(countsB[point], totalB),
+			}
+			o.Change = o.ShareB - o.ShareA
+			changes = append(changes, o)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		ci, cj := changes[i].GamesA+changes[i].GamesB, changes[j].GamesA+changes[j].GamesB
+		if ci != cj {
+			return ci > cj
+		}
+		return changes[i].Point < changes[j].Point
+	})
+	return changes
+}
+
+func (c comparison) print(w io.Writer) error {
+	fmt.Fprintf(w, "# %s: %s compared with %s\n\n", c.Player, c.B.Period, c.A.Period)
+
+	fmt.Fprint(w, "## Results\n\n")
+	header := []string{"", c.A.Period, c.B.Period, "Change"}
+	count := func(label string, a, b int) []string {
+		return []string{label, fmt.Sprint(a), fmt.Sprint(b), fmt.Sprintf("%+d", b-a)}
+	}
+	rows := [][]string{
+		count("Games", c.A.Games, c.B.Games),
+		count("Wins", c.A.Wins, c.B.Wins),
+		count("Losses", c.A.Losses, c.B.Losses),
+		count("Jigo", c.A.Jigo, c.B.Jigo),
+		count("Void", c.A.Void, c.B.Void),
+		{"Win rate", percentText(c.A.WinRate), percentText(c.B.WinRate), percentChangeText(c.Changes.WinRate)},
+		{"Average opponent", opponentText(c.A), opponentText(c.B), stonesText(c.Changes.OpponentRank)},
+		{"Points lost per move", pointsText(c.A), pointsText(c.B), pointsChangeText(c.Changes.PointsLost)},
+		{fmt.Sprintf("Blunders (%d+ points)", blunderPoints), percentText(c.A.BlunderRate), percentText(c.B.BlunderRate), percentChangeText(c.Changes.BlunderRate)},
+	}
+	writeMarkdownTable(w, header, rows)
+
+	for _, color := range []stone{black, white} {
+		changes, heading := c.Changes.BlackOpening, "## First moves as Black\n\n"
+		if color == white {
+			changes, heading = c.Changes.WhiteOpening, "## First moves as White\n\n"
+		}
+		fmt.Fprint(w, heading)
+		if len(changes) == 0 {
+			fmt.Fprint(w, "No games.\n\n")
+			continue
+		}
+		rows = nil
+		for _, o := range changes {
+			rows = append(rows, []string{
+				o.Point,
+				fmt.Sprintf("%d (%.0f%%)", o.GamesA, 100*o.ShareA),
+				fmt.Sprintf("%d (%.0f%%)", o.GamesB, 100*o.ShareB),
+				fmt.Sprintf("%+.0f%%", 100*o.Change),
+			})
+		}
+		header[0] = "Point"
+		writeMarkdownTable(w, header, rows)
+	}
+	return nil
+}
+
+func percentText(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", 100**v)
+}
+
+func percentChangeText(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%+.0f%%", 100**v)
+}
+
+func opponentText(s periodSummary) string {
+	if s.OpponentRank == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%s (%d games)", s.OpponentRankText, s.RankedGames)
+}
+
+func pointsText(s periodSummary) string {
+	if s.PointsLost == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f (%d games)", *s.PointsLost, s.AnalyzedGames)
+}
+
+func pointsChangeText(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%+.2f", *v)
+}
+
+// stonesText describes a change in rank in stones.
+func stonesText(v *float64) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f stones", *v)
+}
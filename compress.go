@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+)
+
+// compressed reports whether data starts like a gzip or bzip2 file.
+func compressed(data []byte) bool {
+	return bytes.HasPrefix(data, gzipMagic) || bytes.HasPrefix(data, bzip2Magic)
+}
+
+// decompress returns a reader of r's contents, decompressing them when they
+// are gzip or bzip2 compressed. Files are recognized by their contents rather
+// than their names, so games compressed in place import whatever they are
+// called.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	start, err := br.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(start, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(start, bzip2Magic):
+		return bzip2.NewReader(br), nil
+	}
+	return br, nil
+}
+
+// sizeLimitedReader fails once more than limit bytes have been read, which
+// keeps a small compressed file from expanding past the file size limit.
+type sizeLimitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, fmt.Errorf("the file is over the limit of %d bytes once decompressed", l.limit)
+	}
+	return n, err
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the defaults read from the configuration file. Command line
+// flags override anything set here. A configuration file looks like:
+//
+//	db_path = "~/go/games.db"
+//	sgf_dirs = ["~/go/ogs", "~/go/kgs"]
+//	workers = 8
+//	busy_timeout_ms = 5000
+//	self = ["apiarian", "apiarian-kgs"]
+//	engine = ["katago", "analysis", "-config", "analysis.cfg", "-model", "model.bin.gz"]
+//	engine_visits = 200
+//	bots = ["*bot", "gnugo*"]
+//
+//	[networks]
+//	"~/go/ogs" = "OGS"
+//	"~/go/kgs" = "KGS"
+//
+//	[timezones]
+//	KGS = "America/Los_Angeles"
+//
+//	[credentials.ogs]
+//	token = "keychain"
+//
+//	[guests]
+//	KGS = ["guest*"]
+//
+//	[policies.short]
+//	shorter_than = 20
+//	action = "reject"
+//
+//	[policies.bot-blitz]
+//	bot = true
+//	speed = "blitz"
+//	unrated = true
+//	action = "reject"
+type Config struct {
+	DBPath  string
+	SGFDirs []string
+	Workers int
+	// BusyTimeout is how many milliseconds a connection waits for another
+	// connection's lock on the database before failing.
+	BusyTimeout int
+	// Network is used for games outside of every directory in Networks.
+	Network string
+	// Networks maps source directories to the network their games were
+	// played on.
+	Networks map[string]string
+	// Timezone is the zone game dates are in unless Timezones has one for
+	// the game's network.
+	Timezone  string
+	Timezones map[string]string
+	// Credentials holds the login details for each network, keyed by the
+	// lower cased network name and then by setting, like
+	// credentials.ogs.username. Settings given as "keychain" are read from
+	// the operating system's keychain when they're needed.
+	Credentials map[string]map[string]string
+	// Self names the user's own accounts, so per-player statistics can be
+	// taken from their side of the board without naming them every time.
+	Self []string
+	// Guests lists the name patterns of each network's guest or anonymous
+	// accounts, matched without regard to case. Games against any of them are
+	// stored against a single guest player for the network.
+	Guests map[string][]string
+	// Bots lists the name patterns of computer players, matched without
+	// regard to case, on top of those marked as bots by their profiles.
+	Bots []string
+	// Policies hold back the games they match from imports, by name.
+	Policies map[string]*importPolicy
+	// Engine is the command line of the KataGo analysis engine the worker
+	// evaluates games with, and EngineVisits how many visits it's asked to
+	// spend on each position, or 0 to leave that to its own configuration.
+	Engine       []string
+	EngineVisits int
+}
+
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Workers:     20,
+		BusyTimeout: 5000,
+		Network:     "sample",
+		Networks:    make(map[string]string),
+		Timezones:   make(map[string]string),
+		Credentials: make(map[string]map[string]string),
+		Policies:    make(map[string]*importPolicy),
+		Guests: map[string][]string{
+			"kgs": {"guest*"},
+			"igs": {"guest*"},
+			"ogs": {"anonymous*"},
+		},
+		Bots: []string{"*bot", "*gnugo*", "*gnu go*", "*katago*", "*leela*", "*pachi*", "*fuego*", "*golaxy*"},
+	}
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, appName, "config.toml")
+}
+
+// extractConfigFlag removes a -config flag from anywhere in the arguments so
+// that every command accepts it, returning the remaining arguments and the
+// flag's value.
+func extractConfigFlag(args []string) ([]string, string) {
+	var rest []string
+	var path string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-config" || a == "--config":
+			if i+1 < len(args) {
+				path = args[i+1]
+				i++
+			}
+		case strings.HasPrefix(a, "-config=") || strings.HasPrefix(a, "--config="):
+			path = a[strings.Index(a, "=")+1:]
+		default:
+			rest = append(rest, a)
+		}
+	}
+	return rest, path
+}
+
+// loadConfig reads the configuration file at path. A missing file is only an
+// error when it was asked for explicitly.
+func loadConfig(path string, explicit bool) (*Config, error) {
+	c := defaultConfig()
+	if path == "" {
+		return c, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !explicit {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values, err := parseTOML(f)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading %s: %s", path, err)
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := values[k]
+		var ok bool
+		switch {
+		case k == "db_path":
+			c.DBPath, ok = v.(string)
+			c.DBPath = expandHome(c.DBPath)
+		case k == "sgf_dirs":
+			c.SGFDirs, ok = v.([]string)
+			for i := range c.SGFDirs {
+				c.SGFDirs[i] = expandHome(c.SGFDirs[i])
+			}
+		case k == "workers":
+			var n int64
+			n, ok = v.(int64)
+			c.Workers = int(n)
+			ok = ok && n > 0
+		case k == "busy_timeout_ms":
+			var n int64
+			n, ok = v.(int64)
+			c.BusyTimeout = int(n)
+			ok = ok && n >= 0
+		case k == "self":
+			// a single account may be given as a plain string
+			var name string
+			if name, ok = v.(string); ok {
+				c.Self = []string{name}
+			} else {
+				c.Self, ok = v.([]string)
+			}
+		case k == "engine":
+			c.Engine, ok = v.([]string)
+			ok = ok && len(c.Engine) > 0
+			for i := range c.Engine {
+				c.Engine[i] = expandHome(c.Engine[i])
+			}
+		case k == "engine_visits":
+			var n int64
+			n, ok = v.(int64)
+			c.EngineVisits = int(n)
+			ok = ok && n >= 0
+		case k == "network":
+			c.Network, ok = v.(string)
+		case strings.HasPrefix(k, "networks."):
+			var network string
+			network, ok = v.(string)
+			c.Networks[expandHome(strings.TrimPrefix(k, "networks."))] = network
+		case k == "timezone":
+			c.Timezone, ok = v.(string)
+		case strings.HasPrefix(k, "timezones."):
+			var zone string
+			zone, ok = v.(string)
+			c.Timezones[strings.TrimPrefix(k, "timezones.")] = zone
+		case strings.HasPrefix(k, "credentials."):
+			parts := strings.SplitN(strings.TrimPrefix(k, "credentials."), ".", 2)
+			parts[0] = strings.ToLower(parts[0])
+			var s string
+			s, ok = v.(string)
+			if ok && len(parts) == 2 {
+				if c.Credentials[parts[0]] == nil {
+					c.Credentials[parts[0]] = make(map[string]string)
+				}
+				c.Credentials[parts[0]][parts[1]] = s
+			}
+		case k == "bots":
+			c.Bots, ok = v.([]string)
+			for _, p := range c.Bots {
+				_, err := filepath.Match(p, "")
+				ok = ok && err == nil
+			}
+		case strings.HasPrefix(k, "guests."):
+			var patterns []string
+			patterns, ok = v.([]string)
+			for _, p := range patterns {
+				_, err := filepath.Match(p, "")
+				ok = ok && err == nil
+			}
+			c.Guests[strings.ToLower(strings.TrimPrefix(k, "guests."))] = patterns
+		case strings.HasPrefix(k, "policies."):
+			parts := strings.SplitN(strings.TrimPrefix(k, "policies."), ".", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("policies.%s should be in a policy's table in %s", parts[0], path)
+			}
+			if err := c.setPolicy(parts[0], parts[1], v); err != nil {
+				return nil, fmt.Errorf("%s in %s", err, path)
+			}
+			ok = true
+		default:
+			return nil, fmt.Errorf("unknown setting %s in %s", k, path)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s has the wrong type in %s", k, path)
+		}
+	}
+	if err := c.checkPolicies(); err != nil {
+		return nil, fmt.Errorf("%s in %s", err, path)
+	}
+	return c, nil
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+// networkFor returns the network of the most specific configured directory
+// containing path or, for paths outside of all of them, the network whose
+// adapter recognizes the game.
+func (c *Config) networkFor(path string, root *sgfNode) string {
+	network, longest := c.Network, -1
+	for dir, n := range c.Networks {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if len(dir) > longest {
+			network, longest = n, len(dir)
+		}
+	}
+	if longest < 0 {
+		if detected, ok := detectNetwork(root); ok {
+			return detected
+		}
+	}
+	return network
+}
+
+// guestName is the player guest accounts are stored as.
+const guestName = "(guest)"
+
+// playerName returns the name to store a player under, which is guestName for
+// the guest accounts of the network.
+func (c *Config) playerName(network, name string) string {
+	for _, pattern := range c.Guests[strings.ToLower(network)] {
+		if ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return guestName
+		}
+	}
+	return name
+}
+
+// isBot reports whether a player's name looks like a computer player's.
+func (c *Config) isBot(name string) bool {
+	for _, pattern := range c.Bots {
+		if ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneFor returns the configured time zone for games on a network, or nil
+// when there isn't one.
+func (c *Config) zoneFor(network string) (*time.Location, error) {
+	name := c.Timezones[network]
+	if name == "" {
+		name = c.Timezone
+	}
+	if name == "" {
+		return nil, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// parseTOML reads the subset of TOML the configuration needs: tables, and
+// keys holding strings, integers, booleans or arrays of strings. Keys are
+// returned with their table names, like "credentials.ogs.username".
+func parseTOML(r io.Reader) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	var table string
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(stripTOMLComment(s.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: unsupported table header", n)
+			}
+			parts, err := splitTOMLKey(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			table = strings.Join(parts, ".")
+			continue
+		}
+		eq := tomlKeyEnd(line)
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		parts, err := splitTOMLKey(line[:eq])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		key := strings.Join(parts, ".")
+		if table != "" {
+			key = table + "." + key
+		}
+		v, err := parseTOMLValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		values[key] = v
+	}
+	return values, s.Err()
+}
+
+// stripTOMLComment removes a # comment which isn't inside a string.
+func stripTOMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitTOMLKey splits a dotted key, allowing quoted parts such as the paths
+// used in the networks table.
+func splitTOMLKey(key string) ([]string, error) {
+	var parts []string
+	key = strings.TrimSpace(key)
+	for {
+		var part string
+		if key != "" && (key[0] == '"' || key[0] == '\'') {
+			end := strings.IndexByte(key[1:], key[0])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted key %s", key)
+			}
+			part, key = key[1:end+1], strings.TrimSpace(key[end+2:])
+		} else if dot := strings.IndexByte(key, '.'); dot >= 0 {
+			part, key = strings.TrimSpace(key[:dot]), key[dot:]
+			if part == "" {
+				return nil, errors.New("empty key")
+			}
+		} else {
+			part, key = strings.TrimSpace(key), ""
+			if part == "" {
+				return nil, errors.New("empty key")
+			}
+		}
+		parts = append(parts, part)
+		if key == "" {
+			return parts, nil
+		}
+		if key[0] != '.' {
+			return nil, fmt.Errorf("expected a dot before %s", key)
+		}
+		key = strings.TrimSpace(key[1:])
+	}
+}
+
+// tomlKeyEnd returns the position of the = ending the key of a line, which
+// may be quoted and hold one, or -1 when there isn't one.
+func tomlKeyEnd(line string) int {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '=':
+			return i
+		}
+	}
+	return -1
+}
+
+func parseTOMLValue(v string) (interface{}, error) {
+	switch {
+	case v == "true":
+		return true, nil
+	case v == "false":
+		return false, nil
+	case strings.HasPrefix(v, `"`):
+		return strconv.Unquote(v)
+	case strings.HasPrefix(v, "'"):
+		if len(v) < 2 || !strings.HasSuffix(v, "'") {
+			return nil, fmt.Errorf("unterminated string %s", v)
+		}
+		return v[1 : len(v)-1], nil
+	case strings.HasPrefix(v, "["):
+		if !strings.HasSuffix(v, "]") {
+			return nil, fmt.Errorf("arrays must be on one line")
+		}
+		var items []string
+		for _, item := range splitTOMLArray(v[1 : len(v)-1]) {
+			s, err := parseTOMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			str, ok := s.(string)
+			if !ok {
+				return nil, fmt.Errorf("only arrays of strings are supported")
+			}
+			items = append(items, str)
+		}
+		return items, nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(v, "_", "", -1), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported value %s", v)
+	}
+	return n, nil
+}
+
+// splitTOMLArray splits the inside of an array on the commas outside of
+// strings.
+func splitTOMLArray(v string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			items = append(items, strings.TrimSpace(v[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(v[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// docConfigExample returns the example configuration file in the Config doc
+// comment.
+func docConfigExample(t *testing.T) string {
+	source, err := ioutil.ReadFile("config.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		lines     []string
+		inExample bool
+	)
+	for _, line := range strings.Split(string(source), "\n") {
+		switch {
+		case strings.HasSuffix(line, "A configuration file looks like:"):
+			inExample = true
+		case !inExample:
+		case strings.HasPrefix(line, "type Config struct"):
+			return strings.Join(lines, "\n")
+		case line == "//":
+			lines = append(lines, "")
+		case strings.HasPrefix(line, "//\t"):
+			lines = append(lines, strings.TrimPrefix(line, "//\t"))
+		}
+	}
+	t.Fatal("found no example in the Config doc comment")
+	return ""
+}
+
+func TestDocConfigExampleLoads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	err := ioutil.WriteFile(path, []byte(docConfigExample(t)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"*bot", "gnugo*"}; !reflect.DeepEqual(c.Bots, want) {
+		t.Errorf("bots are %q, want %q", c.Bots, want)
+	}
+	if got := c.Credentials["ogs"]["token"]; got != "keychain" {
+		t.Errorf("the OGS token is %q, want keychain", got)
+	}
+	if got := c.Timezones["KGS"]; got != "America/Los_Angeles" {
+		t.Errorf("the KGS time zone is %q", got)
+	}
+	if got := c.Guests["kgs"]; !reflect.DeepEqual(got, []string{"guest*"}) {
+		t.Errorf("the KGS guests are %q", got)
+	}
+	if c.Workers != 8 || c.EngineVisits != 200 {
+		t.Errorf("workers %d and engine visits %d, want 8 and 200", c.Workers, c.EngineVisits)
+	}
+}
+
+func TestSettingAfterTableBelongsToIt(t *testing.T) {
+	values, err := parseTOML(strings.NewReader("[credentials.ogs]\ntoken = \"x\"\n\nbots = [\"*bot\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := values["credentials.ogs.bots"]; !ok {
+		t.Errorf("bots after a table header was read as %v", values)
+	}
+}
+
+func TestUnknownSettingIsRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := ioutil.WriteFile(path, []byte("colour = \"red\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path, true); err == nil {
+		t.Error("an unknown setting loaded")
+	}
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// migrations bring a database up to the current schema. Once a migration has
+// been applied its position in this list (plus one) is recorded in the
+// database's user_version, so new schema changes must only ever be appended.
+var migrations = []string{
+	// the original schema; written to be a no-op against databases created
+	// before migrations were tracked
+	`
+	create table if not exists players (
+		id integer primary key not null,
+		name text not null,
+		network text
+	);
+	create unique index if not exists player_name_network ON players(name, network);
+	insert or ignore into players (id, name, network) values (0, 'UNKNOWN PLAYER', 'UNKNOWN NETWORK');
+	create table if not exists games (
+		id integer primary key not null,
+		black_id integer not null,
+		white_id integer not null,
+		winner_id integer,
+		timestamp text,
+		foreign key(black_id) references players(id),
+		foreign key(white_id) references players(id)
+	);
+	`,
+	// tags
+	`
+	create table tags (
+		id integer primary key not null,
+		name text not null
+	);
+	create unique index tag_name ON tags(name);
+	create table game_tags (
+		game_id integer not null,
+		tag_id integer not null,
+		primary key (game_id, tag_id),
+		foreign key(game_id) references games(id),
+		foreign key(tag_id) references tags(id)
+	);
+	`,
+	// notes
+	`
+	create table notes (
+		id integer primary key not null,
+		game_id integer not null,
+		move_number integer,
+		body text not null,
+		created text not null,
+		updated text not null,
+		foreign key(game_id) references games(id)
+	);
+	create index note_game ON notes(game_id);
+	`,
+	// game sources and collections
+	`
+	alter table games add column path text;
+	alter table games add column sgf text;
+	create table collections (
+		id integer primary key not null,
+		name text not null
+	);
+	create unique index collection_name ON collections(name);
+	create table collection_games (
+		collection_id integer not null,
+		game_id integer not null,
+		primary key (collection_id, game_id),
+		foreign key(collection_id) references collections(id),
+		foreign key(game_id) references games(id)
+	);
+	`,
+	// incremental imports
+	`
+	create table files (
+		path text primary key not null,
+		hash text not null,
+		imported text not null
+	);
+	create table import_checkpoints (
+		dir text primary key not null,
+		path text not null
+	);
+	`,
+	// attribution properties
+	`
+	alter table games add column source text;
+	alter table games add column user text;
+	alter table games add column annotator text;
+	alter table games add column copyright text;
+	alter table games add column game_comment text;
+	`,
+	// game names and links back to the server
+	`
+	alter table games add column game_name text;
+	alter table games add column source_url text;
+	`,
+	// places
+	`
+	alter table games add column place text;
+	`,
+	// teams
+	`
+	alter table games add column black_team text;
+	alter table games add column white_team text;
+	`,
+	// time zones; timestamps are UTC and timezone records the zone the
+	// game's date was given in, when it was known
+	`
+	alter table games add column timezone text;
+	`,
+	// player profiles fetched from the servers
+	`
+	create table player_profiles (
+		player_id integer primary key not null,
+		remote_id text not null,
+		rating real,
+		rank text,
+		country text,
+		profile_url text,
+		is_bot integer not null default 0,
+		fetched text not null,
+		foreign key(player_id) references players(id)
+	);
+	`,
+	// indexes for the date and player lookups most commands make
+	`
+	create index if not exists game_timestamp ON games(timestamp);
+	create index if not exists game_black ON games(black_id);
+	create index if not exists game_white ON games(white_id);
+	create index if not exists game_winner ON games(winner_id);
+	`,
+	// per year partitions of the games table
+	`
+	create table partitions (
+		name text primary key not null,
+		path text not null
+	);
+	`,
+	// the position of each game within its file, which can hold several
+	`
+	alter table games add column game_index integer;
+	create index game_file ON games(path, game_index);
+	`,
+	// the move trees of games, including variations; node numbers count the
+	// nodes of a game in SGF order, so the root is 0
+	`
+	create table moves (
+		game_id integer not null,
+		node integer not null,
+		parent integer,
+		branch integer not null,
+		move_number integer not null,
+		color text,
+		point text,
+		comment text,
+		main_line integer not null,
+		primary key (game_id, node),
+		foreign key(game_id) references games(id)
+	);
+	`,
+	// how games ended: win, forfeit, jigo, void or unknown; forfeits have a
+	// winner like wins do. Games imported before this only knew winners.
+	`
+	alter table games add column result text;
+	update games set result = 'win' where winner_id is not null;
+	`,
+	// games with a missing player name refer to no player rather than to a
+	// placeholder, which needs the table rebuilt to drop the not null
+	// constraints; guest accounts are marked on their player instead
+	`
+	create table games_new (
+		id integer primary key not null,
+		black_id integer,
+		white_id integer,
+		winner_id integer,
+		timestamp text,
+		path text,
+		sgf text,
+		source text,
+		user text,
+		annotator text,
+		copyright text,
+		game_comment text,
+		game_name text,
+		source_url text,
+		place text,
+		black_team text,
+		white_team text,
+		timezone text,
+		game_index integer,
+		result text,
+		foreign key(black_id) references players(id),
+		foreign key(white_id) references players(id),
+		foreign key(winner_id) references players(id)
+	);
+	insert into games_new
+	select id, nullif(black_id, 0), nullif(white_id, 0), nullif(winner_id, 0), timestamp, path, sgf,
+		source, user, annotator, copyright, game_comment, game_name, source_url, place,
+		black_team, white_team, timezone, game_index, result
+	from games;
+	drop table games;
+	alter table games_new rename to games;
+	create index game_timestamp ON games(timestamp);
+	create index game_black ON games(black_id);
+	create index game_white ON games(white_id);
+	create index game_winner ON games(winner_id);
+	create index game_file ON games(path, game_index);
+	delete from player_profiles where player_id = 0;
+	delete from players where id = 0;
+	alter table players add column is_guest integer not null default 0;
+	`,
+	// the full text search index, with a row per game named by its docid;
+	// rows are added when a search finds games missing from it, so anything
+	// changing the text of a game only has to delete its row
+	`
+	create virtual table search using fts4(players, event, comments);
+	create trigger note_added after insert on notes begin
+		delete from search where docid = new.game_id;
+	end;
+	create trigger note_updated after update on notes begin
+		delete from search where docid = old.game_id;
+		delete from search where docid = new.game_id;
+	end;
+	create trigger note_removed after delete on notes begin
+		delete from search where docid = old.game_id;
+	end;
+	`,
+	// where the last recorded digest of each player, or of everyone when
+	// player is empty, left off: the newest game it saw and the ratings then
+	`
+	create table digest_runs (
+		player text primary key not null,
+		ran text not null,
+		last_game_id integer not null
+	);
+	create table digest_ratings (
+		player text not null,
+		player_id integer not null,
+		rating real,
+		rank text,
+		primary key (player, player_id)
+	);
+	`,
+	// ranks on parseRank's numeric scale, read from BR and WR and from the
+	// servers' profiles; the games of existing databases are filled in by
+	// backfillRanks
+	`
+	alter table games add column black_rank real;
+	alter table games add column black_rank_uncertain integer;
+	alter table games add column white_rank real;
+	alter table games add column white_rank_uncertain integer;
+	create index game_black_rank on games(black_rank);
+	create index game_white_rank on games(white_rank);
+	alter table player_profiles add column rank_value real;
+	`,
+	// computer players, from their profiles and, by backfillBots, their names
+	`
+	alter table players add column is_bot integer not null default 0;
+	update players set is_bot = 1 where id in (select player_id from player_profiles where is_bot = 1);
+	`,
+	// blitz, live or correspondence, from gameSpeed; filled in for existing
+	// games by backfillSpeeds
+	`
+	alter table games add column speed text;
+	create index game_speed on games(speed);
+	`,
+	// the time each player had left after their moves, from BL and WL; filled
+	// in for existing games by backfillMoveTimes
+	`
+	alter table moves add column time_left real;
+	`,
+	// teaching and review games, guessed by isTeachingGame and filled in for
+	// existing games by backfillTeaching
+	`
+	alter table games add column is_teaching integer not null default 0;
+	`,
+	// games held back from imports by the configured policies, with the
+	// policy and what it did with them
+	`
+	create table quarantine (
+		id integer primary key,
+		path text not null,
+		game_index integer not null,
+		network text,
+		sgf text,
+		policy text not null,
+		action text not null,
+		reason text,
+		held text not null,
+		unique (path, game_index)
+	);
+	`,
+	// the worker's queue of games to analyze, with how far each has got, and
+	// the engine's evaluation of each position of their main lines, from
+	// Black's side
+	`
+	create table analysis_jobs (
+		game_id integer primary key,
+		status text not null,
+		queued text not null,
+		started text,
+		finished text,
+		attempts integer not null default 0,
+		engine text,
+		error text,
+		foreign key(game_id) references games(id)
+	);
+	create index analysis_job_status on analysis_jobs(status);
+	create table evaluations (
+		game_id integer not null,
+		move_number integer not null,
+		winrate real not null,
+		score_lead real,
+		visits integer,
+		primary key (game_id, move_number),
+		foreign key(game_id) references games(id)
+	);
+	`,
+	// the imports which ran to the end, with their summaries as JSON
+	`
+	create table import_runs (
+		id integer primary key,
+		started text not null,
+		finished text not null,
+		summary text not null
+	);
+	`,
+	// the forms of players' names, keyed by normalizeName, and the name each
+	// player goes by; filled in by seedNameAliases
+	`
+	create table name_aliases (
+		alias_key text primary key not null,
+		alias text not null,
+		name text not null,
+		source text not null
+	);
+	alter table players add column canonical_name text;
+	create index player_canonical_name on players(canonical_name);
+	`,
+	// the pairs of players which players dupes was told are different
+	// people, the lower id first
+	`
+	create table player_dupe_dismissals (
+		player_a integer not null,
+		player_b integer not null,
+		dismissed text not null,
+		primary key (player_a, player_b)
+	);
+	`,
+	// the points each side lost to the engine's best play in each phase of
+	// an analyzed game, summed from its evaluations by the worker
+	`
+	create table move_quality (
+		game_id integer not null,
+		color text not null,
+		phase text not null,
+		moves integer not null,
+		points_lost real not null,
+		primary key (game_id, color, phase),
+		foreign key(game_id) references games(id)
+	);
+	`,
+	// the order games were added to the library in, which digests keep their
+	// place by since the ids of deleted games are given out again; filled in
+	// by recordAdditions. last_seq takes over from last_game_id.
+	`
+	create table game_additions (
+		seq integer primary key autoincrement,
+		game_id integer not null unique
+	);
+	alter table digest_runs add column last_seq integer;
+	`,
+	// dates without a time of day are kept as the local date they were given
+	// in; backfillLocalDates undoes the move to UTC of the earlier imports
+	`
+	create index game_timezone on games(timezone);
+	`,
+	// the games are indexed again under the names their players go by and
+	// the other forms of them as well
+	`
+	delete from search;
+	`,
+	// the names, on their networks, of the players merged into others by
+	// players dupes, and the ids of the players they were merged into
+	`
+	create table player_merges (
+		name text not null,
+		network text not null,
+		player_id integer not null,
+		primary key (name, network),
+		foreign key(player_id) references players(id)
+	);
+	`,
+	// a key of each game's players, date and main line, which import -refresh
+	// matches the games of changed files by; see contentKey
+	`
+	alter table games add column content_key text;
+	`,
+	// the move the engine would play in each position it evaluated, in GTP
+	// coordinates; games analyzed before this have none
+	`
+	alter table evaluations add column best_move text;
+	`,
+	// moves were stored a batch at a time outside of their game's
+	// transaction, so an import stopped part way could leave a game with only
+	// some of its moves, or moves without their game; backfillMoves stores
+	// them again from the games' SGF text
+	`
+	delete from moves where game_id not in (select id from games);
+	`,
+}
+
+// migrationFixups finish migrations, by number, which need more than SQL.
+// They run in the same transaction as their migration.
+var migrationFixups = map[int]func(tx *sql.Tx) error{
+	20: backfillRanks,
+	21: backfillBots,
+	22: backfillSpeeds,
+	23: backfillMoveTimes,
+	24: backfillTeaching,
+	28: seedNameAliases,
+	32: backfillLocalDates,
+	35: backfillContentKeys,
+	37: backfillMoves,
+}
+
+// backfillBots marks the existing players whose names match the bot
+// patterns.
+func backfillBots(tx *sql.Tx) error {
+	rows, err := tx.Query("select id, name from players where is_bot = 0")
+	if err != nil {
+		return err
+	}
+	var bots []int64
+	for rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		if config.isBot(name) {
+			bots = append(bots, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range bots {
+		if _, err := tx.Exec("update players set is_bot = 1 where id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// visitStoredGames calls fn with the game tree of every game stored with its
+// SGF text, skipping any which can't be read.
+func visitStoredGames(db queryer, fn func(id int64, root *sgfNode)) error {
+	rows, err := db.Query("select id, sgf from games where sgf is not null")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id     int64
+			source string
+		)
+		if err := rows.Scan(&id, &source); err != nil {
+			return err
+		}
+		games, err := readCollection([]byte(source))
+		if err != nil || len(games) == 0 {
+			continue
+		}
+		fn(id, games[0].root)
+	}
+	return rows.Err()
+}
+
+// nullIfEmpty stores empty strings as NULL.
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// migrate applies any migrations the database has not seen yet. Foreign keys
+// are turned off while migrating, as sqlite recommends, so that migrations can
+// rebuild tables other tables refer to. The setting is per connection and
+// can't change inside a transaction, so every migration runs on one
+// connection set aside for them.
+func migrate(db *sql.DB) error {
+	return migrateTo(db, len(migrations))
+}
+
+// migrateTo brings a database's schema up to a version, the number of
+// migrations applied.
+func migrateTo(db *sql.DB, target int) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var version int
+	err = conn.QueryRowContext(ctx, "pragma user_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("problem reading the schema version: %s", err)
+	}
+	if version >= target {
+		return nil
+	}
+	var foreignKeys bool
+	err = conn.QueryRowContext(ctx, "pragma foreign_keys").Scan(&foreignKeys)
+	if err != nil {
+		return err
+	}
+	if foreignKeys {
+		_, err = conn.ExecContext(ctx, "pragma foreign_keys = off")
+		if err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, "pragma foreign_keys = on")
+	}
+	for i := version; i < target; i++ {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(migrations[i])
+		if fix := migrationFixups[i+1]; err == nil && fix != nil {
+			err = fix(tx)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("problem applying migration %d: %s", i+1, err)
+		}
+		_, err = tx.Exec(fmt.Sprintf("pragma user_version = %d", i+1))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("problem recording migration %d: %s", i+1, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteDSN is the data source name for the database at path. Foreign keys
+// are off by default in sqlite and the setting is per connection, so it is
+// turned on here for every connection the pool makes. Each connection also
+// waits up to the configured busy timeout for another's lock before giving
+// up with "database is locked". Transactions take the write lock when they
+// begin, as one which only asked for it at its first write could find
+// another process had written since it read, and would have to be rolled
+// back anyway.
+func sqliteDSN(path string) string {
+	return fmt.Sprintf("%s?_foreign_keys=on&_busy_timeout=%d&_txlock=immediate", path, config.BusyTimeout)
+}
+
+// partitionDSN is sqliteDSN for a partition, whose foreign keys are left off
+// as they refer to the main database.
+func partitionDSN(path string) string {
+	return fmt.Sprintf("%s?_busy_timeout=%d&_txlock=immediate", path, config.BusyTimeout)
+}
+
+// readDSN is partitionDSN for connections which only read, whose
+// transactions take no lock until they read and never hold the write lock.
+func readDSN(path string) string {
+	return fmt.Sprintf("%s?_busy_timeout=%d", path, config.BusyTimeout)
+}
+
+// A write which still finds the database busy after the busy timeout is
+// tried busyRetries times in all, waiting busyRetryDelay before the second
+// attempt and twice as long before each one after.
+const (
+	busyRetries    = 5
+	busyRetryDelay = 100 * time.Millisecond
+)
+
+// writeMu serializes the writes of this process, so that its writers take
+// turns rather than contend for sqlite's lock. Other processes are only kept
+// out by sqlite's lock, which is what retryBusy waits for.
+var writeMu sync.Mutex
+
+// retryBusy runs a write, running it again with backoff while it fails
+// because another connection or process holds the database. The write
+// should be a single statement, or a whole transaction which is rolled back
+// when it fails, so running it again can't repeat part of it; a statement in
+// a transaction mustn't be retried on its own, as the transaction can't go
+// on once it has found the database busy.
+func retryBusy(write func() error) error {
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	delay := busyRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil || attempt == busyRetries || !isBusy(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// execRetry runs a statement with retryBusy.
+func execRetry(db queryer, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := retryBusy(func() error {
+		var err error
+		res, err = db.Exec(query, args...)
+		return err
+	})
+	return res, err
+}
+
+// isBusy reports whether err is sqlite's SQLITE_BUSY or SQLITE_LOCKED.
+func isBusy(err error) bool {
+	var e sqlite3.Error
+	return errors.As(err, &e) && (e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked)
+}
+
+// openDB opens an existing database for the query and maintenance commands,
+// bringing its schema up to date.
+func openDB(path string) (*sql.DB, error) {
+	err := migrateLegacyDB(path)
+	if err != nil {
+		return nil, fmt.Errorf("problem moving the database to its new location: %s", err)
+	}
+	alreadyExists, err := exists(path)
+	if err != nil {
+		return nil, err
+	}
+	if !alreadyExists {
+		return nil, fmt.Errorf("could not find a database at %s", path)
+	}
+	db, err := sql.Open("sqlite3", sqliteDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	parts, err := listPartitions(db, path)
+	db.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return sql.Open("sqlite3", sqliteDSN(path))
+	}
+	return openPartitioned(path, parts)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestDB opens a new database migrated up to version.
+func openTestDB(t *testing.T, version int) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", sqliteDSN(filepath.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrateTo(db, version); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func mustExec(t *testing.T, db *sql.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+}
+
+func TestBackfillRanks(t *testing.T) {
+	// migration 20 added the rank columns
+	db := openTestDB(t, 19)
+	mustExec(t, db, "insert into players (id, name, network) values (1, 'a', 'Fox'), (2, 'b', 'Fox'), (3, 'c', 'OGS'), (4, 'd', 'OGS')")
+	mustExec(t, db, `insert into games (id, black_id, white_id, sgf) values
+		(1, 1, 2, '(;GM[1]BR[P9段]WR[5段])'),
+		(2, 3, 4, '(;GM[1]BR[P9段]WR[12k?])')`)
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		id         int64
+		black      sql.NullFloat64
+		white      sql.NullFloat64
+		uncertainW sql.NullBool
+	}{
+		{1, sql.NullFloat64{Float64: 7 + 8.0/3, Valid: true}, sql.NullFloat64{Float64: 5, Valid: true}, sql.NullBool{Bool: false, Valid: true}},
+		// only Fox's adapter reads P9段
+		{2, sql.NullFloat64{}, sql.NullFloat64{Float64: -11, Valid: true}, sql.NullBool{Bool: true, Valid: true}},
+	} {
+		var (
+			black, white sql.NullFloat64
+			uncertainW   sql.NullBool
+		)
+		err := db.QueryRow("select black_rank, white_rank, white_rank_uncertain from games where id = ?", c.id).Scan(&black, &white, &uncertainW)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if black != c.black || white != c.white || uncertainW != c.uncertainW {
+			t.Errorf("game %d's ranks are %v, %v (uncertain %v), want %v, %v (uncertain %v)",
+				c.id, black, white, uncertainW, c.black, c.white, c.uncertainW)
+		}
+	}
+}
+
+func TestBackfillLocalDates(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	// migration 32 put dates without a time of day back on their own day
+	db := openTestDB(t, 31)
+	// 2020-01-02 in Tokyo, moved to UTC by an earlier import
+	moved := time.Date(2020, 1, 2, 0, 0, 0, 0, tokyo).UTC().Format(time.RFC3339)
+	mustExec(t, db, `insert into games (id, timestamp, timezone, sgf) values
+		(1, ?, 'Asia/Tokyo', '(;GM[1]DT[2020-01-02])'),
+		(2, '2020-01-02T03:00:00Z', 'Asia/Tokyo', '(;GM[1]DT[2020-01-02 12:00])')`,
+		moved,
+	)
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[int64]string{
+		1: "2020-01-02T00:00:00Z",
+		// games with a time of day were right to be in UTC
+		2: "2020-01-02T03:00:00Z",
+	} {
+		var got string
+		if err := db.QueryRow("select timestamp from games where id = ?", id).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("game %d's timestamp is %s, want %s", id, got, want)
+		}
+	}
+}
+
+func TestBackfillMoves(t *testing.T) {
+	// migration 37 stored the moves of games an import left without them
+	db := openTestDB(t, 36)
+	mustExec(t, db, `insert into games (id, sgf) values
+		(1, '(;GM[1];B[aa];W[bb](;B[cc])(;B[dd]))'),
+		(2, '(;GM[1];B[aa])')`)
+	games, err := readCollection([]byte("(;GM[1];B[aa])"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeMoves(db, "moves", 2, gameMoves(games[0].root)); err != nil {
+		t.Fatal(err)
+	}
+	// a move of a game which is gone, which foreign keys would have kept out
+	db.SetMaxOpenConns(1)
+	mustExec(t, db, "pragma foreign_keys = off")
+	mustExec(t, db, "insert into moves (game_id, node, parent, branch, move_number, main_line) values (3, 1, 0, 0, 1, 1)")
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[int64]int{1: 5, 2: 2, 3: 0} {
+		var got int
+		if err := db.QueryRow("select count(*) from moves where game_id = ?", id).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("game %d has %d moves stored, want %d", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/apiarian/sgf-library-to-sqlite/extract"
+)
+
+const deleteUsage = `usage:
+  delete [-db-path PATH] [-dry-run] [-yes] (GAME_ID... | FILTERS)
+
+delete removes games along with their moves, notes, tags and collection
+entries. Games are picked by id or by filters, such as -query with an SQL
+condition on the games table (aliased g).`
+
+// gameChildTables are the tables with rows belonging to a game, by game_id,
+// which go when the game does.
+var gameChildTables = []string{"moves", "notes", "game_tags", "collection_games", "analysis_jobs", "evaluations", "move_quality", "game_additions"}
+
+func deleteCommand(args []string) {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to change")
+		dryRun = fs.Bool("dry-run", false, "Only list the games which would be deleted")
+		yes    = fs.Bool("yes", false, "Delete without asking for confirmation")
+		filter gameFilter
+	)
+	filter.register(fs)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 && filter.empty() {
+		fmt.Fprintln(os.Stderr, deleteUsage)
+		os.Exit(2)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	var ids []int64
+	if fs.NArg() > 0 {
+		ids, err = parseGameIDs(fs.Args())
+	} else {
+		ids, err = filteredGameIDs(db, &filter)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(ids) == 0 {
+		fmt.Println("no games match")
+		return
+	}
+
+	if *dryRun {
+		fmt.Printf("would delete %d games: %s\n", len(ids), sampleIDs(ids))
+		return
+	}
+	if !*yes {
+		fmt.Printf("delete %d games (%s)? [y/N] ", len(ids), sampleIDs(ids))
+		in := bufio.NewScanner(os.Stdin)
+		in.Scan()
+		if answer := strings.ToLower(strings.TrimSpace(in.Text())); answer != "y" && answer != "yes" {
+			fmt.Println("nothing deleted")
+			return
+		}
+	}
+
+	err = deleteGames(db, *dbPath, ids)
+	if err != nil {
+		log.Fatalf("error deleting games: %s\n", err)
+	}
+	fmt.Printf("deleted %d games\n", len(ids))
+}
+
+// deleteGames removes games and everything belonging to them in one
+// transaction. In a partitioned database the games and their moves are removed
+// from every partition, since the views over them can't be written to.
+func deleteGames(db *sql.DB, dbPath string, ids []int64) error {
+	parts, err := listPartitions(db, dbPath)
+	if err != nil {
+		return err
+	}
+	tables := append([]string{}, gameChildTables...)
+	for _, e := range extract.Registered() {
+		tables = append(tables, e.GameTables...)
+	}
+	partitioned := make(map[string]bool)
+	for _, t := range partitionedTables {
+		partitioned[t] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(ids); start += 500 {
+		end := start + 500
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+		in := strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		for _, table := range append(tables, "games") {
+			column := "game_id"
+			if table == "games" {
+				column = "id"
+			}
+			schemas := []string{"main"}
+			if partitioned[table] {
+				for _, p := range parts {
+					schemas = append(schemas, p.name)
+				}
+			}
+			for _, schema := range schemas {
+				_, err := tx.Exec("delete from "+schema+"."+table+" where "+column+" in ("+in+")", args...)
+				if err != nil {
+					tx.Rollback()
+					return fmt.Errorf("problem deleting from %s: %s", table, err)
+				}
+			}
+		}
+		// the ids of deleted games are given to the next games imported, which
+		// mustn't find the deleted games' text in the search index
+		_, err := tx.Exec("delete from main.search where docid in ("+in+")", args...)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("problem deleting from search: %s", err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const digestUsage = `usage:
+  digest [-db-path PATH] [-player NAME] [-since-last-run] [-json]
+
+digest summarizes the games added to the library, the players met for the
+first time in them and the ratings which moved, for everyone or for one
+player's games. With -since-last-run it covers only what changed since the
+last digest run that way, and remembers this one, which suits a weekly job
+run from cron; otherwise it covers the whole library and remembers nothing.`
+
+func digestCommand(args []string) {
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	var (
+		dbPath       = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		player       = fs.String("player", "", "Only cover this player's games and opponents")
+		sinceLastRun = fs.Bool("since-last-run", false, "Only cover what changed since the last digest run with this flag, and record this run")
+		asJSON       = fs.Bool("json", false, "Write the digest as JSON")
+	)
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, digestUsage)
+		os.Exit(2)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	err = recordAdditions(db)
+	if err != nil {
+		log.Fatalf("error recording the new games: %s\n", err)
+	}
+	var d digest
+	if *sinceLastRun {
+		err = db.QueryRow(
+			"select ran, last_seq from digest_runs where player = ?", *player,
+		).Scan(&d.Since, &d.lastSeq)
+		if err != nil && err != sql.ErrNoRows {
+			log.Fatalf("error reading the last digest run: %s\n", err)
+		}
+	}
+	err = d.collect(db, *player)
+	if err != nil {
+		log.Fatalf("error collecting the digest: %s\n", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(d)
+	} else {
+		err = d.print(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *sinceLastRun {
+		err = recordDigest(db, *player, d.latestSeq)
+		if err != nil {
+			log.Fatalf("error recording the digest run: %s\n", err)
+		}
+	}
+}
+
+type digestGame struct {
+	ID     int64  `json:"id"`
+	Date   string `json:"date"`
+	Black  string `json:"black"`
+	White  string `json:"white"`
+	Winner string `json:"winner"`
+}
+
+type digestPlayer struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+}
+
+type ratingChange struct {
+	digestPlayer
+	From     *float64 `json:"from"`
+	To       *float64 `json:"to"`
+	FromRank string   `json:"from_rank"`
+	ToRank   string   `json:"to_rank"`
+}
+
+type digest struct {
+	// Since is when the last recorded run was, or empty for the whole library
+	Since         string         `json:"since"`
+	Player        string         `json:"player,omitempty"`
+	Games         []digestGame   `json:"new_games"`
+	Wins          int            `json:"wins"`
+	Losses        int            `json:"losses"`
+	NewPlayers    []digestPlayer `json:"new_opponents"`
+	RatingChanges []ratingChange `json:"rating_changes"`
+
+	// lastSeq and latestSeq are game_additions positions
+	lastSeq, latestSeq int64
+}
+
+// recordAdditions gives the games added since it last ran their places in
+// game_additions, in the order of their ids. Imports don't record them, so
+// that it's done for every partition at once. The digest runs recorded
+// before game_additions have their place found from the last game they saw.
+func recordAdditions(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		insert into game_additions (game_id)
+		select id from games where id not in (select game_id from game_additions)
+		order by id`,
+	)
+	if err == nil {
+		_, err = tx.Exec(`
+			update digest_runs
+			set last_seq = coalesce((select max(a.seq) from game_additions a where a.game_id <= digest_runs.last_game_id), 0)
+			where last_seq is null`,
+		)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *digest) collect(db *sql.DB, player string) error {
+	d.Player = player
+	d.latestSeq = d.lastSeq
+	d.Games, d.NewPlayers, d.RatingChanges = []digestGame{}, []digestPlayer{}, []ratingChange{}
+
+	// the last game added that a run saw marks where it left off
+	rows, err := db.Query(`
+		select g.id, a.seq, coalesce(g.timestamp, ''), coalesce(b.name, '(unknown)'), coalesce(w.name, '(unknown)'),
+			coalesce(winner.name, g.result, '')
+		from games g
+		join game_additions a on a.game_id = g.id
+		left join players b on b.id = g.black_id
+		left join players w on w.id = g.white_id
+		left join players winner on winner.id = g.winner_id
+		where a.seq > ? and (? = '' or b.name = ? or w.name = ?)
+		order by g.timestamp, g.id`,
+		d.lastSeq, player, player, player,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var (
+			g   digestGame
+			seq int64
+		)
+		if err := rows.Scan(&g.ID, &seq, &g.Date, &g.Black, &g.White, &g.Winner); err != nil {
+			rows.Close()
+			return err
+		}
+		g.Date = dateOf(g.Date)
+		if player != "" && g.Winner == player {
+			d.Wins++
+		} else if player != "" && (g.Winner == g.Black || g.Winner == g.White) {
+			d.Losses++
+		}
+		if seq > d.latestSeq {
+			d.latestSeq = seq
+		}
+		d.Games = append(d.Games, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// players whose first game, or first game against player, is new
+	rows, err = db.Query(`
+		select p.name, coalesce(p.network, '')
+		from players p
+		join games g on g.black_id = p.id or g.white_id = p.id
+		join game_additions a on a.game_id = g.id
+		left join players b on b.id = g.black_id
+		left join players w on w.id = g.white_id
+		where p.is_guest = 0 and p.name != ? and (? = '' or b.name = ? or w.name = ?)
+		group by p.id
+		having min(a.seq) > ?
+		order by p.name`,
+		player, player, player, player, d.lastSeq,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var p digestPlayer
+		if err := rows.Scan(&p.Name, &p.Network); err != nil {
+			rows.Close()
+			return err
+		}
+		d.NewPlayers = append(d.NewPlayers, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(`
+		select p.name, coalesce(p.network, ''), dr.rating, pp.rating, coalesce(dr.rank, ''), coalesce(pp.rank, '')
+		from player_profiles pp
+		join players p on p.id = pp.player_id
+		join digest_ratings dr on dr.player = ? and dr.player_id = pp.player_id
+		where (dr.rating is not pp.rating or dr.rank is not pp.rank)
+			and (? = '' or p.name = ? or p.id in (
+				select case when b.name = ? then g.white_id else g.black_id end
+				from games g
+				left join players b on b.id = g.black_id
+				left join players w on w.id = g.white_id
+				where g.id in (select game_id from game_additions where seq > ?) and (b.name = ? or w.name = ?)))
+		order by p.name`,
+		player, player, player, player, d.lastSeq, player, player,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			c        ratingChange
+			from, to sql.NullFloat64
+		)
+		if err := rows.Scan(&c.Name, &c.Network, &from, &to, &c.FromRank, &c.ToRank); err != nil {
+			return err
+		}
+		if from.Valid {
+			c.From = &from.Float64
+		}
+		if to.Valid {
+			c.To = &to.Float64
+		}
+		d.RatingChanges = append(d.RatingChanges, c)
+	}
+	return rows.Err()
+}
+
+func (d *digest) print(w io.Writer) error {
+	since := "ever"
+	if d.Since != "" {
+		since = "since " + dateOf(d.Since)
+	}
+	fmt.Fprintf(w, "%d new games %s", len(d.Games), since)
+	if d.Player != "" {
+		fmt.Fprintf(w, " for %s: %d wins, %d losses", d.Player, d.Wins, d.Losses)
+	}
+	fmt.Fprintln(w)
+	for _, g := range d.Games {
+		fmt.Fprintf(w, "  %s  %s vs %s, winner %s\n", g.Date, g.Black, g.White, g.Winner)
+	}
+	if len(d.NewPlayers) > 0 {
+		fmt.Fprintf(w, "%d new opponents\n", len(d.NewPlayers))
+		for _, p := range d.NewPlayers {
+			fmt.Fprintf(w, "  %s (%s)\n", p.Name, p.Network)
+		}
+	}
+	if len(d.RatingChanges) > 0 {
+		fmt.Fprintf(w, "%d ratings moved\n", len(d.RatingChanges))
+		for _, c := range d.RatingChanges {
+			fmt.Fprintf(w, "  %s (%s): %s -> %s\n", c.Name, c.Network, ratingText(c.From, c.FromRank), ratingText(c.To, c.ToRank))
+		}
+	}
+	return nil
+}
+
+func ratingText(rating *float64, rank string) string {
+	text := "?"
+	if rating != nil {
+		text = fmt.Sprintf("%.0f", *rating)
+	}
+	if rank != "" {
+		text += " " + rank
+	}
+	return text
+}
+
+// recordDigest remembers where a digest left off, with a snapshot of the
+// ratings for the next run to compare against.
+func recordDigest(db *sql.DB, player string, lastSeq int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"insert or replace into digest_runs (player, ran, last_game_id, last_seq) values (?, ?, 0, ?)",
+		player, time.Now().Format(time.RFC3339), lastSeq,
+	)
+	if err == nil {
+		_, err = tx.Exec("delete from digest_ratings where player = ?", player)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+			insert into digest_ratings (player, player_id, rating, rank)
+			select ?, player_id, rating, rank from player_profiles`,
+			player,
+		)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apiarian/sgf-library-to-sqlite/extract"
+)
+
+const dumpUsage = `usage:
+  dump [-db-path PATH] -o FILE
+  load [-db-path PATH] FILE
+
+dump writes the whole library to a zip archive which doesn't depend on
+sqlite: a manifest, the schema for reference, each table as JSON lines and
+the SGF text of each game as its own file, with a SHA-256 checksum of every
+file in the manifest. load checks the checksums and rebuilds the library
+from an archive into a new database, bringing it up to the current schema.
+The search index is left to be rebuilt by the next search, and a
+partitioned library loads into a single file.`
+
+// dumpFormat is the version of the archive layout, raised whenever it
+// changes in a way older versions of load can't read.
+const dumpFormat = 1
+
+type dumpManifest struct {
+	Format int `json:"format"`
+	// Schema is the number of migrations the dumped database had
+	Schema  int         `json:"schema"`
+	Created string      `json:"created"`
+	Tables  []dumpTable `json:"tables"`
+	// Files are the checksums of every other file in the archive, by name
+	Files map[string]string `json:"files"`
+}
+
+type dumpTable struct {
+	Name string `json:"name"`
+	Rows int    `json:"rows"`
+}
+
+// dumpSkipTable reports whether a table is left out of dumps: the record of
+// partitions, which a load doesn't recreate, sqlite's own tables, and the
+// search index with its shadow tables, which is rebuilt from the games.
+func dumpSkipTable(name string) bool {
+	return name == "partitions" || name == "search" || strings.HasPrefix(name, "search_") || strings.HasPrefix(name, "sqlite_")
+}
+
+func dumpCommand(args []string) {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to dump")
+		out    = fs.String("o", "", "The archive to write")
+	)
+	fs.Parse(args)
+
+	if *out == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, dumpUsage)
+		os.Exit(2)
+	}
+	if outExists, err := exists(*out); err != nil || outExists {
+		log.Fatalf("%s already exists\n", *out)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := dumpLibrary(db, f)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(*out)
+		log.Fatalf("error dumping the library: %s\n", err)
+	}
+	var rows, games int
+	for _, t := range m.Tables {
+		rows += t.Rows
+	}
+	for name := range m.Files {
+		if strings.HasPrefix(name, "sgf/") {
+			games++
+		}
+	}
+	log.Printf("dumped %d tables with %d rows and the SGF text of %d games to %s\n", len(m.Tables), rows, games, *out)
+}
+
+// dumpLibrary writes the archive, reading everything in one transaction so
+// that it is a consistent snapshot.
+func dumpLibrary(db *sql.DB, w io.Writer) (*dumpManifest, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	m := &dumpManifest{
+		Format:  dumpFormat,
+		Created: time.Now().Format(time.RFC3339),
+		Files:   make(map[string]string),
+	}
+	err = tx.QueryRow("pragma user_version").Scan(&m.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	zw := zip.NewWriter(w)
+	// add writes a file to the archive, recording its checksum
+	add := func(name string, write func(w io.Writer) error) error {
+		fw, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		bw := bufio.NewWriter(io.MultiWriter(fw, h))
+		if err := write(bw); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		m.Files[name] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	}
+
+	var names, schema []string
+	rows, err := tx.Query("select name, sql from sqlite_master where type = 'table' and sql is not null order by rowid")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name, sql string
+		if err := rows.Scan(&name, &sql); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !dumpSkipTable(name) {
+			names = append(names, name)
+			schema = append(schema, sql+";")
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	err = add("schema.sql", func(w io.Writer) error {
+		_, err := io.WriteString(w, strings.Join(schema, "\n\n")+"\n")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		t := dumpTable{Name: name}
+		err := add("tables/"+name+".jsonl", func(w io.Writer) error {
+			var err error
+			t.Rows, err = dumpRows(tx, name, w)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("problem dumping %s: %s", name, err)
+		}
+		m.Tables = append(m.Tables, t)
+	}
+
+	rows, err = tx.Query("select id, sgf from games where sgf is not null order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id     int64
+			source string
+		)
+		if err := rows.Scan(&id, &source); err != nil {
+			return nil, err
+		}
+		err := add(fmt.Sprintf("sgf/%d.sgf", id), func(w io.Writer) error {
+			_, err := io.WriteString(w, source)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	fw, err := zw.Create("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return nil, err
+	}
+	return m, zw.Close()
+}
+
+// dumpRows writes a table as JSON lines: the column names, then each row's
+// values in the same order. The SGF text of games goes in its own files, so
+// it is left out here.
+func dumpRows(tx *sql.Tx, table string, w io.Writer) (int, error) {
+	rows, err := tx.Query("select * from " + quoteIdentifier(table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(columns); err != nil {
+		return 0, err
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var n int
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+			if table == "games" && columns[i] == "sgf" {
+				values[i] = nil
+			}
+		}
+		if err := enc.Encode(values); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+func loadCommand(args []string) {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	dbPath := fs.String("db-path", defaultDBPath(), "The path of the new sqlite3 database to create")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, dumpUsage)
+		os.Exit(2)
+	}
+	if dbExists, err := exists(*dbPath); err != nil || dbExists {
+		log.Fatalf("%s already exists; load only creates new databases\n", *dbPath)
+	}
+
+	zr, err := zip.OpenReader(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer zr.Close()
+
+	m, files, err := readDumpManifest(&zr.Reader)
+	if err != nil {
+		log.Fatalf("error checking %s: %s\n", fs.Arg(0), err)
+	}
+
+	db, err := sql.Open("sqlite3", sqliteDSN(*dbPath))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	err = loadLibrary(db, m, files)
+	if err != nil {
+		db.Close()
+		os.Remove(*dbPath)
+		log.Fatalf("error loading %s: %s\n", fs.Arg(0), err)
+	}
+	log.Printf("loaded %d tables into %s\n", len(m.Tables), *dbPath)
+}
+
+// readDumpManifest reads an archive's manifest and checks that this version
+// can load it and that every file matches its checksum, returning the files
+// by name.
+func readDumpManifest(zr *zip.Reader) (*dumpManifest, map[string]*zip.File, error) {
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	mf := files["manifest.json"]
+	if mf == nil {
+		return nil, nil, fmt.Errorf("there is no manifest.json; is this a dump?")
+	}
+	r, err := mf.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	// reading to the end checks the manifest against the archive's own
+	// checksum of it
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("problem reading the manifest: %s", err)
+	}
+	var m dumpManifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, nil, fmt.Errorf("problem reading the manifest: %s", err)
+	}
+	if m.Format > dumpFormat {
+		return nil, nil, fmt.Errorf("the archive is in format %d, newer than this version reads (%d)", m.Format, dumpFormat)
+	}
+	if m.Schema > len(migrations) {
+		return nil, nil, fmt.Errorf("the archive has schema version %d, newer than this version knows (%d)", m.Schema, len(migrations))
+	}
+
+	for name, sum := range m.Files {
+		f := files[name]
+		if f == nil {
+			return nil, nil, fmt.Errorf("%s is missing", name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("problem reading %s: %s", name, err)
+		}
+		if hex.EncodeToString(h.Sum(nil)) != sum {
+			return nil, nil, fmt.Errorf("%s doesn't match its checksum", name)
+		}
+	}
+	return &m, files, nil
+}
+
+// loadLibrary creates the schema the archive was dumped from, fills it in and
+// then applies the migrations since, so their backfills see the data.
+func loadLibrary(db *sql.DB, m *dumpManifest, files map[string]*zip.File) error {
+	err := migrateTo(db, m.Schema)
+	if err != nil {
+		return err
+	}
+	err = extract.Prepare(db)
+	if err != nil {
+		return err
+	}
+
+	// the manifest and the rows name the tables and columns, which are
+	// checked against the schema before they go into any SQL
+	columns, err := tableColumns(db)
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]bool)
+	for _, t := range m.Tables {
+		if columns[t.Name] == nil || dumpSkipTable(t.Name) || loaded[t.Name] {
+			return fmt.Errorf("the archive has a table %q which isn't in the schema, or is there twice", t.Name)
+		}
+		loaded[t.Name] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// rows may refer to tables loaded after them
+	_, err = tx.Exec("pragma defer_foreign_keys = on")
+	if err != nil {
+		return err
+	}
+	for _, t := range m.Tables {
+		// the players table starts with the unknown player
+		_, err := tx.Exec("delete from " + quoteIdentifier(t.Name))
+		if err != nil {
+			return fmt.Errorf("problem clearing %s: %s", t.Name, err)
+		}
+		n, err := loadRows(tx, t.Name, columns[t.Name], files["tables/"+t.Name+".jsonl"])
+		if err != nil {
+			return fmt.Errorf("problem loading %s: %s", t.Name, err)
+		}
+		if n != t.Rows {
+			return fmt.Errorf("%s has %d rows rather than the %d in the manifest", t.Name, n, t.Rows)
+		}
+	}
+
+	stmt, err := tx.Prepare("update games set sgf = ? where id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for name := range m.Files {
+		var id int64
+		if _, err := fmt.Sscanf(name, "sgf/%d.sgf", &id); err != nil {
+			continue
+		}
+		r, err := files[name].Open()
+		if err != nil {
+			return err
+		}
+		source, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(string(source), id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return migrate(db)
+}
+
+// tableColumns returns the columns of each table in a database, by table.
+func tableColumns(db *sql.DB) (map[string]map[string]bool, error) {
+	rows, err := db.Query("select name from sqlite_master where type = 'table'")
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	columns := make(map[string]map[string]bool)
+	for _, table := range tables {
+		rows, err := db.Query("select name from pragma_table_info(?)", table)
+		if err != nil {
+			return nil, err
+		}
+		columns[table] = make(map[string]bool)
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			columns[table][name] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return columns, nil
+}
+
+// quoteIdentifier quotes a table or column name for SQL.
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// loadRows inserts a table's rows from the archive, whose columns must be
+// among the known columns of the table.
+func loadRows(tx *sql.Tx, table string, known map[string]bool, f *zip.File) (int, error) {
+	if f == nil {
+		return 0, fmt.Errorf("its rows are missing")
+	}
+	r, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var columns []string
+	if err := dec.Decode(&columns); err != nil {
+		return 0, err
+	}
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		if !known[c] {
+			return 0, fmt.Errorf("there is no column %q in the schema", c)
+		}
+		quoted[i] = quoteIdentifier(c)
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf(
+		"insert into %s (%s) values (%s)",
+		quoteIdentifier(table),
+		strings.Join(quoted, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "),
+	))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	var n int
+	for dec.More() {
+		var values []interface{}
+		if err := dec.Decode(&values); err != nil {
+			return n, err
+		}
+		for i, v := range values {
+			if num, ok := v.(json.Number); ok {
+				if whole, err := num.Int64(); err == nil {
+					values[i] = whole
+				} else {
+					values[i], _ = num.Float64()
+				}
+			}
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// dupePlayer is a player with what players dupes compares them on.
+type dupePlayer struct {
+	id                       int64
+	name, network, canonical string
+	games                    int
+	first, last              string
+	// opponents are by canonical name and days by date
+	opponents, days map[string]bool
+}
+
+// dupePair is two players who may be the same person, with how alike they
+// are.
+type dupePair struct {
+	a, b *dupePlayer
+	// name is the similarity of their names, and opponents and days the
+	// share of their opponents and playing days they have in common
+	name, opponents, days       float64
+	sharedOpponents, sharedDays int
+	sameNetwork                 bool
+	score                       float64
+}
+
+func loadDupePlayers(db *sql.DB) ([]*dupePlayer, error) {
+	rows, err := db.Query(`
+		select id, name, coalesce(network, ''), coalesce(canonical_name, name)
+		from players
+		where is_guest = 0
+		order by id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var players []*dupePlayer
+	byID := make(map[int64]*dupePlayer)
+	for rows.Next() {
+		p := &dupePlayer{opponents: make(map[string]bool), days: make(map[string]bool)}
+		if err := rows.Scan(&p.id, &p.name, &p.network, &p.canonical); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		players = append(players, p)
+		byID[p.id] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`
+		select g.black_id, g.white_id, coalesce(b.canonical_name, b.name), coalesce(w.canonical_name, w.name),
+			coalesce(g.timestamp, '')
+		from games g
+		join players b on b.id = g.black_id
+		join players w on w.id = g.white_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			ids       [2]int64
+			names     [2]string
+			timestamp string
+		)
+		if err := rows.Scan(&ids[0], &ids[1], &names[0], &names[1], &timestamp); err != nil {
+			return nil, err
+		}
+		day := dateOf(timestamp)
+		for i, id := range ids {
+			p := byID[id]
+			if p == nil {
+				continue
+			}
+			p.games++
+			p.opponents[names[1-i]] = true
+			if day == "" {
+				continue
+			}
+			p.days[day] = true
+			if p.first == "" || day < p.first {
+				p.first = day
+			}
+			if day > p.last {
+				p.last = day
+			}
+		}
+	}
+	return players, rows.Err()
+}
+
+// overlap returns the number of keys two sets share and their share of all
+// the keys.
+func overlap(a, b map[string]bool) (int, float64) {
+	var shared int
+	for k := range a {
+		if b[k] {
+			shared++
+		}
+	}
+	if shared == 0 {
+		return 0, 0
+	}
+	return shared, float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// scoreDupe rates how likely two players are to be the same person, mostly
+// by their names. Sharing opponents and playing days hints at the same
+// person recorded twice, and so does being on the same network, or on one
+// the records didn't say.
+func scoreDupe(a, b *dupePlayer) dupePair {
+	d := dupePair{a: a, b: b}
+	d.name = nameSimilarity(a.name, b.name)
+	d.sharedOpponents, d.opponents = overlap(a.opponents, b.opponents)
+	d.sharedDays, d.days = overlap(a.days, b.days)
+	d.sameNetwork = a.network == b.network || a.network == "" || b.network == ""
+	d.score = 0.55*d.name + 0.2*d.opponents + 0.15*d.days
+	if d.sameNetwork {
+		d.score += 0.1
+	}
+	return d
+}
+
+// findDupes returns the pairs of players scoring at least minScore as the
+// same person, best first. Only players whose names share trigrams are
+// compared, and never those who have played each other, already go by the
+// same name or were dismissed as different people.
+func findDupes(db *sql.DB, minScore float64) ([]dupePair, error) {
+	players, err := loadDupePlayers(db)
+	if err != nil {
+		return nil, err
+	}
+	dismissed, err := dupeDismissals(db)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string][]int)
+	grams := make([]map[string]bool, len(players))
+	for i, p := range players {
+		key := normalizeName(p.name)
+		if key == "" {
+			continue
+		}
+		grams[i] = trigrams(key)
+		for t := range grams[i] {
+			index[t] = append(index[t], i)
+		}
+	}
+
+	var pairs []dupePair
+	for i, a := range players {
+		shared := make(map[int]int)
+		for t := range grams[i] {
+			for _, j := range index[t] {
+				if j > i {
+					shared[j]++
+				}
+			}
+		}
+		for j, n := range shared {
+			b := players[j]
+			switch {
+			case n < 2:
+			case a.canonical == b.canonical:
+			case dismissed[[2]int64{a.id, b.id}]:
+			case a.opponents[b.canonical] || b.opponents[a.canonical]:
+			default:
+				if d := scoreDupe(a, b); d.score >= minScore {
+					pairs = append(pairs, d)
+				}
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].score != pairs[j].score {
+			return pairs[i].score > pairs[j].score
+		}
+		if pairs[i].a.id != pairs[j].a.id {
+			return pairs[i].a.id < pairs[j].a.id
+		}
+		return pairs[i].b.id < pairs[j].b.id
+	})
+	return pairs, nil
+}
+
+func dupeDismissals(db *sql.DB) (map[[2]int64]bool, error) {
+	rows, err := db.Query("select player_a, player_b from player_dupe_dismissals")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	dismissed := make(map[[2]int64]bool)
+	for rows.Next() {
+		var pair [2]int64
+		if err := rows.Scan(&pair[0], &pair[1]); err != nil {
+			return nil, err
+		}
+		dismissed[pair] = true
+	}
+	return dismissed, rows.Err()
+}
+
+func printDupes(pairs []dupePair) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCORE\tPLAYER\tNETWORK\tGAMES\tPLAYER\tNETWORK\tGAMES\tSHARED OPPONENTS\tSHARED DAYS")
+	for _, d := range pairs {
+		fmt.Fprintf(tw, "%.2f\t%s\t%s\t%d\t%s\t%s\t%d\t%d\t%d\n",
+			d.score, d.a.name, d.a.network, d.a.games, d.b.name, d.b.network, d.b.games, d.sharedOpponents, d.sharedDays)
+	}
+	return tw.Flush()
+}
+
+// reviewDupes asks about each pair in turn whether to merge them, and which
+// way, or to dismiss them as different people.
+func reviewDupes(db *sql.DB, dbPath string, pairs []dupePair) error {
+	in := bufio.NewScanner(os.Stdin)
+	merged := make(map[int64]bool)
+	for i, d := range pairs {
+		// a merged player's other pairs went with them
+		if merged[d.a.id] || merged[d.b.id] {
+			continue
+		}
+		fmt.Printf("\n%d of %d: score %.2f (names %.2f alike, %d shared opponents, %d shared days)\n",
+			i+1, len(pairs), d.score, d.name, d.sharedOpponents, d.sharedDays)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for n, p := range []*dupePlayer{d.a, d.b} {
+			active := "-"
+			if p.first != "" {
+				active = p.first + " to " + p.last
+			}
+			fmt.Fprintf(tw, "  [%d]\t%s\t%s\t%d games\t%s\n", n+1, p.name, p.network, p.games, active)
+		}
+		tw.Flush()
+		fmt.Print("keep [1] or [2] and merge the other into it, [d]ismiss, [s]kip or [q]uit? [s] ")
+		if !in.Scan() {
+			return in.Err()
+		}
+		var err error
+		switch answer := strings.ToLower(strings.TrimSpace(in.Text())); answer {
+		case "1", "2":
+			keep, drop := d.a, d.b
+			if answer == "2" {
+				keep, drop = d.b, d.a
+			}
+			err = mergePlayers(db, dbPath, keep, drop)
+			if err == nil {
+				merged[drop.id] = true
+				fmt.Printf("merged %s into %s\n", drop.name, keep.name)
+			}
+		case "d":
+			_, err = db.Exec(
+				"insert or replace into player_dupe_dismissals (player_a, player_b, dismissed) values (?, ?, ?)",
+				d.a.id, d.b.id, time.Now().Format(time.RFC3339),
+			)
+		case "q":
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergePlayers moves the games and profile of drop to keep, in every
+// partition, and removes drop. The dropped name is recorded as merged into
+// keep on its network only, so games imported under it later go to the kept
+// player too.
+func mergePlayers(db *sql.DB, dbPath string, keep, drop *dupePlayer) error {
+	parts, err := listPartitions(db, dbPath)
+	if err != nil {
+		return err
+	}
+	schemas := []string{"main"}
+	for _, p := range parts {
+		schemas = append(schemas, p.name)
+	}
+	type statement struct {
+		query string
+		args  []interface{}
+	}
+	var statements []statement
+	for _, schema := range schemas {
+		for _, column := range []string{"black_id", "white_id", "winner_id"} {
+			statements = append(statements, statement{
+				"update " + schema + ".games set " + column + " = ? where " + column + " = ?",
+				[]interface{}{keep.id, drop.id},
+			})
+		}
+	}
+	statements = append(statements,
+		// the kept player's own profile wins
+		statement{
+			"delete from player_profiles where player_id = ? and exists (select 1 from player_profiles where player_id = ?)",
+			[]interface{}{drop.id, keep.id},
+		},
+		statement{"update player_profiles set player_id = ? where player_id = ?", []interface{}{keep.id, drop.id}},
+		statement{"update or ignore digest_ratings set player_id = ? where player_id = ?", []interface{}{keep.id, drop.id}},
+		statement{"delete from digest_ratings where player_id = ?", []interface{}{drop.id}},
+		statement{
+			"update players set is_bot = max(is_bot, (select is_bot from players where id = ?)) where id = ?",
+			[]interface{}{drop.id, keep.id},
+		},
+		statement{"delete from player_dupe_dismissals where player_a = ? or player_b = ?", []interface{}{drop.id, drop.id}},
+		statement{"update player_merges set player_id = ? where player_id = ?", []interface{}{keep.id, drop.id}},
+		statement{
+			"insert or replace into player_merges (name, network, player_id) values (?, ?, ?)",
+			[]interface{}{drop.name, drop.network, keep.id},
+		},
+		statement{"delete from players where id = ?", []interface{}{drop.id}},
+		// the moved games are indexed under the kept player's names
+		statement{
+			"delete from search where docid in (select id from games where black_id = ? or white_id = ?)",
+			[]interface{}{keep.id, keep.id},
+		},
+	)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, s := range statements {
+		if _, err := tx.Exec(s.query, s.args...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("problem merging %s into %s: %s", drop.name, keep.name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// unmergePlayer undoes the merges of a name, on one network or on all of them
+// when network is empty. Each merged name becomes a player of its own again,
+// with the games whose SGF text records it under that name, and games
+// imported under it later are no longer sent to the kept player. Games can't
+// be told apart when the kept player was recorded under the same name on
+// another network, so those stay where they are. Profiles and dismissed pairs
+// removed by the merge aren't brought back. It returns how many games were
+// moved back.
+func unmergePlayer(db *sql.DB, name, network string) (int, error) {
+	query := "select network, player_id from player_merges where name = ?"
+	args := []interface{}{name}
+	if network != "" {
+		query += " and network = ?"
+		args = append(args, network)
+	}
+	type merge struct {
+		network string
+		keepID  int64
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	var merges []merge
+	for rows.Next() {
+		var m merge
+		if err := rows.Scan(&m.network, &m.keepID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		merges = append(merges, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(merges) == 0 {
+		return 0, fmt.Errorf("%s wasn't merged into another player", name)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var moved int
+	for _, m := range merges {
+		n, err := unmergeName(tx, name, m.network, m.keepID)
+		if err != nil {
+			return 0, fmt.Errorf("problem unmerging %s, %s: %s", name, m.network, err)
+		}
+		moved += n
+	}
+	return moved, tx.Commit()
+}
+
+// unmergeName adds a merged name back as a player and moves the games it
+// played from the player it was merged into, returning how many there were.
+func unmergeName(tx *sql.Tx, name, network string, keepID int64) (int, error) {
+	canonical, err := canonicalName(tx, name)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(
+		"insert into players (name, network, is_guest, is_bot, canonical_name) values (?, ?, ?, ?, ?)",
+		name, network, name == guestName, config.isBot(name), canonical,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	var keepName string
+	err = tx.QueryRow("select name from players where id = ?", keepID).Scan(&keepName)
+	if err != nil {
+		return 0, err
+	}
+	var moved int
+	if keepName != name {
+		moved, err = moveGamesBack(tx, name, network, keepID, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = tx.Exec("delete from player_merges where name = ? and network = ?", name, network)
+	return moved, err
+}
+
+// moveGamesBack moves the sides of the games of keepID whose SGF text records
+// name, as read on network, to the player id, returning how many games it
+// changed.
+func moveGamesBack(tx *sql.Tx, name, network string, keepID, id int64) (int, error) {
+	type game struct {
+		id                         int64
+		blackID, whiteID, winnerID sql.NullInt64
+		source                     string
+	}
+	rows, err := tx.Query(
+		"select id, black_id, white_id, winner_id, sgf from games where sgf is not null and (black_id = ? or white_id = ?)",
+		keepID, keepID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var games []game
+	for rows.Next() {
+		var g game
+		if err := rows.Scan(&g.id, &g.blackID, &g.whiteID, &g.winnerID, &g.source); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		games = append(games, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var moved int
+	for _, g := range games {
+		collection, err := readCollection([]byte(g.source))
+		if err != nil || len(collection) == 0 {
+			continue
+		}
+		root := collection[0].root
+		winner, _ := winnerColor(root.get("RE"))
+		sides := []struct {
+			color, property, column string
+			playerID                sql.NullInt64
+		}{
+			{"B", "PB", "black_id", g.blackID},
+			{"W", "PW", "white_id", g.whiteID},
+		}
+		var movedGame bool
+		for _, side := range sides {
+			if side.playerID.Int64 != keepID {
+				continue
+			}
+			recorded, err := playerName(root, side.property)
+			if err != nil || config.playerName(network, networkPlayerName(network, recorded)) != name {
+				continue
+			}
+			_, err = tx.Exec("update games set "+side.column+" = ? where id = ?", id, g.id)
+			if err == nil && winner == side.color && g.winnerID.Int64 == keepID {
+				_, err = tx.Exec("update games set winner_id = ? where id = ?", id, g.id)
+			}
+			if err != nil {
+				return 0, err
+			}
+			movedGame = true
+		}
+		if !movedGame {
+			continue
+		}
+		// the game is indexed again under its new player's names
+		_, err = tx.Exec("delete from search where docid = ?", g.id)
+		if err != nil {
+			return 0, err
+		}
+		moved++
+	}
+	return moved, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// evaluation is the engine's view of a position in a game's main line.
+type evaluation struct {
+	// moveNumber counts the moves played before the position, so 0 is the
+	// starting position
+	moveNumber int
+	// winrate is Black's chance of winning, and scoreLead how many points
+	// Black is ahead by
+	winrate   float64
+	scoreLead float64
+	visits    int
+	// bestMove is the move the engine would play in the position, in GTP
+	// coordinates, or empty when it wasn't recorded
+	bestMove string
+}
+
+// analysisEngine is a running KataGo analysis engine, which reads JSON
+// queries on its standard input and answers each position of them with a
+// line of JSON on its standard output. Each query asks for the winrates and
+// score leads to be reported for Black, whatever the configuration says.
+type analysisEngine struct {
+	cmd     *exec.Cmd
+	in      io.WriteCloser
+	out     *bufio.Scanner
+	visits  int
+	queries int
+}
+
+// startEngine runs the configured engine. Where nice is available it runs at
+// the lowest priority, so it only takes the time nothing else wants.
+func startEngine(command []string, visits int) (*analysisEngine, error) {
+	if len(command) == 0 {
+		return nil, errors.New("no engine is configured; set engine in the config file")
+	}
+	if runtime.GOOS != "windows" {
+		if nice, err := exec.LookPath("nice"); err == nil {
+			command = append([]string{nice, "-n", "19"}, command...)
+		}
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("problem starting the engine: %s", err)
+	}
+	s := bufio.NewScanner(out)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &analysisEngine{cmd: cmd, in: in, out: s, visits: visits}, nil
+}
+
+func (e *analysisEngine) close() error {
+	e.in.Close()
+	return e.cmd.Wait()
+}
+
+// gtpColumns are the column letters of GTP coordinates, which skip I.
+const gtpColumns = "ABCDEFGHJKLMNOPQRSTUVWXYZ"
+
+// gtpPoint converts an SGF point to the GTP coordinates KataGo reads.
+func gtpPoint(v string, size int) string {
+	p, ok := parsePoint(v, size)
+	if !ok {
+		return "pass"
+	}
+	return fmt.Sprintf("%c%d", gtpColumns[p.x], size-p.y)
+}
+
+// katagoRules picks the KataGo rules closest to a game's RU property,
+// defaulting to Japanese rules as most servers do.
+func katagoRules(ru string) string {
+	ru = strings.ToLower(ru)
+	for _, r := range []string{"chinese", "korean", "aga", "new-zealand", "tromp-taylor"} {
+		if strings.Contains(ru, r) {
+			return r
+		}
+	}
+	if strings.Contains(ru, "nz") {
+		return "new-zealand"
+	}
+	return "japanese"
+}
+
+// analyze evaluates every position of a game's main line.
+func (e *analysisEngine) analyze(root *sgfNode) ([]evaluation, error) {
+	size := boardSize(root)
+	if size > len(gtpColumns) {
+		return nil, fmt.Errorf("the engine can't analyze %dx%d boards", size, size)
+	}
+	type query struct {
+		ID            string      `json:"id"`
+		Moves         [][2]string `json:"moves"`
+		InitialStones [][2]string `json:"initialStones"`
+		Rules         string      `json:"rules"`
+		Komi          *float64    `json:"komi,omitempty"`
+		BoardXSize    int         `json:"boardXSize"`
+		BoardYSize    int         `json:"boardYSize"`
+		AnalyzeTurns  []int       `json:"analyzeTurns"`
+		MaxVisits     int         `json:"maxVisits,omitempty"`
+		// OverrideSettings overrides the engine's configuration
+		OverrideSettings map[string]interface{} `json:"overrideSettings"`
+	}
+	e.queries++
+	q := query{
+		ID:            strconv.Itoa(e.queries),
+		Moves:         [][2]string{},
+		InitialStones: [][2]string{},
+		Rules:         katagoRules(root.get("RU")),
+		BoardXSize:    size,
+		BoardYSize:    size,
+		MaxVisits:     e.visits,
+		OverrideSettings: map[string]interface{}{
+			"reportAnalysisWinratesAs": "BLACK",
+		},
+	}
+	if km, err := strconv.ParseFloat(strings.TrimSpace(root.get("KM")), 64); err == nil {
+		q.Komi = &km
+	}
+	for _, color := range []string{"B", "W"} {
+		for _, v := range root.props["A"+color] {
+			q.InitialStones = append(q.InitialStones, [2]string{color, gtpPoint(v, size)})
+		}
+	}
+	for _, n := range root.mainLine() {
+		for _, color := range []string{"B", "W"} {
+			if vs, ok := n.props[color]; ok {
+				q.Moves = append(q.Moves, [2]string{color, gtpPoint(vs[0], size)})
+			}
+		}
+	}
+	for i := 0; i <= len(q.Moves); i++ {
+		q.AnalyzeTurns = append(q.AnalyzeTurns, i)
+	}
+
+	data, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	_, err = e.in.Write(append(data, '\n'))
+	if err != nil {
+		return nil, fmt.Errorf("problem sending the game to the engine: %s", err)
+	}
+
+	evaluations := make([]evaluation, 0, len(q.AnalyzeTurns))
+	for len(evaluations) < len(q.AnalyzeTurns) {
+		if !e.out.Scan() {
+			if err := e.out.Err(); err != nil {
+				return nil, fmt.Errorf("problem reading from the engine: %s", err)
+			}
+			return nil, errors.New("the engine stopped")
+		}
+		var resp struct {
+			ID             string `json:"id"`
+			Error          string `json:"error"`
+			Warning        string `json:"warning"`
+			IsDuringSearch bool   `json:"isDuringSearch"`
+			TurnNumber     int    `json:"turnNumber"`
+			RootInfo       struct {
+				Winrate   float64 `json:"winrate"`
+				ScoreLead float64 `json:"scoreLead"`
+				Visits    int     `json:"visits"`
+			} `json:"rootInfo"`
+			MoveInfos []struct {
+				Move  string `json:"move"`
+				Order int    `json:"order"`
+			} `json:"moveInfos"`
+		}
+		err := json.Unmarshal(e.out.Bytes(), &resp)
+		if err != nil {
+			return nil, fmt.Errorf("problem reading the engine's answer: %s", err)
+		}
+		// warnings and partial results aren't answers
+		if resp.ID != q.ID || resp.Warning != "" || resp.IsDuringSearch {
+			continue
+		}
+		if resp.Error != "" {
+			return nil, fmt.Errorf("the engine said: %s", resp.Error)
+		}
+		ev := evaluation{
+			moveNumber: resp.TurnNumber,
+			winrate:    resp.RootInfo.Winrate,
+			scoreLead:  resp.RootInfo.ScoreLead,
+			visits:     resp.RootInfo.Visits,
+		}
+		for _, m := range resp.MoveInfos {
+			if m.Order == 0 {
+				ev.bestMove = m.Move
+			}
+		}
+		evaluations = append(evaluations, ev)
+	}
+	return evaluations, nil
+}
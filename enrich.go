@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+)
+
+// playerProfile is what a server knows about one of its players.
+type playerProfile struct {
+	remoteID   string
+	rating     sql.NullFloat64
+	rank       string
+	country    string
+	profileURL string
+	isBot      bool
+}
+
+// errNoProfile is returned by profile fetchers for names the server doesn't
+// know.
+var errNoProfile = errors.New("no such player")
+
+func enrichCommand(args []string) {
+	fs := flag.NewFlagSet("enrich", flag.ExitOnError)
+	var (
+		dbPath  = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to update")
+		network = fs.String("network", "", "The network whose players to look up (one of: "+fetcherNames()+")")
+		refresh = fs.Bool("refresh", false, "Look up players which already have a profile again")
+		delay   = fs.Duration("delay", time.Second, "How long to wait between requests to the server")
+	)
+	fs.Parse(args)
+
+	fetcher, ok := adapterFor(*network).(profileFetcher)
+	if !ok {
+		log.Fatal("The -network argument must be one of: " + fetcherNames())
+	}
+	credentials, err := config.credentialsFor(*network)
+	if err != nil {
+		log.Fatalf("error reading the credentials for %s: %s\n", *network, err)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	query := "select p.id, p.name from players p where lower(p.network) = lower(?) and p.is_guest = 0"
+	if !*refresh {
+		query += " and p.id not in (select player_id from player_profiles)"
+	}
+	rows, err := db.Query(query+" order by p.id", *network)
+	if err != nil {
+		log.Fatalf("error finding players: %s\n", err)
+	}
+	type player struct {
+		id   int64
+		name string
+	}
+	var players []player
+	for rows.Next() {
+		var p player
+		if err := rows.Scan(&p.id, &p.name); err != nil {
+			log.Fatalf("error reading players: %s\n", err)
+		}
+		players = append(players, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Fatalf("error reading players: %s\n", err)
+	}
+	log.Println("Looking up", len(players), "players")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	var found, missing int
+	for i, p := range players {
+		if i > 0 {
+			time.Sleep(*delay)
+		}
+		profile, err := fetcher.fetchProfile(client, credentials, p.name)
+		if err == errNoProfile {
+			missing++
+			continue
+		}
+		if err != nil {
+			log.Printf("error looking up %s: %s\n", p.name, err)
+			continue
+		}
+		_, err = db.Exec(`
+			insert or replace into player_profiles
+			(player_id, remote_id, rating, rank, rank_value, country, profile_url, is_bot, fetched)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			p.id,
+			profile.remoteID,
+			profile.rating,
+			nullIfEmpty(profile.rank),
+			normalizeRank(profile.rank).number(),
+			nullIfEmpty(profile.country),
+			nullIfEmpty(profile.profileURL),
+			profile.isBot,
+			time.Now().UTC().Format(time.RFC3339),
+		)
+		if err == nil && profile.isBot {
+			_, err = db.Exec("update players set is_bot = 1 where id = ?", p.id)
+		}
+		if err != nil {
+			log.Fatalf("error storing the profile of %s: %s\n", p.name, err)
+		}
+		found++
+	}
+	log.Printf("found %d profiles, %d players were unknown to the server\n", found, missing)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errNoSGFText is returned by gameSGF for games imported without their SGF
+// text.
+var errNoSGFText = errors.New("imported without its SGF text")
+
+// gameSGF returns the SGF text of a stored game with its notes added as
+// comments: notes without a move number go on the root node, the others on
+// the matching node of the main line. The text is cleaned up as norm asks.
+func gameSGF(db queryer, id int64, norm sgfNormalization) ([]byte, error) {
+	var source sql.NullString
+	err := db.QueryRow("select sgf from games where id = ?", id).Scan(&source)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("there is no game with id %d", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !source.Valid {
+		return nil, fmt.Errorf("game %d was %w; re-import it to export it", id, errNoSGFText)
+	}
+	text := source.String
+	if norm.utf8 {
+		text, err = toUTF8(text)
+		if err != nil {
+			return nil, fmt.Errorf("problem re-encoding game %d: %s", id, err)
+		}
+	}
+	var root *sgfNode
+	parse := func() error {
+		games, err := readCollection([]byte(text))
+		if err != nil || len(games) == 0 {
+			return fmt.Errorf("problem reading the SGF text of game %d: %v", id, err)
+		}
+		root = games[0].root
+		return nil
+	}
+	if norm.any() {
+		if err := parse(); err != nil {
+			return nil, err
+		}
+		if err := norm.normalize(db, id, root); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.Query(
+		"select move_number, body from notes where game_id = ? order by coalesce(move_number, 0), id",
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			moveNumber sql.NullInt64
+			body       string
+		)
+		if err := rows.Scan(&moveNumber, &body); err != nil {
+			return nil, err
+		}
+		if root == nil {
+			if err := parse(); err != nil {
+				return nil, err
+			}
+		}
+		node := root
+		if moveNumber.Valid {
+			line := root.mainLine()
+			if int(moveNumber.Int64) < len(line) {
+				node = line[moveNumber.Int64]
+			}
+		}
+		if c := node.get("C"); c != "" {
+			body = c + "\n\n" + body
+		}
+		node.set("C", body)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if root == nil {
+		return []byte(text), nil
+	}
+	var buf bytes.Buffer
+	writeGameTree(&buf, root)
+	return buf.Bytes(), nil
+}
+
+// writeSGFCollection writes the games as a single SGF collection.
+func writeSGFCollection(w io.Writer, db *sql.DB, ids []int64, norm sgfNormalization) error {
+	for _, id := range ids {
+		data, err := gameSGF(db, id, norm)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
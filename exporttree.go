@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+const exportTreeUsage = `usage:
+  export-tree [-db-path PATH] [filters] [-normalize | -utf8 -fill-info -strip-variations -sort-properties] -out DIR
+  export-tree [-db-path PATH] [filters] [-normalize | ...] -single-file -out FILE
+
+export-tree writes the games as SGF files into DIR/PLAYER/YEAR/, one file per
+game named after its date and players. Each game goes under both of its
+players, or only under those picked by -player or -self. Files already in
+DIR are never overwritten; a number is added to the name instead.
+
+With -single-file the games are written, oldest first, as one SGF collection
+to FILE instead, which mustn't exist yet.
+
+The games are written as they were imported unless asked to clean them up:
+-utf8 re-encodes them to UTF-8, -fill-info adds a missing result or date
+from the database, -strip-variations keeps only the main line and
+-sort-properties writes properties in a standard order. -normalize does all
+four.
+
+Games imported without their SGF text are skipped. Games which can't be
+exported for another reason are logged and skipped too, and export-tree
+exits with an error once the rest are written.`
+
+func exportTreeCommand(args []string) {
+	fs := flag.NewFlagSet("export-tree", flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		out    = fs.String("out", "", "The directory to write the library to, or the file with -single-file")
+		single = fs.Bool("single-file", false, "Write the games as one SGF collection file instead of a directory tree")
+		filter gameFilter
+		norm   sgfNormalization
+	)
+	filter.register(fs)
+	norm.register(fs)
+	fs.Parse(args)
+
+	if *out == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, exportTreeUsage)
+		os.Exit(2)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	games, err := treeGames(db, &filter)
+	if err != nil {
+		log.Fatalf("error reading the games: %s\n", err)
+	}
+	if *single {
+		written, skipped, err := writeSingleFile(db, *out, games, norm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote %d games to %s%s\n", written, *out, skipped)
+		skipped.exit()
+		return
+	}
+	// the games were picked by the names the players go by, whichever form
+	// of them they were recorded under
+	only, err := canonicalNames(db, filter.names())
+	if err != nil {
+		log.Fatal(err)
+	}
+	var (
+		written int
+		skipped treeSkips
+	)
+	for _, g := range games {
+		data, err := gameSGF(db, g.id, norm)
+		if err != nil {
+			skipped.add(err)
+			continue
+		}
+		for _, player := range []treePlayer{g.black, g.white} {
+			if len(only) > 0 && !only[player.canonical] {
+				continue
+			}
+			dir := filepath.Join(*out, safeFileName(player.name), g.year())
+			err := os.MkdirAll(dir, 0755)
+			if err == nil {
+				_, err = writeNewFile(dir, g.fileName(), data)
+			}
+			if err != nil {
+				log.Fatalf("error writing game %d: %s\n", g.id, err)
+			}
+			written++
+		}
+	}
+	log.Printf("wrote %d files to %s%s\n", written, *out, skipped)
+	skipped.exit()
+}
+
+// treeSkips counts the games export-tree skipped: those imported without
+// their SGF text, which can't be exported, and those which failed some other
+// way, such as SGF text which can't be read or re-encoded.
+type treeSkips struct {
+	noText, failed int
+}
+
+// add logs why a game was skipped and counts it.
+func (s *treeSkips) add(err error) {
+	log.Println(err)
+	if errors.Is(err, errNoSGFText) {
+		s.noText++
+	} else {
+		s.failed++
+	}
+}
+
+func (s treeSkips) String() string {
+	var parts []string
+	if s.noText > 0 {
+		parts = append(parts, fmt.Sprintf("skipping %d games without SGF text", s.noText))
+	}
+	if s.failed > 0 {
+		parts = append(parts, fmt.Sprintf("%d games failed to export", s.failed))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return ", " + strings.Join(parts, ", ")
+}
+
+// exit ends the command with an error status when games failed to export,
+// after the rest were written.
+func (s treeSkips) exit() {
+	if s.failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// writeSingleFile writes the games to a new file at path as one SGF
+// collection, skipping those which can't be exported.
+func writeSingleFile(db *sql.DB, path string, games []treeGame, norm sgfNormalization) (int, treeSkips, error) {
+	var skipped treeSkips
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return 0, skipped, fmt.Errorf("%s already exists", path)
+	}
+	if err != nil {
+		return 0, skipped, err
+	}
+	w := bufio.NewWriter(f)
+	var written int
+	for _, g := range games {
+		data, err := gameSGF(db, g.id, norm)
+		if err != nil {
+			skipped.add(err)
+			continue
+		}
+		_, err = w.Write(append(data, '\n'))
+		if err != nil {
+			f.Close()
+			return 0, skipped, fmt.Errorf("error writing game %d: %s", g.id, err)
+		}
+		written++
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return written, skipped, err
+}
+
+type treeGame struct {
+	id           int64
+	timestamp    string
+	black, white treePlayer
+}
+
+// treePlayer is the name a player was recorded under and the one they go by.
+type treePlayer struct {
+	name, canonical string
+}
+
+func treeGames(db *sql.DB, filter *gameFilter) ([]treeGame, error) {
+	where, args := filter.where()
+	rows, err := db.Query(`
+		select g.id, coalesce(g.timestamp, ''),
+			coalesce(b.name, '(unknown)'), coalesce(b.canonical_name, b.name, '(unknown)'),
+			coalesce(w.name, '(unknown)'), coalesce(w.canonical_name, w.name, '(unknown)')
+		from games g
+		left join players b on b.id = g.black_id
+		left join players w on w.id = g.white_id
+		where `+where+`
+		order by g.timestamp, g.id`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var games []treeGame
+	for rows.Next() {
+		var g treeGame
+		if err := rows.Scan(&g.id, &g.timestamp, &g.black.name, &g.black.canonical, &g.white.name, &g.white.canonical); err != nil {
+			return nil, err
+		}
+		games = append(games, g)
+	}
+	return games, rows.Err()
+}
+
+func (g treeGame) year() string {
+	if len(g.timestamp) < 4 {
+		return "undated"
+	}
+	return g.timestamp[:4]
+}
+
+func (g treeGame) fileName() string {
+	date := dateOf(g.timestamp)
+	if date == "" {
+		date = "undated"
+	}
+	return safeFileName(fmt.Sprintf("%s %s vs %s", date, g.black.name, g.white.name)) + ".sgf"
+}
+
+// safeFileName replaces the characters which aren't allowed, or are awkward,
+// in file names on common systems.
+func safeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case strings.ContainsRune(`/\:*?"<>|`, r), unicode.IsControl(r):
+			return '_'
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// writeNewFile writes data to name in dir, or to name with a number added
+// when that file already exists, returning the path written.
+func writeNewFile(dir, name string, data []byte) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		path := filepath.Join(dir, name)
+		if n > 1 {
+			path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, n, ext))
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return path, err
+	}
+}
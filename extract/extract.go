@@ -0,0 +1,140 @@
+// Package extract lets programs add their own per-game extractors to the
+// sgflib import without changing the import itself. An extractor registers
+// itself from an init function, much like a database/sql driver:
+//
+//	func init() {
+//		extract.Register(extract.Extractor{
+//			Name:       "tournament",
+//			Schema:     []string{"create table if not exists tournament_games (game_id integer primary key, event text)"},
+//			GameTables: []string{"tournament_games"},
+//			Extract: func(db extract.Execer, g *extract.Game) error {
+//				event := g.Root.Get("EV")
+//				if event == "" {
+//					return nil
+//				}
+//				_, err := db.Exec("insert or replace into tournament_games (game_id, event) values (?, ?)", g.ID, event)
+//				return err
+//			},
+//		})
+//	}
+//
+// and is built into sgflib by importing its package for its side effects from
+// a file added to the main package.
+package extract
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Execer is satisfied by *sql.DB and *sql.Tx.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Node is a node of a game tree.
+type Node struct {
+	// Properties holds every property of the node by its identifier, like
+	// "PB" or "C".
+	Properties map[string][]string
+	// Children are the variations from this node, the main line first.
+	Children []*Node
+}
+
+// Get returns the first value of a property, or "" without one.
+func (n *Node) Get(id string) string {
+	if vs := n.Properties[id]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// Game is a game as it was stored by an import.
+type Game struct {
+	// ID is the game's id in the games table.
+	ID int64
+	// Path is the file the game came from and Index its position within the
+	// file's collection.
+	Path  string
+	Index int
+	// Network is the network the game's players are on.
+	Network string
+	// Black and White are the players' names, empty when they are missing.
+	Black, White string
+	// Source is the SGF text of the game.
+	Source string
+	// Root is the game tree, or nil if its text couldn't be read.
+	Root *Node
+}
+
+// Extractor derives data from each imported game.
+type Extractor struct {
+	// Name identifies the extractor in errors.
+	Name string
+	// Schema creates the extractor's tables. It is run before every import,
+	// so it should only create what doesn't exist yet.
+	Schema []string
+	// GameTables are the extractor's tables with a game_id column. Their rows
+	// are deleted along with their games.
+	GameTables []string
+	// Extract is called with each game an import stores. A game refreshed by
+	// a later import is passed again with the same ID, so Extract should
+	// replace what it stored for the game before.
+	Extract func(db Execer, g *Game) error
+}
+
+var (
+	mu         sync.Mutex
+	extractors = make(map[string]Extractor)
+)
+
+// Register adds an extractor to every import. It panics if an extractor with
+// the same name is already registered or it has no Extract function.
+func Register(e Extractor) {
+	mu.Lock()
+	defer mu.Unlock()
+	if e.Extract == nil {
+		panic("extract: Register without an Extract function for " + e.Name)
+	}
+	if _, dup := extractors[e.Name]; dup {
+		panic("extract: Register called twice for " + e.Name)
+	}
+	extractors[e.Name] = e
+}
+
+// Registered returns the registered extractors in name order.
+func Registered() []Extractor {
+	mu.Lock()
+	defer mu.Unlock()
+	var es []Extractor
+	for _, e := range extractors {
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].Name < es[j].Name })
+	return es
+}
+
+// Prepare runs the schemas of the registered extractors.
+func Prepare(db Execer) error {
+	for _, e := range Registered() {
+		for _, q := range e.Schema {
+			if _, err := db.Exec(q); err != nil {
+				return fmt.Errorf("problem preparing the %s extractor: %s", e.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Run passes a game to every registered extractor.
+func Run(db Execer, g *Game) error {
+	for _, e := range Registered() {
+		if err := e.Extract(db, g); err != nil {
+			return fmt.Errorf("the %s extractor failed on game %d: %s", e.Name, g.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// stringList is a flag.Value collecting every use of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// gameFilter holds the flags shared by the commands which select games.
+type gameFilter struct {
+	tags   stringList
+	player string
+	// self limits the games to those of the config file's self names
+	self  bool
+	since string
+	until string
+	place string
+	team  string
+	rank  rankRange
+	speed string
+	// excludeBots leaves out games against computer players
+	excludeBots bool
+	// excludeTeaching leaves out the games flagged by isTeachingGame
+	excludeTeaching bool
+	query           string
+}
+
+func (f *gameFilter) register(fs *flag.FlagSet) {
+	fs.Var(&f.tags, "tag", "Only include games with this tag (may be repeated)")
+	fs.StringVar(&f.player, "player", "", "Only include games played by this player")
+	fs.BoolVar(&f.self, "self", false, "Only include your own games, played by any of the self names in the config file")
+	fs.StringVar(&f.since, "since", "", "Only include games played on or after this date (like 2024 or 2024-01-31)")
+	fs.StringVar(&f.until, "until", "", "Only include games played on or before this date (like 2024 or 2024-01-31)")
+	fs.StringVar(&f.place, "place", "", "Only include games whose place (PC) contains this text")
+	fs.StringVar(&f.team, "team", "", "Only include games where this team (BT or WT) played")
+	fs.Var(&f.rank, "rank", "Only include games where a player's recorded rank is in this range (like 5k-1d, or just 3d)")
+	fs.StringVar(&f.speed, "speed", "", "Only include games of this speed: blitz, live or correspondence")
+	fs.BoolVar(&f.excludeBots, "exclude-bots", false, "Leave out games with a computer player")
+	fs.BoolVar(&f.excludeTeaching, "exclude-teaching", false, "Leave out teaching and review games")
+	fs.StringVar(&f.query, "query", "", "Only include games matching this SQL condition on the games table, which is aliased g (like \"g.result = 'void'\")")
+}
+
+// empty reports whether no filters were given, in which case every game
+// matches.
+func (f *gameFilter) empty() bool {
+	return len(f.tags) == 0 && f.player == "" && !f.self && f.since == "" && f.until == "" && f.place == "" && f.team == "" && f.rank.text == "" && f.speed == "" && !f.excludeBots && !f.excludeTeaching && f.query == ""
+}
+
+// where returns a condition on the games table, aliased as g, and its
+// arguments.
+func (f *gameFilter) where() (string, []interface{}) {
+	clauses := []string{"1"}
+	var args []interface{}
+	for _, t := range f.tags {
+		clauses = append(clauses, "g.id in (select gt.game_id from game_tags gt join tags t on t.id = gt.tag_id where t.name = ?)")
+		args = append(args, t)
+	}
+	if names := f.names(); len(names) > 0 || f.self {
+		named, namedArgs := playersNamed(names)
+		clauses = append(clauses, "(g.black_id in ("+named+") or g.white_id in ("+named+"))")
+		args = append(args, namedArgs...)
+		args = append(args, namedArgs...)
+	}
+	if f.since != "" {
+		clauses = append(clauses, "g.timestamp >= ?")
+		args = append(args, f.since)
+	}
+	if f.until != "" {
+		// compare prefixes so that a bare year or month includes all of it
+		clauses = append(clauses, "substr(g.timestamp, 1, length(?)) <= ?")
+		args = append(args, f.until, f.until)
+	}
+	if f.place != "" {
+		clauses = append(clauses, "g.place like ?")
+		args = append(args, "%"+f.place+"%")
+	}
+	if f.team != "" {
+		clauses = append(clauses, "(g.black_team = ? or g.white_team = ?)")
+		args = append(args, f.team, f.team)
+	}
+	if f.rank.text != "" {
+		clauses = append(clauses, "(g.black_rank between ? and ? or g.white_rank between ? and ?)")
+		args = append(args, f.rank.low, f.rank.high, f.rank.low, f.rank.high)
+	}
+	if f.speed != "" {
+		clauses = append(clauses, "g.speed = ?")
+		args = append(args, f.speed)
+	}
+	if f.excludeBots {
+		clauses = append(clauses, "not exists (select 1 from players bot where bot.id in (g.black_id, g.white_id) and bot.is_bot = 1)")
+	}
+	if f.excludeTeaching {
+		clauses = append(clauses, "g.is_teaching = 0")
+	}
+	if f.query != "" {
+		clauses = append(clauses, "("+f.query+")")
+	}
+	return strings.Join(clauses, " and "), args
+}
+
+// names returns the players the filter is limited to: -player, or the self
+// names with -self.
+func (f *gameFilter) names() []string {
+	if f.player != "" {
+		return []string{f.player}
+	}
+	if f.self {
+		return config.Self
+	}
+	return nil
+}
+
+// perspective returns the players whose side of the board per-player
+// statistics are taken from, which are the self names unless -player is
+// given.
+func (f *gameFilter) perspective() ([]string, error) {
+	if f.player == "" && len(config.Self) > 0 {
+		f.self = true
+	}
+	names := f.names()
+	if len(names) == 0 {
+		return nil, errors.New("the -player argument must be specified, or self set in the config file")
+	}
+	return names, nil
+}
+
+// filteredGameIDs returns the ids of the games matching the filter.
+func filteredGameIDs(db *sql.DB, f *gameFilter) ([]int64, error) {
+	where, args := f.where()
+	rows, err := db.Query("select g.id from games g where "+where+" order by g.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// parseGameIDs converts command line arguments to game ids.
+func parseGameIDs(args []string) ([]int64, error) {
+	var ids []int64
+	for _, a := range args {
+		id, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a game id", a)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func gamesCommand(args []string) {
+	fs := flag.NewFlagSet("games", flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		filter gameFilter
+	)
+	filter.register(fs)
+	fs.Parse(args)
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	where, whereArgs := filter.where()
+	rows, err := db.Query(`
+		select g.id, g.timestamp, coalesce(b.name, '(unknown)'), coalesce(w.name, '(unknown)'), coalesce(winner.name || case when g.result = 'forfeit' then ' (forfeit)' else '' end, g.result, ''), g.game_name, g.source_url
+		from games g
+		left join players b on b.id = g.black_id
+		left join players w on w.id = g.white_id
+		left join players winner on winner.id = g.winner_id
+		where `+where+`
+		order by g.timestamp, g.id`,
+		whereArgs...,
+	)
+	if err != nil {
+		log.Fatalf("error querying games: %s\n", err)
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tDATE\tBLACK\tWHITE\tWINNER\tNAME\tLINK")
+	for rows.Next() {
+		var (
+			id        int64
+			timestamp sql.NullString
+			black     string
+			white     string
+			winner    sql.NullString
+			name      sql.NullString
+			link      sql.NullString
+		)
+		err := rows.Scan(&id, &timestamp, &black, &white, &winner, &name, &link)
+		if err != nil {
+			log.Fatalf("error reading game: %s\n", err)
+		}
+		fmt.Fprintf(
+			tw,
+			"%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			id,
+			timestamp.String,
+			black,
+			white,
+			winner.String,
+			name.String,
+			link.String,
+		)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("error reading games: %s\n", err)
+	}
+	tw.Flush()
+}
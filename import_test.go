@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testImport imports the files at paths into st, in order, as the import
+// command does, and returns the importer's summary.
+func testImport(t *testing.T, st *memoryStore, refresh bool, paths ...string) *importSummary {
+	t.Helper()
+	known, err := st.knownFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := &importer{
+		store:        st,
+		refresh:      refresh,
+		summary:      newImportSummary(),
+		networkZones: make(map[string]*time.Location),
+		now:          func() string { return "2024-01-01T00:00:00Z" },
+	}
+	limits := readLimits{maxFileSize: 1 << 20, budget: newMemoryBudget(1 << 20)}
+	for i, path := range paths {
+		fr := readFile(walkedFile{seq: i, path: path}, known, limits)
+		if !fr.unchanged {
+			im.importFile(fr)
+		}
+		limits.budget.done(fr.seq, fr.reserved)
+	}
+	return im.summary
+}
+
+func writeTestFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedFrom returns the games stored from a file by their index in it.
+func storedFrom(st *memoryStore, path string) map[int]*storedGame {
+	games := make(map[int]*storedGame)
+	for _, g := range st.games {
+		if g.path == path {
+			games[g.index] = g
+		}
+	}
+	return games
+}
+
+func TestImportFile(t *testing.T) {
+	dir := t.TempDir()
+	collection := filepath.Join(dir, "collection.sgf")
+	writeTestFile(t, collection, `
+(;GM[1]SZ[19]PB[alice]PW[bob]BR[3k]WR[2d]RE[W+R]DT[2020-01-02 10:30];B[pd];W[dp](;B[pp])(;B[dd]))
+(;GM[1]SZ[19]PC[Fox Weiqi]PB[柯洁]PW[bob]BR[P9段]RE[0]DT[2021-03-04];B[qd])`)
+	broken := filepath.Join(dir, "broken.sgf")
+	writeTestFile(t, broken, "(;GM[1]PB[carol]C[never ends")
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("(;GM[1]SZ[9]PB[carol]PW[alice]RE[B+3.5];B[ee])"))
+	w.Close()
+	compressed := filepath.Join(dir, "compressed.sgf.gz")
+	writeTestFile(t, compressed, gz.String())
+
+	st := newMemoryStore()
+	summary := testImport(t, st, false, collection, broken, compressed)
+	if summary.GamesInserted != 3 || summary.GamesFailed != 1 || summary.Failures["parse"] != 1 {
+		t.Errorf("inserted %d games and failed %d, %v; want 3 and 1 parse failure",
+			summary.GamesInserted, summary.GamesFailed, summary.Failures)
+	}
+	// alice, bob and carol on the default network, and 柯洁 and bob on Fox
+	if summary.PlayersCreated != 5 || len(st.players) != 5 {
+		t.Errorf("created %d players and stored %d, want 5", summary.PlayersCreated, len(st.players))
+	}
+	if summary.Warnings["date"] != 1 {
+		t.Errorf("warned about %d dates, want 1", summary.Warnings["date"])
+	}
+
+	games := storedFrom(st, collection)
+	first, fox := games[0], games[1]
+	if first == nil || fox == nil {
+		t.Fatalf("stored the games %v from the collection", games)
+	}
+	alice := st.players["alice\x00"+config.Network]
+	bob := st.players["bob\x00"+config.Network]
+	if first.blackID.Int64 != alice || first.whiteID.Int64 != bob || first.winnerID.Int64 != bob {
+		t.Errorf("the first game's players are %v, %v and %v, want black %d, white and winner %d",
+			first.blackID, first.whiteID, first.winnerID, alice, bob)
+	}
+	if first.timestamp != "2020-01-02T10:30:00Z" {
+		t.Errorf("the first game's timestamp is %q", first.timestamp)
+	}
+	if first.blackRank.value != -2 || first.whiteRank.value != 2 {
+		t.Errorf("the first game's ranks are %+v and %+v", first.blackRank, first.whiteRank)
+	}
+	// the root, three moves of the main line and the variation
+	if len(first.moves) != 5 {
+		t.Errorf("stored %d moves of the first game, want 5", len(first.moves))
+	}
+	if first.sgf == "" || first.sgf[0] != '(' {
+		t.Errorf("the first game's SGF text is %q", first.sgf)
+	}
+
+	if _, ok := st.players["柯洁\x00Fox"]; !ok {
+		t.Errorf("the Fox game's players weren't stored on Fox: %v", st.players)
+	}
+	if !fox.blackRank.known || fox.blackRank.value != 7+8.0/3 {
+		t.Errorf("the Fox professional's rank is %+v", fox.blackRank)
+	}
+	if fox.result != resultJigo || fox.winnerID.Valid {
+		t.Errorf("the jigo is stored as %q won by %v", fox.result, fox.winnerID)
+	}
+
+	if len(storedFrom(st, compressed)) != 1 {
+		t.Error("the compressed file's game wasn't stored")
+	}
+	for _, path := range []string{collection, broken, compressed} {
+		if st.files[path] == "" {
+			t.Errorf("%s wasn't recorded", path)
+		}
+	}
+
+	// unchanged files aren't read again
+	summary = testImport(t, st, false, collection, broken, compressed)
+	if summary.GamesInserted != 0 || len(st.games) != 3 {
+		t.Errorf("importing unchanged files inserted %d games", summary.GamesInserted)
+	}
+}
+
+func TestImportFileRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "games.sgf")
+	writeTestFile(t, path, "(;GM[1]PB[alice]PW[bob]RE[B+R]DT[2020-01-02];B[aa])(;GM[1]PB[bob]PW[alice]DT[2020-01-03];B[bb])")
+	st := newMemoryStore()
+	testImport(t, st, true, path)
+	ids := make(map[string]int64)
+	for id, g := range st.games {
+		ids[g.contentKey] = id
+	}
+
+	// the second game gets a result and a game is added before both
+	writeTestFile(t, path, "(;GM[1]PB[carol]PW[alice]DT[2019-12-31])(;GM[1]PB[alice]PW[bob]RE[B+R]DT[2020-01-02];B[aa])(;GM[1]PB[bob]PW[alice]RE[W+R]DT[2020-01-03];B[bb])")
+	summary := testImport(t, st, true, path)
+	if summary.GamesUpdated != 2 || summary.GamesInserted != 1 {
+		t.Errorf("updated %d games and inserted %d, want 2 and 1", summary.GamesUpdated, summary.GamesInserted)
+	}
+	if len(st.games) != 3 {
+		t.Fatalf("%d games are stored, want 3", len(st.games))
+	}
+	// the games keep their ids, at their new places in the file
+	games := storedFrom(st, path)
+	for index, g := range games {
+		if id, ok := ids[g.contentKey]; ok && st.games[id] != g {
+			t.Errorf("the game at index %d didn't keep its id %d", index, id)
+		}
+	}
+	alice := st.players["alice\x00"+config.Network]
+	if g := games[2]; g == nil || g.result != resultWin || g.winnerID.Int64 != alice {
+		t.Errorf("the refreshed game is %+v, want a win for alice", g)
+	}
+}
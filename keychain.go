@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// keychainValue is the credential value which says to read the setting from
+// the operating system's keychain instead of the configuration file.
+const keychainValue = "keychain"
+
+// credentialsFor returns the credentials of a network, reading those set to
+// keychainValue from the keychain. They're stored there under the service
+// appName and an account like "ogs.token".
+func (c *Config) credentialsFor(network string) (map[string]string, error) {
+	network = strings.ToLower(network)
+	credentials := make(map[string]string)
+	for key, value := range c.Credentials[network] {
+		if value == keychainValue {
+			var err error
+			value, err = readKeychain(network + "." + key)
+			if err != nil {
+				return nil, fmt.Errorf("problem reading credentials.%s.%s from the keychain: %s", network, key, err)
+			}
+		}
+		credentials[key] = value
+	}
+	return credentials, nil
+}
+
+// readKeychain reads a secret with the keychain's command line tool: security
+// on macOS and secret-tool, from libsecret, elsewhere.
+func readKeychain(account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", appName, "-a", account, "-w")
+	case "windows":
+		return "", fmt.Errorf("the keychain isn't supported on windows")
+	default:
+		cmd = exec.Command("secret-tool", "lookup", "service", appName, "account", account)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", err, msg)
+		}
+		return "", err
+	}
+	value := strings.TrimRight(string(out), "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("there is no %s secret for %s", appName, account)
+	}
+	return value, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errLocked is returned by lockFile when another process holds the lock.
+var errLocked = errors.New("locked")
+
+// acquireLock takes the advisory lock guarding a database against
+// simultaneous imports, waiting up to wait for another run to finish. The
+// returned function releases the lock.
+//
+// The lock is a file next to the database holding the owner's process id,
+// locked with the operating system's file locks, which are let go of when
+// the process holding them dies. A lock file left behind by a run which died
+// is simply locked again.
+func acquireLock(dbPath string, wait time.Duration) (func(), error) {
+	path := dbPath + ".lock"
+	deadline := time.Now().Add(wait)
+	for {
+		f, err := lockFile(path)
+		if err == nil {
+			f.Truncate(0)
+			fmt.Fprintf(f, "%d\n%s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+			return func() { unlockFile(f, path) }, nil
+		}
+		if err != errLocked {
+			return nil, err
+		}
+
+		if time.Now().After(deadline) {
+			pid, since := readLock(path)
+			return nil, fmt.Errorf(
+				"%s is in use by another run (process %d, since %s); use -lock-wait to wait for it",
+				dbPath,
+				pid,
+				since,
+			)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func readLock(path string) (int, string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, "unknown"
+	}
+	lines := strings.SplitN(string(data), "\n", 3)
+	pid, _ := strconv.Atoi(strings.TrimSpace(lines[0]))
+	since := "unknown"
+	if len(lines) > 1 && strings.TrimSpace(lines[1]) != "" {
+		since = strings.TrimSpace(lines[1])
+	}
+	return pid, since
+}
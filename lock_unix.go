@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens and locks the lock file at path, returning errLocked when
+// another process holds it.
+func lockFile(path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, errLocked
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// the holder may have removed the file between it being opened and
+		// locked here, leaving this lock on a file no one else will open
+		opened, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(opened, current) {
+			return f, nil
+		}
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// unlockFile removes the lock file while it's still locked, so no one can
+// lock the removed file after it's let go of.
+func unlockFile(f *os.File, path string) {
+	os.Remove(path)
+	f.Close()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorSharingViolation is what opening a file another process has open
+// without sharing it fails with.
+const errorSharingViolation syscall.Errno = 32
+
+// lockFile opens the lock file at path without sharing it for writing, which
+// keeps other processes from opening it the same way until it's closed,
+// returning errLocked when another process has it open.
+func lockFile(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(
+		name,
+		syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		syscall.FILE_SHARE_READ,
+		nil,
+		syscall.OPEN_ALWAYS,
+		syscall.FILE_ATTRIBUTE_NORMAL,
+		0,
+	)
+	if err == errorSharingViolation {
+		return nil, errLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+// unlockFile closes the lock file before removing it, as Windows won't remove
+// an open file.
+func unlockFile(f *os.File, path string) {
+	f.Close()
+	os.Remove(path)
+}
@@ -8,41 +8,147 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"os/user"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/apiarian/sgf"
-	"github.com/apiarian/sgf/parse"
+	"github.com/apiarian/sgf-library-to-sqlite/extract"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// commands maps subcommand names to their entry points. Running the program
+// without a subcommand imports a directory of SGF files.
+var commands = map[string]func(args []string){
+	"anki":        ankiCommand,
+	"bench":       benchCommand,
+	"browse":      browseCommand,
+	"chart":       chartCommand,
+	"check":       checkCommand,
+	"collection":  collectionCommand,
+	"compare":     compareCommand,
+	"delete":      deleteCommand,
+	"digest":      digestCommand,
+	"dump":        dumpCommand,
+	"enrich":      enrichCommand,
+	"export":      exportCommand,
+	"export-tree": exportTreeCommand,
+	"games":       gamesCommand,
+	"load":        loadCommand,
+	"note":        noteCommand,
+	"overview":    overviewCommand,
+	"players":     playersCommand,
+	"quarantine":  quarantineCommand,
+	"report":      reportCommand,
+	"scout":       scoutCommand,
+	"search":      searchCommand,
+	"serve":       serveCommand,
+	"show":        showCommand,
+	"sql":         sqlCommand,
+	"stats":       statsCommand,
+	"tag":         tagCommand,
+	"worker":      workerCommand,
+}
+
 func main() {
-	usr, _ := user.Current()
+	args, configPath := extractConfigFlag(os.Args[1:])
+	explicit := configPath != ""
+	if !explicit {
+		configPath = defaultConfigPath()
+	}
+	c, err := loadConfig(configPath, explicit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config = c
 
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			cmd(args[1:])
+			return
+		}
+	}
+	importCommand(args)
+}
+
+func importCommand(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
 	var (
-		dbPath  = flag.String("db-path", filepath.Join(usr.HomeDir, "go-games.db"), "The path to the sqlite3 database to store the data")
-		clearDB = flag.Bool("clear-db", false, "Clear an existing db and start over")
-		sgfDir  = flag.String("sgf-dir", "", "The directory of SGF files to search recursively")
+		dbPath         = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to store the data")
+		clearDB        = fs.Bool("clear-db", false, "Clear an existing db and start over")
+		sgfDir         = fs.String("sgf-dir", "", "The directory of SGF files to search recursively (defaults to sgf_dirs from the config file)")
+		workers        = fs.Int("workers", config.Workers, "The number of files to process at once")
+		lockWait       = fs.Duration("lock-wait", 0, "How long to wait for another import into the same database to finish")
+		resume         = fs.Bool("resume", false, "Skip the files an interrupted import already finished without reading them again")
+		summaryPath    = fs.String("summary-json", "", "Also write the end of run summary to this file as JSON")
+		deterministic  = fs.Bool("deterministic", false, "Insert games in walk order and record no wall clock times, so importing the same files always produces the same database")
+		timezone       = fs.String("timezone", "", "The time zone game dates are in, like Asia/Tokyo (defaults to the config file's timezone settings, then UTC)")
+		maxFileMB      = fs.Int64("max-file-mb", 64, "Skip files bigger than this many megabytes")
+		inFlightMB     = fs.Int64("in-flight-mb", 256, "Roughly how many megabytes the workers may hold of files read and parsed but not yet stored")
+		refresh        = fs.Bool("refresh", false, "Update the games of changed files in place, keeping their tags and notes, instead of adding them again")
+		partitionBy    = fs.String("partition-by", "", fmt.Sprintf("Keep games in a separate database file per year; the only choice is year (a partitioned database stays partitioned, holds at most %d years as sqlite attaches at most %d databases to a connection, and keeps games without a date in the main file)", maxPartitions, maxPartitions))
+		holdIncomplete = fs.Bool("quarantine-incomplete", false, "Quarantine the games with fields which couldn't be read instead of importing them without those fields")
 	)
 
-	flag.Parse()
+	fs.Parse(args)
 
-	if *sgfDir == "" {
+	sgfDirs := config.SGFDirs
+	if *sgfDir != "" {
+		sgfDirs = []string{*sgfDir}
+	}
+	if len(sgfDirs) == 0 {
 		log.Fatal("The -sgf-dir argument must be specified")
 	}
-	sgfDirStats, err := os.Stat(*sgfDir)
-	if os.IsNotExist(err) {
-		log.Fatal("Could not find " + *sgfDir)
+	for _, dir := range sgfDirs {
+		sgfDirStats, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			log.Fatal("Could not find " + dir)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !sgfDirStats.IsDir() {
+			log.Fatal(dir + " does not appear to be a directory")
+		}
+		log.Println("Going to look for SGF files in", dir)
+	}
+	if *workers < 1 {
+		log.Fatal("The -workers argument must be at least 1")
+	}
+	if *maxFileMB < 1 || *inFlightMB < 1 {
+		log.Fatal("The -max-file-mb and -in-flight-mb arguments must be at least 1")
+	}
+	if *partitionBy != "" && *partitionBy != "year" {
+		log.Fatal("The -partition-by argument must be year")
 	}
-	if !sgfDirStats.IsDir() {
-		log.Fatal(*sgfDir + " does not appear to be a directory")
+	var zone *time.Location
+	if *timezone != "" {
+		var err error
+		zone, err = time.LoadLocation(*timezone)
+		if err != nil {
+			log.Fatalf("error loading the time zone %s: %s\n", *timezone, err)
+		}
 	}
-	log.Println("Going to look for SGF files in", *sgfDir)
 
+	err := migrateLegacyDB(*dbPath)
+	if err != nil {
+		log.Fatalf("error moving the database to its new location: %s\n", err)
+	}
 	log.Println("Looking for the database at", *dbPath)
+	err = os.MkdirAll(filepath.Dir(*dbPath), 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+	unlock, err := acquireLock(*dbPath, *lockWait)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer unlock()
+
 	alreadyExists, err := exists(*dbPath)
 	if err != nil {
 		log.Fatal(err)
@@ -50,13 +156,13 @@ func main() {
 
 	if *clearDB && alreadyExists {
 		log.Println("Deleting the old database")
-		err := os.Remove(*dbPath)
+		err := removeDB(*dbPath)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	db, err := sql.Open("sqlite3", *dbPath)
+	db, err := sql.Open("sqlite3", sqliteDSN(*dbPath))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -64,59 +170,62 @@ func main() {
 
 	if *clearDB || !alreadyExists {
 		log.Println("Creating a new database")
-
-		dbInitializationString := `
-		create table players (
-			id integer primary key not null,
-			name text not null,
-			network text
-		);
-		create unique index player_name_network ON players(name, network);
-		insert into players (id, name, network) values (0, 'UNKNOWN PLAYER', 'UNKNOWN NETWORK');
-		create table games (
-			id integer primary key not null,
-			black_id integer not null,
-			white_id integer not null,
-			winner_id integer,
-			timestamp text,
-			foreign key(black_id) references players(id),
-			foreign key(white_id) references players(id)
-		);
-		`
-		_, err = db.Exec(dbInitializationString)
-		if err != nil {
-			log.Printf("%q: %s\n", err, dbInitializationString)
-			return
-		}
 	}
-	getPlayerIdSmt, err := db.Prepare("select id from players where name = ? and network = ?")
+	err = migrate(db)
 	if err != nil {
-		log.Printf("error making getPlayerIdSmt: %s\n", err)
-		return
+		log.Fatalf("error migrating the database: %s\n", err)
 	}
-	insertPlayerSmt, err := db.Prepare("insert into players (name, network) values (?, ?)")
+	err = extract.Prepare(db)
 	if err != nil {
-		log.Fatalf("error making insertPlayerSmt: %s\n", err)
+		log.Fatal(err)
 	}
-	insertGameSmt, err := db.Prepare("insert into games (black_id, white_id, winner_id, timestamp) values (?, ?, ?, ?)")
+	st, err := newSQLiteStore(db, *dbPath, *partitionBy != "")
 	if err != nil {
-		log.Fatalf("error making insertGameSmt: %s\n", err)
+		log.Fatal(err)
+	}
+	defer st.close()
+
+	known, err := st.knownFiles()
+	if err != nil {
+		log.Fatalf("error reading the imported files: %s\n", err)
+	}
+	resumeFrom := make(map[string]string)
+	if *resume {
+		resumeFrom, err = st.checkpoints()
+		if err != nil {
+			log.Fatalf("error reading the import checkpoints: %s\n", err)
+		}
+		log.Println("Resuming from", len(resumeFrom), "directory checkpoints")
+	} else {
+		err = st.clearCheckpoints()
+		if err != nil {
+			log.Fatalf("error clearing the import checkpoints: %s\n", err)
+		}
+	}
+	skip := func(path string) bool {
+		last, ok := resumeFrom[filepath.Dir(path)]
+		return ok && filepath.Base(path) <= filepath.Base(last)
 	}
 
 	log.Println("ready to go!")
+	summary := newImportSummary()
 
 	done := make(chan struct{})
 	defer close(done)
 
-	paths, errc := walkFiles(done, *sgfDir)
+	progress := newWalkProgress()
+	paths, errc := walkFiles(done, skip, progress, sgfDirs...)
 
-	c := make(chan result)
+	limits := readLimits{
+		maxFileSize: *maxFileMB << 20,
+		budget:      newMemoryBudget(*inFlightMB << 20),
+	}
+	c := make(chan fileResult)
 	var wg sync.WaitGroup
-	const numProcessors = 20
-	wg.Add(numProcessors)
-	for i := 0; i < numProcessors; i++ {
+	wg.Add(*workers)
+	for i := 0; i < *workers; i++ {
 		go func() {
-			processor(done, paths, c)
+			processor(done, paths, known, limits, c)
 			wg.Done()
 		}()
 	}
@@ -125,77 +234,462 @@ func main() {
 		close(c)
 	}()
 
-	var playerIdCache = make(map[string]int)
+	importTime := func() string {
+		if *deterministic {
+			return time.Unix(0, 0).UTC().Format(time.RFC3339)
+		}
+		return time.Now().Format(time.RFC3339)
+	}
+	im := &importer{
+		store:          st,
+		extractDB:      st,
+		refresh:        *refresh,
+		summary:        summary,
+		zone:           zone,
+		networkZones:   make(map[string]*time.Location),
+		now:            importTime,
+		holdIncomplete: *holdIncomplete,
+	}
+	results := (<-chan fileResult)(c)
+	if *deterministic {
+		results = inWalkOrder(c)
+	}
+
+	for fr := range results {
+		summary.FilesScanned++
+		if fr.unchanged {
+			summary.FilesUnchanged++
+		} else {
+			im.importFile(fr)
+		}
+		if dir, last, ok := progress.finished(fr.path); ok {
+			err := st.checkpoint(dir, last)
+			if err != nil {
+				log.Fatalf("error recording the checkpoint for %s: %s\n", dir, err)
+			}
+		}
+		limits.budget.done(fr.seq, fr.reserved)
+	}
+	if err := <-errc; err != nil {
+		log.Fatal(err)
+	}
+
+	// the walk finished, so there is nothing left to resume
+	err = st.clearCheckpoints()
+	if err != nil {
+		log.Fatalf("error clearing the import checkpoints: %s\n", err)
+	}
+
+	summary.finish()
+	// deterministic imports keep wall clock times out of the database
+	if !*deterministic {
+		err = st.recordRun(summary)
+		if err != nil {
+			log.Fatalf("error recording the import: %s\n", err)
+		}
+	}
+	log.Println("import finished")
+	summary.print(os.Stderr)
+	if *summaryPath != "" {
+		err := summary.writeJSON(*summaryPath)
+		if err != nil {
+			log.Fatalf("error writing the summary: %s\n", err)
+		}
+	}
+}
+
+// importer writes the games read from files to a store.
+type importer struct {
+	store store
+	// extractDB is what extractors write to, or nil to skip them
+	extractDB extract.Execer
+	// refresh updates games already imported from a file rather than adding
+	// them again
+	refresh bool
+	summary *importSummary
+	// zone overrides the configured time zones when set
+	zone         *time.Location
+	networkZones map[string]*time.Location
+	// now is when games held back by a policy are recorded as held
+	now func() string
+	// holdIncomplete quarantines the games with warnings
+	holdIncomplete bool
+	// skipPolicies imports every game, as when they are accepted from
+	// quarantine
+	skipPolicies bool
+}
+
+// incompletePolicy is the policy named for games quarantined by
+// holdIncomplete.
+const incompletePolicy = "incomplete"
 
-	for r := range c {
+// heldBack returns the policy holding a game back from the import, if any,
+// and why.
+func (im *importer) heldBack(r result) (name, action, reason string, held bool) {
+	if im.skipPolicies {
+		return "", "", "", false
+	}
+	if p, reason, ok := config.heldBack(r); ok {
+		return p.name, p.action, reason, true
+	}
+	if im.holdIncomplete && len(r.warnings) > 0 {
+		var fields []string
+		for field := range r.warnings {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		return incompletePolicy, policyQuarantine, "could not read the " + strings.Join(fields, ", "), true
+	}
+	return "", "", "", false
+}
+
+// importFile stores the games read from a file, and records its hash when it
+// has one, in a single transaction, so a file is never left with only some
+// of its games stored. A file which finds the database busy is rolled back
+// and stored again from the start, waiting longer each time, like retryBusy
+// does for single statements. What storing it did is only counted and logged
+// once the transaction commits.
+func (im *importer) importFile(fr fileResult) {
+	delay := busyRetryDelay
+	for attempt := 1; ; {
+		f := &fileImport{summary: newImportSummary()}
+		err := im.storeFile(fr, f)
+		if err == nil {
+			f.finish(im.summary)
+			return
+		}
+		if rbErr := im.store.rollback(); rbErr != nil {
+			log.Fatalf("error storing %s: %s\n", fr.path, rbErr)
+		}
+		switch {
+		case err == errStoreAgain:
+		case isBusy(err) && attempt < busyRetries:
+			log.Printf("the database is busy, storing %s again in %s\n", fr.path, delay)
+			time.Sleep(delay)
+			delay *= 2
+			attempt++
+		default:
+			log.Fatalf("error storing %s: %s\n", fr.path, err)
+		}
+	}
+}
+
+// fileImport is what storing a file did.
+type fileImport struct {
+	summary *importSummary
+	logs    []string
+}
+
+func (f *fileImport) logf(format string, args ...interface{}) {
+	f.logs = append(f.logs, fmt.Sprintf(format, args...))
+}
+
+// finish logs what storing the file did and adds its counts to summary.
+func (f *fileImport) finish(summary *importSummary) {
+	for _, l := range f.logs {
+		log.Print(l)
+	}
+	summary.add(f.summary)
+}
+
+// storeFile stores a file in a transaction, returning before it's committed
+// when anything fails.
+func (im *importer) storeFile(fr fileResult, f *fileImport) error {
+	if err := im.store.begin(); err != nil {
+		return fmt.Errorf("problem starting the transaction: %w", err)
+	}
+	var matches map[int]int64
+	if im.refresh {
+		var err error
+		matches, err = im.matchStored(fr, f)
+		if err != nil {
+			return fmt.Errorf("problem reading the games stored from it: %w", err)
+		}
+	}
+	for i, r := range fr.games {
 		if r.err != nil {
-			log.Println("got an error with", r.path, r.err)
+			f.logf("got an error with %s %s\n", r.path, r.err)
+			f.summary.failed(r.errCategory)
 			continue
 		}
-		for _, p := range []string{r.black, r.white} {
-			if _, ok := playerIdCache[p]; ok {
-				continue
+		if policy, action, reason, held := im.heldBack(r); held {
+			err := im.store.holdBack(heldGame{
+				path:    r.path,
+				index:   r.index,
+				network: r.network,
+				sgf:     r.source,
+				policy:  policy,
+				action:  action,
+				reason:  reason,
+				held:    im.now(),
+			})
+			if err != nil {
+				return fmt.Errorf("problem holding back game %d: %w", r.index, err)
 			}
-			rows, err := getPlayerIdSmt.Query(p, r.network)
-			defer rows.Close()
+			f.summary.heldBack(action)
+			continue
+		}
+		for field, err := range r.warnings {
+			f.logf("%s: importing without the %s: %s\n", r.path, field, err)
+			f.summary.warned(field)
+		}
+		g, err := im.storedGame(r, f)
+		if err != nil {
+			return err
+		}
+
+		id, updated := matches[i]
+		if updated {
+			err = im.store.updateGame(id, g)
 			if err != nil {
-				log.Fatalf("error reading id from database for %s, %s: %s\n", p, r.network, err)
+				return fmt.Errorf("problem refreshing game %d: %w", r.index, err)
 			}
-			var idFound bool
-			for rows.Next() {
-				var id int
-				err := rows.Scan(&id)
-				if err != nil {
-					log.Fatalf("error getting id from database for %s, %s: %s\n", p, r.network, err)
-				}
-				playerIdCache[p] = id
-				idFound = true
+			f.summary.GamesUpdated++
+		} else {
+			id, err = im.store.insertGame(g)
+			if err == errStoreAgain {
+				return err
 			}
-			if !idFound {
-				result, err := insertPlayerSmt.Exec(p, r.network)
-				if err != nil {
-					log.Fatalf("error inserting player into database for %s, %s: %s\n", p, r.network, err)
-				}
-				id, err := result.LastInsertId()
-				if err != nil {
-					log.Fatalf("error extracting the last insert id for %s, %s: %s\n", p, r.network, err)
-				}
-				playerIdCache[p] = int(id)
+			if err != nil {
+				return fmt.Errorf("problem inserting game %d: %w", r.index, err)
 			}
+			f.summary.GamesInserted++
 		}
-		black_id := playerIdCache[r.black]
-		white_id := playerIdCache[r.white]
-		var insertError error
-		switch r.winnerColor {
-		case "B":
-			_, insertError = insertGameSmt.Exec(
-				black_id,
-				white_id,
-				black_id,
-				r.date.Format(time.RFC3339),
-			)
-		case "W":
-			_, insertError = insertGameSmt.Exec(
-				black_id,
-				white_id,
-				white_id,
-				r.date.Format(time.RFC3339),
-			)
-		default:
-			_, insertError = insertGameSmt.Exec(
-				black_id,
-				white_id,
-				nil,
-				r.date.Format(time.RFC3339),
-			)
+
+		if im.extractDB == nil || len(extract.Registered()) == 0 {
+			continue
 		}
-		if insertError != nil {
-			log.Fatalf("error inserting game: %s\n", err)
+		err = extract.Run(im.extractDB, &extract.Game{
+			ID:      id,
+			Path:    r.path,
+			Index:   r.index,
+			Network: r.network,
+			Black:   r.black,
+			White:   r.white,
+			Source:  r.source,
+			Root:    exportNode(r.root),
+		})
+		if err != nil {
+			return err
 		}
 	}
-	if err := <-errc; err != nil {
-		log.Fatal(err)
+
+	if fr.hash != "" {
+		err := im.store.recordFile(fr.path, fr.hash, im.now())
+		if err != nil {
+			return fmt.Errorf("problem recording the file: %w", err)
+		}
+	}
+	return im.store.commit()
+}
+
+// storedGame resolves the players and time zone of a game read from a file.
+func (im *importer) storedGame(r result, f *fileImport) (*storedGame, error) {
+	g := &storedGame{
+		result:     r.resultType,
+		path:       r.path,
+		index:      r.index,
+		sgf:        r.source,
+		sourceURL:  sourceURL(r.root),
+		contentKey: contentKey(r.root),
+		info:       make(map[string]string),
+		moves:      gameMoves(r.root),
+	}
+
+	// players without a name are stored as no player at all
+	for _, p := range []struct {
+		name string
+		id   *sql.NullInt64
+	}{{r.black, &g.blackID}, {r.white, &g.whiteID}} {
+		if p.name == "" {
+			continue
+		}
+		id, created, err := im.store.playerID(p.name, r.network)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			f.summary.PlayersCreated++
+		}
+		*p.id = sql.NullInt64{Int64: id, Valid: true}
+	}
+	switch r.winnerColor {
+	case "B":
+		g.winnerID = g.blackID
+	case "W":
+		g.winnerID = g.whiteID
+	}
+
+	zone := im.zone
+	if zone == nil {
+		var ok bool
+		zone, ok = im.networkZones[r.network]
+		if !ok {
+			var err error
+			zone, err = config.zoneFor(r.network)
+			if err != nil {
+				return nil, fmt.Errorf("problem loading the time zone for %s: %s", r.network, err)
+			}
+			im.networkZones[r.network] = zone
+		}
+	}
+	if r.hasDate {
+		var dt string
+		if r.root != nil {
+			dt = r.root.get("DT")
+		}
+		g.timestamp, g.timezone = utcTimestamp(r.date, zone, hasTimeOfDay(dt))
+	}
+
+	if r.root != nil {
+		for _, c := range infoColumns {
+			g.info[c.column] = r.root.get(c.property)
+		}
+		g.blackRank = networkRank(r.network, r.root.get("BR"))
+		g.whiteRank = networkRank(r.network, r.root.get("WR"))
+		g.speed = gameSpeed(r.root)
+		g.teaching = isTeachingGame(r.root, g.blackRank, g.whiteRank)
+	}
+	return g, nil
+}
+
+// exportNode copies a game tree into the form extractors are given.
+func exportNode(n *sgfNode) *extract.Node {
+	if n == nil {
+		return nil
+	}
+	e := &extract.Node{Properties: make(map[string][]string, len(n.props))}
+	for id, vs := range n.props {
+		e.Properties[id] = append([]string(nil), vs...)
+	}
+	for _, c := range n.children {
+		e.Children = append(e.Children, exportNode(c))
+	}
+	return e
+}
+
+// infoColumns are the games columns copied straight from the game
+// information properties of the root node.
+var infoColumns = []struct{ column, property string }{
+	{"source", "SO"},
+	{"user", "US"},
+	{"annotator", "AN"},
+	{"copyright", "CP"},
+	{"game_comment", "GC"},
+	{"game_name", "GN"},
+	{"place", "PC"},
+	{"black_team", "BT"},
+	{"white_team", "WT"},
+}
+
+// utcTimestamp reads the date and time of day from a formatted game date as
+// local time in zone and returns it in UTC, along with the zone's name. Without
+// a zone the date is taken to already be in UTC. A date without a time of day
+// is kept as it was given, since local midnight in UTC is the day before
+// anywhere east of Greenwich, which would move the game to another day and
+// perhaps another month or year.
+func utcTimestamp(formatted string, zone *time.Location, withTime bool) (string, string) {
+	if zone == nil || len(formatted) < 19 {
+		return formatted, ""
+	}
+	if !withTime {
+		return formatted, zone.String()
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", formatted[:19], zone)
+	if err != nil {
+		return formatted, ""
+	}
+	return t.UTC().Format(time.RFC3339), zone.String()
+}
+
+// timeOfDay matches the time in a DT property which gives one.
+var timeOfDay = regexp.MustCompile(`\d{1,2}:\d{2}`)
+
+// hasTimeOfDay reports whether a DT property gives the time a game was
+// played as well as its date.
+func hasTimeOfDay(dt string) bool {
+	return timeOfDay.MatchString(dt)
+}
+
+// backfillLocalDates puts the games whose date without a time of day was
+// moved to UTC back on the date they were given.
+func backfillLocalDates(tx *sql.Tx) error {
+	rows, err := tx.Query("select id, timestamp, timezone, sgf from games where timezone is not null and timestamp is not null and sgf is not null")
+	if err != nil {
+		return err
 	}
+	dates := make(map[int64]string)
+	for rows.Next() {
+		var (
+			id                    int64
+			timestamp, tz, source string
+		)
+		if err := rows.Scan(&id, &timestamp, &tz, &source); err != nil {
+			rows.Close()
+			return err
+		}
+		games, err := readCollection([]byte(source))
+		if err != nil || len(games) == 0 || hasTimeOfDay(games[0].root.get("DT")) {
+			continue
+		}
+		zone, err := time.LoadLocation(tz)
+		if err != nil {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			continue
+		}
+		dates[id] = t.In(zone).Format("2006-01-02") + "T00:00:00Z"
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, date := range dates {
+		if _, err := tx.Exec("update games set timestamp = ? where id = ?", date, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gameColumns are the games columns set from a game's file.
+func gameColumns() []string {
+	columns := []string{
+		"black_id", "white_id", "winner_id", "result", "timestamp", "timezone", "path", "game_index", "sgf", "source_url",
+		"black_rank", "black_rank_uncertain", "white_rank", "white_rank_uncertain", "speed", "is_teaching",
+		"content_key",
+	}
+	for _, c := range infoColumns {
+		columns = append(columns, c.column)
+	}
+	return columns
+}
+
+// insertGameQuery is the statement storing a game in table, which takes its
+// id first when withID is set.
+func insertGameQuery(table string, withID bool) string {
+	columns := gameColumns()
+	if withID {
+		columns = append([]string{"id"}, columns...)
+	}
+	return fmt.Sprintf(
+		"insert into %s (%s) values (?%s)",
+		table,
+		strings.Join(columns, ", "),
+		strings.Repeat(", ?", len(columns)-1),
+	)
+}
+
+// updateGameQuery is the statement replacing a game in table, which takes the
+// id of the game last.
+func updateGameQuery(table string) string {
+	columns := gameColumns()
+	for i, c := range columns {
+		columns[i] = c + " = ?"
+	}
+	return "update " + table + " set " + strings.Join(columns, ", ") + " where id = ?"
 }
 
 func exists(path string) (bool, error) {
@@ -209,97 +703,326 @@ func exists(path string) (bool, error) {
 	return true, err
 }
 
-func walkFiles(done <-chan struct{}, root string) (<-chan string, <-chan error) {
-	paths := make(chan string)
+// walkedFile is a file found by walkFiles, numbered in walk order.
+type walkedFile struct {
+	seq  int
+	path string
+}
+
+// walkFiles sends every regular file under the roots, in lexical order,
+// except for those skip matches.
+func walkFiles(done <-chan struct{}, skip func(string) bool, progress *walkProgress, roots ...string) (<-chan walkedFile, <-chan error) {
+	paths := make(chan walkedFile)
 	errc := make(chan error, 1)
 	go func() {
 		defer close(paths)
-		errc <- filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.Mode().IsRegular() {
+		var seq int
+		for _, root := range roots {
+			err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.Mode().IsRegular() || skip(path) {
+					return nil
+				}
+				progress.started(path)
+				select {
+				case paths <- walkedFile{seq, path}:
+					seq++
+				case <-done:
+					return errors.New("walk canceled")
+				}
 				return nil
+			})
+			if err != nil {
+				errc <- err
+				return
 			}
-			select {
-			case paths <- path:
-			case <-done:
-				return errors.New("walk canceled")
-			}
-			return nil
-		})
+		}
+		errc <- nil
 	}()
 	return paths, errc
 }
 
 type result struct {
-	path        string
+	path string
+	// index is the position of the GameTree within its file's collection
+	index       int
 	black       string
 	white       string
 	network     string
 	winnerColor string
-	date        sgf.FuzzyDate
-	err         error
+	// resultType is the games.result value
+	resultType string
+	// date is the start date formatted as RFC 3339, in the game's local time
+	date    string
+	hasDate bool
+	source  string
+	root    *sgfNode
+	err     error
+	// errCategory groups errors for the summary
+	errCategory string
+	// warnings are the fields which couldn't be read, by field
+	warnings map[string]error
 }
 
-func processor(done <-chan struct{}, paths <-chan string, c chan<- result) {
-	for path := range paths {
-		rs := process(path)
-		for _, r := range rs {
-			select {
-			case c <- r:
-			case <-done:
-				return
-			}
+func (r *result) warn(field string, err error) {
+	if r.warnings == nil {
+		r.warnings = make(map[string]error)
+	}
+	if err == nil {
+		err = errors.New("missing")
+	}
+	r.warnings[field] = err
+}
+
+// fileResult is everything read from one file.
+type fileResult struct {
+	seq  int
+	path string
+	// hash is empty when the file couldn't be read
+	hash string
+	// unchanged files were imported before and have no games
+	unchanged bool
+	games     []result
+	// partial results hold only some of the file's games, as when they're
+	// accepted from quarantine
+	partial bool
+	// reserved is what the file holds of the memory budget until its games
+	// are stored
+	reserved int64
+}
+
+// readLimits bound the memory the workers use reading files.
+type readLimits struct {
+	maxFileSize int64
+	budget      *memoryBudget
+}
+
+func processor(done <-chan struct{}, paths <-chan walkedFile, known map[string]string, limits readLimits, c chan<- fileResult) {
+	for f := range paths {
+		fr := readFile(f, known, limits)
+		select {
+		case c <- fr:
+		case <-done:
+			limits.budget.release(fr.reserved)
+			return
 		}
 	}
 }
 
-func process(path string) []result {
-	r := []result{
-		result{path: path},
+// readFile reads and processes one walked file. Files over streamAbove are
+// hashed and then split into games as they are read, so the memory budget is
+// paid as the text is read and for each game once it's parsed, rather than
+// for the whole file up front. Compressed files are always read that way, as
+// they are decompressed, since their size says little about how big their
+// games are. Hashes are of the files as stored.
+func readFile(f walkedFile, known map[string]string, limits readLimits) fileResult {
+	path := f.path
+	fr := fileResult{seq: f.seq, path: path}
+	failed := func(category string, err error) fileResult {
+		fr.games = []result{{path: path, err: err, errCategory: category}}
+		return fr
 	}
-	data, err := ioutil.ReadFile(path)
+
+	info, err := os.Stat(path)
 	if err != nil {
-		r[0].err = fmt.Errorf("problem reading file: %s", err)
-		return r
+		return failed("read", fmt.Errorf("problem reading file: %s", err))
+	}
+	if info.Size() > limits.maxFileSize {
+		return failed("size", fmt.Errorf("the file is %d bytes, over the limit of %d", info.Size(), limits.maxFileSize))
+	}
+	if info.Size() <= streamAbove {
+		fr.reserved = limits.budget.acquire(f.seq, gameCost(int(info.Size())))
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return failed("read", fmt.Errorf("problem reading file: %s", err))
+		}
+		fr.hash = hashData(data)
+		fr.unchanged = known[path] == fr.hash
+		if !fr.unchanged && !compressed(data) {
+			fr.games = process(path, data)
+		}
+		if fr.unchanged || !compressed(data) {
+			return fr
+		}
+		// the compressed text is dropped here, and the games are paid for
+		// as they're decompressed below
+		limits.budget.release(fr.reserved)
+		fr.reserved = 0
+	} else {
+		fr.hash, err = hashFile(path)
+		if err != nil {
+			return failed("read", fmt.Errorf("problem reading file: %s", err))
+		}
+		fr.unchanged = known[path] == fr.hash
+		if fr.unchanged {
+			return fr
+		}
 	}
 
-	collection, _, err := parse.Parse(data)
+	file, err := os.Open(path)
+	if err != nil {
+		fr.hash = ""
+		return failed("read", fmt.Errorf("problem reading file: %s", err))
+	}
+	defer file.Close()
+	r, err := decompress(file)
+	if err != nil {
+		fr.hash = ""
+		return failed("read", fmt.Errorf("problem decompressing file: %s", err))
+	}
+	r = &sizeLimitedReader{r: r, limit: limits.maxFileSize}
+	r = &chargedReader{r: r, budget: limits.budget, seq: f.seq, reserved: &fr.reserved}
+	var index int
+	err = splitGameTrees(r, func(raw []byte) error {
+		// the games are kept until the file is stored, so each is paid for
+		// in full once it's read, its text having been paid for already
+		fr.reserved += limits.budget.acquire(f.seq, gameCost(len(raw))-int64(len(raw)))
+		for _, g := range process(path, raw) {
+			g.index = index
+			fr.games = append(fr.games, g)
+			index++
+		}
+		return nil
+	})
 	if err != nil {
-		r[0].err = fmt.Errorf("problem parsing file: %s", err)
-		return r
+		fr.games = append(fr.games, result{
+			path:        path,
+			err:         fmt.Errorf("problem parsing file: %s", err),
+			errCategory: "parse",
+		})
 	}
-	for i := range collection {
-		// extend the return structure to have the same base data for each GameTree
-		// in the collection
-		if i > 0 {
-			r = append(r, r[0])
+	return fr
+}
+
+// inWalkOrder passes on the results of processing files in the order the
+// files were walked rather than the order they finished in.
+func inWalkOrder(c <-chan fileResult) <-chan fileResult {
+	ordered := make(chan fileResult)
+	go func() {
+		defer close(ordered)
+		pending := make(map[int]fileResult)
+		next := 0
+		for fr := range c {
+			pending[fr.seq] = fr
+			for {
+				fr, ok := pending[next]
+				if !ok {
+					break
+				}
+				delete(pending, next)
+				ordered <- fr
+				next++
+			}
 		}
+	}()
+	return ordered
+}
+
+func process(path string, data []byte) []result {
+	games, err := readCollection(data)
+	if err == nil && len(games) == 0 {
+		err = errors.New("there are no games in the file")
+	}
+	if err != nil {
+		return []result{{
+			path:        path,
+			err:         fmt.Errorf("problem parsing file: %s", err),
+			errCategory: "parse",
+		}}
 	}
 
-	for i, gt := range collection {
-		r[i].date, err = gt.StartDate()
+	// a field which can't be read is left empty with a warning rather than
+	// losing the rest of the game
+	r := make([]result, len(games))
+	for i, g := range games {
+		r[i].path = path
+		r[i].index = i
+		// keep the source text of each GameTree so it can be exported later
+		r[i].source = string(g.raw)
+		r[i].root = g.root
+
+		r[i].date, err = startDate(g.root.get("DT"))
 		if err != nil {
-			r[i].err = fmt.Errorf("error getting date for GameTree: %s", err)
-			continue
+			r[i].warn("date", err)
+		} else {
+			r[i].hasDate = true
 		}
-		r[i].black, err = gt.BlackPlayerName()
+		r[i].black, err = playerName(g.root, "PB")
 		if err != nil {
-			r[i].err = fmt.Errorf("error getting black player name for GameTree: %s", err)
-			continue
+			r[i].warn("black player", err)
 		}
-		r[i].white, err = gt.WhitePlayerName()
+		r[i].white, err = playerName(g.root, "PW")
 		if err != nil {
-			r[i].err = fmt.Errorf("error getting white player name for GameTree: %s", err)
-			continue
+			r[i].warn("white player", err)
 		}
-		r[i].winnerColor, err = gt.WinnerColor()
-		if r[i].winnerColor == "" {
-			r[i].err = fmt.Errorf("error getting the winner color for GameTree: %s", err)
-			continue
+		re := g.root.get("RE")
+		r[i].winnerColor, err = winnerColor(re)
+		r[i].resultType = resultType(re, r[i].winnerColor)
+		switch r[i].resultType {
+		case resultJigo, resultVoid:
+			r[i].winnerColor = ""
+		case resultUnknown:
+			r[i].warn("winner", err)
+		}
+		r[i].network = config.networkFor(path, r[i].root)
+		if r[i].black != "" {
+			r[i].black = config.playerName(r[i].network, networkPlayerName(r[i].network, r[i].black))
+		}
+		if r[i].white != "" {
+			r[i].white = config.playerName(r[i].network, networkPlayerName(r[i].network, r[i].white))
 		}
-		r[i].network = "sample"
 	}
 	return r
 }
+
+// dateAndTime matches the start of a DT property: a year, optionally a month
+// and a day, and optionally a time of day after the day.
+var dateAndTime = regexp.MustCompile(`^(\d{4})(?:-(\d{2})(?:-(\d{2})(?:[ T](\d{1,2}):(\d{2})(?::(\d{2}))?)?)?)?`)
+
+// startDate reads the date a game started from its DT property, which may
+// list several dates, formatted as RFC 3339. A missing month or day is taken
+// to be the first.
+func startDate(dt string) (string, error) {
+	first := strings.TrimSpace(strings.SplitN(dt, ",", 2)[0])
+	if first == "" {
+		return "", errors.New("the game has no date")
+	}
+	m := dateAndTime.FindStringSubmatch(first)
+	if m == nil {
+		return "", fmt.Errorf("can't read the date %q", first)
+	}
+	parts := make([]int, len(m)-1)
+	for i, v := range m[1:] {
+		parts[i], _ = strconv.Atoi(v)
+	}
+	for i := 1; i <= 2; i++ {
+		if parts[i] == 0 {
+			parts[i] = 1
+		}
+	}
+	t := time.Date(parts[0], time.Month(parts[1]), parts[2], parts[3], parts[4], parts[5], 0, time.UTC)
+	if t.Month() != time.Month(parts[1]) || t.Day() != parts[2] || parts[3] > 23 || parts[4] > 59 || parts[5] > 59 {
+		return "", fmt.Errorf("can't read the date %q", first)
+	}
+	return t.Format(time.RFC3339), nil
+}
+
+// playerName reads a player's name from the PB or PW property.
+func playerName(root *sgfNode, property string) (string, error) {
+	name := strings.TrimSpace(root.get(property))
+	if name == "" {
+		return "", fmt.Errorf("the game has no %s property", property)
+	}
+	return name, nil
+}
+
+// winnerColor reads the color of the winner from a RE property, B or W.
+func winnerColor(re string) (string, error) {
+	re = strings.ToUpper(strings.TrimSpace(re))
+	if len(re) >= 2 && re[1] == '+' && (re[0] == 'B' || re[0] == 'W') {
+		return re[:1], nil
+	}
+	return "", fmt.Errorf("can't read a winner from the result %q", re)
+}
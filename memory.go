@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// streamAbove is the file size past which files are read one GameTree at a
+// time rather than being read and parsed whole.
+const streamAbove = 1 << 20
+
+// parsedOverhead is roughly how many times its size in SGF text a game takes
+// in memory once it's read: its source text, kept for the games table, and
+// the game tree readCollection builds from it, whose nodes each hold a map of
+// their properties.
+const parsedOverhead = 4
+
+// gameCost is what a game read from n bytes of SGF holds of the memory
+// budget.
+func gameCost(n int) int64 {
+	return int64(n) * parsedOverhead
+}
+
+// memoryBudget bounds the memory the import workers hold at once. Workers
+// reserve what they read and parse as they go, and a file's reservations are
+// released once its games have been stored.
+//
+// The file the import stores next, the lowest numbered one not yet stored,
+// never waits for the budget. Files can finish out of order and hold their
+// reservations until they're stored, which in walk order means waiting for
+// that file, so making it wait could leave every worker waiting on the
+// others.
+type memoryBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+	// next is the lowest numbered file not yet stored, and stored the
+	// numbers above it which have been
+	next   int
+	stored map[int]bool
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	b := &memoryBudget{limit: limit, stored: make(map[int]bool)}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n bytes are free and reserves them for the file
+// numbered seq, returning the amount reserved. The file stored next goes
+// ahead without waiting, over the budget if need be.
+func (b *memoryBudget) acquire(seq int, n int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used+n > b.limit && seq != b.next {
+		b.cond.Wait()
+	}
+	b.used += n
+	return n
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// done releases the reservations of the file numbered seq once its games
+// have been stored.
+func (b *memoryBudget) done(seq int, n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.stored[seq] = true
+	for b.stored[b.next] {
+		delete(b.stored, b.next)
+		b.next++
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// chargedReader reserves what's read from r for the file numbered seq as it's
+// read, adding it to reserved, so a game is paid for while it's being
+// gathered up and not only once it's whole.
+type chargedReader struct {
+	r        io.Reader
+	budget   *memoryBudget
+	seq      int
+	reserved *int64
+}
+
+func (c *chargedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		*c.reserved += c.budget.acquire(c.seq, int64(n))
+	}
+	return n, err
+}
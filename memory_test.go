@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// readCharged reads data through a chargedReader for the file numbered seq,
+// returning what it reserved once the read is done.
+func readCharged(budget *memoryBudget, seq int, data []byte) <-chan int64 {
+	done := make(chan int64, 1)
+	go func() {
+		var reserved int64
+		r := &chargedReader{r: bytes.NewReader(data), budget: budget, seq: seq, reserved: &reserved}
+		ioutil.ReadAll(r)
+		done <- reserved
+	}()
+	return done
+}
+
+func TestChargedReaderWaitsForBudget(t *testing.T) {
+	budget := newMemoryBudget(10)
+
+	// the file stored next reads past the budget without waiting
+	var first int64
+	select {
+	case first = <-readCharged(budget, 0, make([]byte, 25)):
+	case <-time.After(time.Second):
+		t.Fatal("the file stored next waited for the budget")
+	}
+	if first != 25 {
+		t.Fatalf("the first file reserved %d bytes, want 25", first)
+	}
+
+	// a later file waits until the budget is freed
+	second := readCharged(budget, 1, make([]byte, 5))
+	select {
+	case n := <-second:
+		t.Fatalf("the second file read %d bytes over the budget", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	budget.done(0, first)
+	select {
+	case n := <-second:
+		if n != 5 {
+			t.Errorf("the second file reserved %d bytes, want 5", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the second file still waited once the budget was freed")
+	}
+	budget.done(1, 5)
+	if budget.used != 0 {
+		t.Errorf("%d bytes are still reserved", budget.used)
+	}
+}
+
+func TestMemoryBudgetNextFile(t *testing.T) {
+	budget := newMemoryBudget(10)
+	budget.acquire(0, 10)
+
+	// file 1 becomes the one stored next once file 0 is, even while file 2,
+	// stored out of order, still holds its share
+	budget.done(2, 0)
+	budget.done(0, 10)
+	if budget.next != 1 {
+		t.Fatalf("the next file is %d, want 1", budget.next)
+	}
+	budget.done(1, 0)
+	if budget.next != 3 {
+		t.Errorf("the next file is %d, want 3", budget.next)
+	}
+}
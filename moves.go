@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// moveRow is one node of a game tree as stored in the moves table.
+type moveRow struct {
+	node, parent int
+	branch       int
+	moveNumber   int
+	color, point string
+	comment      string
+	mainLine     bool
+	// timeLeft is the player's remaining time after the move, in seconds,
+	// from the BL or WL property when timed is set
+	timeLeft float64
+	timed    bool
+}
+
+// gameMoves flattens a game tree into rows, numbering the nodes in the order
+// they appear in the SGF so the root is node 0 and the main line comes first.
+func gameMoves(root *sgfNode) []moveRow {
+	var rows []moveRow
+	var walk func(n *sgfNode, parent, branch, moveNumber int, mainLine bool)
+	walk = func(n *sgfNode, parent, branch, moveNumber int, mainLine bool) {
+		row := moveRow{
+			node:     len(rows),
+			parent:   parent,
+			branch:   branch,
+			comment:  n.get("C"),
+			mainLine: mainLine,
+		}
+		for _, color := range []string{"B", "W"} {
+			if _, ok := n.props[color]; ok {
+				row.color = color
+				row.point = n.get(color)
+				row.timeLeft, row.timed = parseSeconds(n.get(color + "L"))
+				moveNumber++
+			}
+		}
+		row.moveNumber = moveNumber
+		rows = append(rows, row)
+		for i, c := range n.children {
+			walk(c, row.node, i, moveNumber, mainLine && i == 0)
+		}
+	}
+	if root != nil {
+		walk(root, -1, 0, 0, true)
+	}
+	return rows
+}
+
+// movesPerInsert keeps each insert under sqlite's limit of 999 variables.
+const movesPerInsert = 90
+
+// storeMoves records the tree of a game in a moves table, a batch of nodes at
+// a time, which db should be the transaction storing the game so the game is
+// never stored with only some of its moves.
+func storeMoves(db queryer, table string, gameID int64, rows []moveRow) error {
+	for start := 0; start < len(rows); start += movesPerInsert {
+		end := start + movesPerInsert
+		if end > len(rows) {
+			end = len(rows)
+		}
+		var args []interface{}
+		for _, m := range rows[start:end] {
+			var parent interface{}
+			if m.parent >= 0 {
+				parent = m.parent
+			}
+			var point, timeLeft interface{}
+			if m.color != "" {
+				point = m.point
+			}
+			if m.timed {
+				timeLeft = m.timeLeft
+			}
+			args = append(args,
+				gameID, m.node, parent, m.branch, m.moveNumber,
+				nullIfEmpty(m.color), point, nullIfEmpty(m.comment), m.mainLine, timeLeft,
+			)
+		}
+		_, err := db.Exec(fmt.Sprintf(`
+			insert into %s
+			(game_id, node, parent, branch, move_number, color, point, comment, main_line, time_left)
+			values %s`,
+			table,
+			strings.TrimSuffix(strings.Repeat("(?, ?, ?, ?, ?, ?, ?, ?, ?, ?), ", end-start), ", "),
+		), args...)
+		if err != nil {
+			return fmt.Errorf("problem storing the moves of game %d: %s", gameID, err)
+		}
+	}
+	return nil
+}
+
+// backfillMoves stores the moves of the games whose moves don't match their
+// SGF text, as when an import stopped while storing them.
+func backfillMoves(tx *sql.Tx) error {
+	counts := make(map[int64]int)
+	rows, err := tx.Query("select game_id, count(*) from moves group by game_id")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int64
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			rows.Close()
+			return err
+		}
+		counts[id] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	missing := make(map[int64][]moveRow)
+	err = visitStoredGames(tx, func(id int64, root *sgfNode) {
+		if moves := gameMoves(root); len(moves) != counts[id] {
+			missing[id] = moves
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for id, moves := range missing {
+		if _, err := tx.Exec("delete from moves where game_id = ?", id); err != nil {
+			return err
+		}
+		if err := storeMoves(tx, "moves", id, moves); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// networkAdapter holds what the importer and the other commands need to know
+// about one Go server. Supporting a new server means adding an adapter to
+// networkAdapters.
+//
+// Every adapter detects its network's games and reads their names and ranks,
+// but only OGS, whose API is public, implements profileFetcher, so enrich
+// can't look up the players of KGS, Fox, Tygem or DGS. Those servers have no
+// public API for their players' profiles.
+type networkAdapter interface {
+	// name is the network's name as it's stored with its players, unless the
+	// configuration file names it differently
+	name() string
+	// detect reports whether a game was played on the network, for games
+	// outside of every directory in the configured networks
+	detect(root *sgfNode) bool
+	// playerName tidies a player's name as the server writes it in PB and PW
+	playerName(name string) string
+	// rank reads a rank as the server writes it in BR and WR
+	rank(s string) rankValue
+}
+
+// profileFetcher is implemented by the adapters of networks whose servers can
+// be asked about their players, which so far is only OGS.
+type profileFetcher interface {
+	fetchProfile(client *http.Client, credentials map[string]string, name string) (*playerProfile, error)
+}
+
+var networkAdapters = []networkAdapter{
+	ogsAdapter{},
+	kgsAdapter{},
+	foxAdapter{},
+	tygemAdapter{},
+	dgsAdapter{},
+}
+
+// adapterFor returns the adapter of a network, named without regard to case,
+// or nil for networks without one.
+func adapterFor(network string) networkAdapter {
+	for _, a := range networkAdapters {
+		if strings.EqualFold(a.name(), network) {
+			return a
+		}
+	}
+	return nil
+}
+
+// detectNetwork returns the name of the first network whose adapter
+// recognizes a game.
+func detectNetwork(root *sgfNode) (string, bool) {
+	if root == nil {
+		return "", false
+	}
+	for _, a := range networkAdapters {
+		if a.detect(root) {
+			return a.name(), true
+		}
+	}
+	return "", false
+}
+
+// networkPlayerName is a player's name tidied by their network's adapter.
+func networkPlayerName(network, name string) string {
+	if a := adapterFor(network); a != nil {
+		return a.playerName(name)
+	}
+	return strings.TrimSpace(name)
+}
+
+// networkRank reads a rank with the adapter of the network it was given on.
+func networkRank(network, s string) rankValue {
+	if a := adapterFor(network); a != nil {
+		return a.rank(s)
+	}
+	return normalizeRank(s)
+}
+
+// storedNetworks returns the network of each stored game by its id, which is
+// that of its players, for reading what the game's SGF says the way its
+// network's adapter does.
+func storedNetworks(db queryer) (map[int64]string, error) {
+	rows, err := db.Query(`
+		select g.id, coalesce(b.network, w.network, '')
+		from games g
+		left join players b on b.id = g.black_id
+		left join players w on w.id = g.white_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	networks := make(map[int64]string)
+	for rows.Next() {
+		var (
+			id      int64
+			network string
+		)
+		if err := rows.Scan(&id, &network); err != nil {
+			return nil, err
+		}
+		networks[id] = network
+	}
+	return networks, rows.Err()
+}
+
+// fetcherNames lists the networks with a profileFetcher, for usage messages.
+func fetcherNames() string {
+	var names []string
+	for _, a := range networkAdapters {
+		if _, ok := a.(profileFetcher); ok {
+			names = append(names, strings.ToLower(a.name()))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// rootMentions reports whether any of the properties servers sign their games
+// with contain one of the words, without regard to case.
+func rootMentions(root *sgfNode, words ...string) bool {
+	var text []string
+	for _, id := range []string{"PC", "AP", "SO", "EV", "GN"} {
+		text = append(text, root.props[id]...)
+	}
+	return containsAny(strings.ToLower(strings.Join(text, " ")), words)
+}
+
+// baseAdapter has the behaviour shared by the servers which don't need
+// anything special.
+type baseAdapter struct{}
+
+func (baseAdapter) playerName(name string) string { return strings.TrimSpace(name) }
+
+func (baseAdapter) rank(s string) rankValue { return normalizeRank(s) }
+
+// ogsAdapter is for OGS, the Online Go Server at online-go.com.
+type ogsAdapter struct{ baseAdapter }
+
+func (ogsAdapter) name() string { return "OGS" }
+
+func (ogsAdapter) detect(root *sgfNode) bool {
+	return rootMentions(root, "online-go.com", "ogs:")
+}
+
+const ogsAPI = "https://online-go.com/api/v1"
+
+func (ogsAdapter) fetchProfile(client *http.Client, credentials map[string]string, name string) (*playerProfile, error) {
+	req, err := http.NewRequest("GET", ogsAPI+"/players/?username="+url.QueryEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := credentials["token"]; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the server said %s", resp.Status)
+	}
+
+	var page struct {
+		Results []struct {
+			ID       int64   `json:"id"`
+			Username string  `json:"username"`
+			Country  string  `json:"country"`
+			Ranking  float64 `json:"ranking"`
+			UIClass  string  `json:"ui_class"`
+			Ratings  struct {
+				Overall struct {
+					Rating float64 `json:"rating"`
+				} `json:"overall"`
+			} `json:"ratings"`
+		} `json:"results"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading the response: %s", err)
+	}
+	for _, r := range page.Results {
+		if r.Username != name {
+			continue
+		}
+		profile := &playerProfile{
+			remoteID:   fmt.Sprint(r.ID),
+			country:    r.Country,
+			profileURL: fmt.Sprintf("https://online-go.com/player/%d", r.ID),
+			isBot:      strings.Contains(r.UIClass, "bot"),
+		}
+		if r.Ratings.Overall.Rating > 0 {
+			profile.rating = sql.NullFloat64{Float64: r.Ratings.Overall.Rating, Valid: true}
+		}
+		// OGS rankings count up from 30k at 0, so 30 is 1d
+		if r.Ranking > 0 {
+			profile.rank = formatRank(r.Ranking - 29)
+		}
+		return profile, nil
+	}
+	return nil, errNoProfile
+}
+
+// kgsAdapter is for the KGS Go Server at gokgs.com. Its ranks are marked
+// with a ? until they settle, which normalizeRank already reads.
+type kgsAdapter struct{ baseAdapter }
+
+func (kgsAdapter) name() string { return "KGS" }
+
+func (kgsAdapter) detect(root *sgfNode) bool {
+	return rootMentions(root, "gokgs.com", "kgs go server", "kiseido go server")
+}
+
+// foxAdapter is for the Yehu or Fox Weiqi server, whose games are written
+// with Chinese ranks.
+type foxAdapter struct{ baseAdapter }
+
+func (foxAdapter) name() string { return "Fox" }
+
+func (foxAdapter) detect(root *sgfNode) bool {
+	return rootMentions(root, "foxwq", "野狐", "fox weiqi")
+}
+
+// rank reads Fox's professional ranks, written as P9段, as well as the usual
+// forms.
+func (foxAdapter) rank(s string) rankValue {
+	t := strings.ToLower(strings.TrimSpace(s))
+	if strings.HasPrefix(t, "p") && strings.HasSuffix(t, "段") {
+		return normalizeRank(strings.TrimSuffix(t, "段"))
+	}
+	return normalizeRank(s)
+}
+
+// tygemAdapter is for Tygem, whose games are written with Korean or English
+// ranks.
+type tygemAdapter struct{ baseAdapter }
+
+func (tygemAdapter) name() string { return "Tygem" }
+
+func (tygemAdapter) detect(root *sgfNode) bool {
+	return rootMentions(root, "tygem", "타이젬")
+}
+
+// dgsAdapter is for DGS, the Dragon Go Server, which hosts turn based games.
+type dgsAdapter struct{ baseAdapter }
+
+func (dgsAdapter) name() string { return "DGS" }
+
+func (dgsAdapter) detect(root *sgfNode) bool {
+	return rootMentions(root, "dragongoserver", "dragon go server")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const noteUsage = `usage:
+  note add [-db-path PATH] [-move N] GAME_ID [TEXT...]
+  note edit [-db-path PATH] NOTE_ID [TEXT...]
+  note remove [-db-path PATH] NOTE_ID
+  note list [-db-path PATH] GAME_ID
+
+When TEXT is left out of add or edit the note is opened in $EDITOR.`
+
+func noteCommand(args []string) {
+	if len(args) == 0 || (args[0] != "add" && args[0] != "edit" && args[0] != "remove" && args[0] != "list") {
+		fmt.Fprintln(os.Stderr, noteUsage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("note "+args[0], flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to use")
+		move   = fs.Int("move", 0, "The move number the note refers to, if any")
+	)
+	fs.Parse(args[1:])
+
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, noteUsage)
+		os.Exit(2)
+	}
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		log.Fatalf("%q is not an id\n", fs.Arg(0))
+	}
+	text := strings.Join(fs.Args()[1:], " ")
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "add":
+		if text == "" {
+			text, err = editText("")
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		var moveNumber interface{}
+		if *move > 0 {
+			moveNumber = *move
+		}
+		noteID, err := addNote(db, id, moveNumber, text)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(noteID)
+	case "edit":
+		if text == "" {
+			var old string
+			err := db.QueryRow("select body from notes where id = ?", id).Scan(&old)
+			if err == sql.ErrNoRows {
+				log.Fatalf("there is no note with id %d\n", id)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			text, err = editText(old)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		err := updateNote(db, id, text)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "remove":
+		_, err := db.Exec("delete from notes where id = ?", id)
+		if err != nil {
+			log.Fatalf("error removing note %d: %s\n", id, err)
+		}
+	case "list":
+		err := listNotes(db, id)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func addNote(db *sql.DB, gameID int64, moveNumber interface{}, text string) (int64, error) {
+	if strings.TrimSpace(text) == "" {
+		return 0, fmt.Errorf("refusing to add an empty note")
+	}
+	var found int
+	err := db.QueryRow("select count(*) from games where id = ?", gameID).Scan(&found)
+	if err != nil {
+		return 0, err
+	}
+	if found == 0 {
+		return 0, fmt.Errorf("there is no game with id %d", gameID)
+	}
+	now := time.Now().Format(time.RFC3339)
+	result, err := db.Exec(
+		"insert into notes (game_id, move_number, body, created, updated) values (?, ?, ?, ?, ?)",
+		gameID,
+		moveNumber,
+		text,
+		now,
+		now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("problem adding note to game %d: %s", gameID, err)
+	}
+	return result.LastInsertId()
+}
+
+func updateNote(db *sql.DB, id int64, text string) error {
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("refusing to save an empty note; use note remove instead")
+	}
+	result, err := db.Exec(
+		"update notes set body = ?, updated = ? where id = ?",
+		text,
+		time.Now().Format(time.RFC3339),
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("problem updating note %d: %s", id, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("there is no note with id %d", id)
+	}
+	return nil
+}
+
+func listNotes(db *sql.DB, gameID int64) error {
+	rows, err := db.Query(
+		"select id, move_number, body from notes where game_id = ? order by coalesce(move_number, 0), id",
+		gameID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id         int64
+			moveNumber sql.NullInt64
+			body       string
+		)
+		if err := rows.Scan(&id, &moveNumber, &body); err != nil {
+			return err
+		}
+		if moveNumber.Valid {
+			fmt.Printf("[%d] move %d: %s\n", id, moveNumber.Int64, body)
+		} else {
+			fmt.Printf("[%d] %s\n", id, body)
+		}
+	}
+	return rows.Err()
+}
+
+// editText opens text in the user's editor and returns the saved result.
+func editText(text string) (string, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	f, err := ioutil.TempFile("", "sgf-note-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(text)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command(editor, f.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("problem running %s: %s", editor, err)
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
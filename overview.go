@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const overviewUsage = `usage:
+  overview [-db-path PATH] [-limit N]
+
+overview prints library-wide numbers as a quick check after a big import:
+the games in total, by network and by year, the players met most often, the
+files holding the most game records and how much space the database takes.`
+
+// overviewBarWidth is the length of the longest bar in the histograms.
+const overviewBarWidth = 40
+
+func overviewCommand(args []string) {
+	fs := flag.NewFlagSet("overview", flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		limit  = fs.Int("limit", 10, "The most opponents and files to list")
+	)
+	fs.Parse(args)
+
+	if fs.NArg() > 0 || *limit < 1 {
+		fmt.Fprintln(os.Stderr, overviewUsage)
+		os.Exit(2)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	err = printOverview(db, *dbPath, *limit)
+	if err != nil {
+		log.Fatalf("error reading the library: %s\n", err)
+	}
+}
+
+func printOverview(db *sql.DB, dbPath string, limit int) error {
+	var games, players, files int
+	err := db.QueryRow(`
+		select (select count(*) from games), (select count(*) from players where id != 0), (select count(*) from files)`,
+	).Scan(&games, &players, &files)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d games between %d players, imported from %d files\n\n", games, players, files)
+
+	// a game's network is its black player's, both being on the same server
+	fmt.Println("By network")
+	err = printHistogram(db, `
+		select coalesce(p.network, '(unknown)'), count(*)
+		from games g
+		left join players p on p.id = g.black_id
+		group by p.network
+		order by count(*) desc`,
+	)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("By year")
+	err = printHistogram(db, `
+		select coalesce(substr(g.timestamp, 1, 4), '(undated)'), count(*)
+		from games g
+		group by substr(g.timestamp, 1, 4)
+		order by substr(g.timestamp, 1, 4)`,
+	)
+	if err != nil {
+		return err
+	}
+
+	// the self names would top the list, so they are left out; the empty
+	// name keeps the list valid sql when there are none
+	fmt.Println("Most frequent opponents")
+	exclude := append([]string{""}, config.Self...)
+	in := strings.TrimSuffix(strings.Repeat("?, ", len(exclude)), ", ")
+	var args []interface{}
+	for _, name := range exclude {
+		args = append(args, name)
+	}
+	err = printQuery(db, `
+		select p.name as player, coalesce(p.network, '') as network, count(*) as games
+		from players p
+		join games g on p.id in (g.black_id, g.white_id)
+		where p.id != 0 and p.name not in (`+in+`)
+		group by p.id
+		order by count(*) desc, p.name
+		limit ?`,
+		append(args, limit),
+	)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+
+	fmt.Println("Largest files, by the size of their game records")
+	err = printQuery(db, `
+		select g.path as file, count(*) as games, printf('%.1f', sum(length(g.sgf)) / 1024.0) as kb
+		from games g
+		group by g.path
+		order by sum(length(g.sgf)) desc
+		limit ?`,
+		[]interface{}{limit},
+	)
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+
+	sizes, err := databaseSizes(db, dbPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Database size")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	var total int64
+	for _, s := range sizes {
+		fmt.Fprintf(tw, "%s\t%.1f MB\n", s.path, float64(s.size)/(1<<20))
+		total += s.size
+	}
+	if len(sizes) > 1 {
+		fmt.Fprintf(tw, "total\t%.1f MB\n", float64(total)/(1<<20))
+	}
+	return tw.Flush()
+}
+
+// printHistogram prints the label and count rows of query with a bar for
+// each.
+func printHistogram(db *sql.DB, query string, args ...interface{}) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var (
+		labels []string
+		counts []int
+		most   int
+	)
+	for rows.Next() {
+		var (
+			label string
+			count int
+		)
+		if err := rows.Scan(&label, &count); err != nil {
+			return err
+		}
+		labels = append(labels, label)
+		counts = append(counts, count)
+		if count > most {
+			most = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i, label := range labels {
+		bar := strings.Repeat("#", (counts[i]*overviewBarWidth+most-1)/most)
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", label, counts[i], bar)
+	}
+	fmt.Fprintln(tw)
+	return tw.Flush()
+}
+
+type fileSize struct {
+	path string
+	size int64
+}
+
+// databaseSizes returns the size of the database's file and of each of its
+// partitions, counting their write-ahead logs.
+func databaseSizes(db *sql.DB, dbPath string) ([]fileSize, error) {
+	paths := []string{dbPath}
+	parts, err := listPartitions(db, dbPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		paths = append(paths, p.path)
+	}
+	var sizes []fileSize
+	for _, path := range paths {
+		s := fileSize{path: path}
+		for _, suffix := range []string{"", "-wal"} {
+			if info, err := os.Stat(path + suffix); err == nil {
+				s.size += info.Size()
+			}
+		}
+		sizes = append(sizes, s)
+	}
+	return sizes, nil
+}
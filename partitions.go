@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Partitioned databases keep their games in one sqlite file per year next to
+// the main database, which holds everything else. Each partition is a full
+// database migrated like the main one, so its tables always have the same
+// columns, and only its partitionedTables are used.
+//
+// The query commands see every partition through temporary views named after
+// the partitioned tables, which shadow the main tables on each connection. sqlite can't enforce
+// foreign keys across files, so they are left off for partitioned databases and
+// the check command looks for orphans instead. Writes through the views are
+// passed on to the table in every file by temporary triggers, which is how
+// commands which don't know about partitions can still update and delete
+// games; inserts have to go to a partition, so only the import makes them.
+//
+// sqlite attaches at most maxPartitions databases to a connection, both to
+// the query commands' connections and to the import's, which limits a
+// database to that many years of games. Games without a date are kept in the
+// main database, so they don't take up a partition.
+
+// partitionedTables are the tables whose rows are kept in the partitions.
+var partitionedTables = []string{"games", "moves"}
+
+// maxPartitions is sqlite's default limit on attached databases,
+// SQLITE_MAX_ATTACHED.
+const maxPartitions = 10
+
+type partition struct {
+	// name is the schema name the partition is attached as
+	name string
+	path string
+}
+
+// partitionPath is where the games of a year are kept for the database at
+// dbPath, e.g. games-2019.db next to games.db.
+func partitionPath(dbPath, year string) string {
+	ext := filepath.Ext(dbPath)
+	return strings.TrimSuffix(dbPath, ext) + "-" + year + ext
+}
+
+// partitionYear is the year a game belongs to by its UTC timestamp, or ""
+// for a game without a date.
+func partitionYear(timestamp string) string {
+	if len(timestamp) < 4 {
+		return ""
+	}
+	return timestamp[:4]
+}
+
+// listPartitions returns the partitions of the database at dbPath. Their paths
+// are stored relative to the main database so the files can be moved together.
+func listPartitions(db queryer, dbPath string) ([]partition, error) {
+	rows, err := db.Query("select name, path from partitions order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var parts []partition
+	for rows.Next() {
+		var p partition
+		if err := rows.Scan(&p.name, &p.path); err != nil {
+			return nil, err
+		}
+		p.path = filepath.Join(filepath.Dir(dbPath), p.path)
+		parts = append(parts, p)
+	}
+	return parts, rows.Err()
+}
+
+// openPartition opens and migrates a partition's file. Foreign keys stay off
+// since its games refer to players in the main database.
+func openPartition(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", partitionDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("problem migrating the partition %s: %s", path, err)
+	}
+	return db, nil
+}
+
+// openPartitioned opens a partitioned database for the query commands, with
+// every partition attached to each connection and the games view over them.
+func openPartitioned(path string, parts []partition) (*sql.DB, error) {
+	for _, p := range parts {
+		pdb, err := openPartition(p.path)
+		if err != nil {
+			return nil, err
+		}
+		pdb.Close()
+	}
+
+	d := &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return attachPartitions(conn, parts)
+		},
+	}
+	return sql.OpenDB(dsnConnector{dsn: partitionDSN(path), driver: d}), nil
+}
+
+// attachPartitions attaches the partitions to a connection and creates the
+// views over them.
+func attachPartitions(conn *sqlite3.SQLiteConn, parts []partition) error {
+	for _, p := range parts {
+		_, err := conn.Exec("attach database ? as "+p.name, []driver.Value{p.path})
+		if err != nil {
+			return fmt.Errorf("problem attaching the partition %s: %s", p.path, err)
+		}
+	}
+	for _, table := range partitionedTables {
+		selects := []string{"select * from main." + table}
+		for _, p := range parts {
+			selects = append(selects, "select * from "+p.name+"."+table)
+		}
+		_, err := conn.Exec("create temp view "+table+" as "+strings.Join(selects, " union all "), nil)
+		if err != nil {
+			return err
+		}
+		err = createViewTriggers(conn, table, parts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createViewTriggers makes updates and deletes through the view of a
+// partitioned table change its rows in whichever file holds them.
+func createViewTriggers(conn *sqlite3.SQLiteConn, table string, parts []partition) error {
+	rows, err := conn.Query("pragma main.table_info("+table+")", nil)
+	if err != nil {
+		return err
+	}
+	var columns, keys []string
+	row := make([]driver.Value, 6)
+	for rows.Next(row) == nil {
+		// cid, name, type, notnull, dflt_value, pk
+		name := fmt.Sprint(row[1])
+		if b, ok := row[1].([]byte); ok {
+			name = string(b)
+		}
+		columns = append(columns, name+" = new."+name)
+		if pk, ok := row[5].(int64); ok && pk > 0 {
+			keys = append(keys, name+" = old."+name)
+		}
+	}
+	rows.Close()
+	if len(keys) == 0 {
+		return fmt.Errorf("the %s table has no primary key", table)
+	}
+
+	schemas := []string{"main"}
+	for _, p := range parts {
+		schemas = append(schemas, p.name)
+	}
+	where := " where " + strings.Join(keys, " and ") + ";\n"
+	var deletes, updates strings.Builder
+	for _, schema := range schemas {
+		deletes.WriteString("delete from " + schema + "." + table + where)
+		updates.WriteString("update " + schema + "." + table + " set " + strings.Join(columns, ", ") + where)
+	}
+	_, err = conn.Exec("create temp trigger "+table+"_delete instead of delete on "+table+" begin\n"+deletes.String()+"end", nil)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec("create temp trigger "+table+"_update instead of update on "+table+" begin\n"+updates.String()+"end", nil)
+	return err
+}
+
+// dsnConnector opens connections to one data source with a particular driver,
+// for drivers which aren't registered by name.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// partitionWriter routes imported games into their year's partition, creating
+// partitions as new years turn up; games without a date stay in the main
+// database. The partitions are attached to the store's connection, so the
+// games of a file are written in the same transaction as everything else the
+// file stores. Game ids are handed out here so that they stay unique across
+// partitions.
+type partitionWriter struct {
+	dbPath string
+	conn   *sql.Conn
+	// attached are the names of the partitions attached to conn
+	attached map[string]bool
+	// needed are the years the file being stored needs partitions for
+	needed []string
+	nextID int64
+	// fileID is nextID when the file being stored began
+	fileID int64
+}
+
+func newPartitionWriter(dbPath string, conn *sql.Conn, parts []partition) (*partitionWriter, error) {
+	w := &partitionWriter{
+		dbPath:   dbPath,
+		conn:     conn,
+		attached: make(map[string]bool),
+	}
+	ctx := context.Background()
+	err := conn.QueryRowContext(ctx, "select coalesce(max(id), 0) from main.games").Scan(&w.nextID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		if err := w.attach(p); err != nil {
+			return nil, err
+		}
+		var max int64
+		err = conn.QueryRowContext(ctx, "select coalesce(max(id), 0) from "+p.name+".games").Scan(&max)
+		if err != nil {
+			return nil, err
+		}
+		if max > w.nextID {
+			w.nextID = max
+		}
+	}
+	w.nextID++
+	w.fileID = w.nextID
+	return w, nil
+}
+
+// attach migrates a partition, creating it when it's new, and attaches it to
+// the connection. It can't be done in a transaction.
+func (w *partitionWriter) attach(p partition) error {
+	db, err := openPartition(p.path)
+	if err != nil {
+		return err
+	}
+	db.Close()
+	_, err = w.conn.ExecContext(context.Background(), "attach database ? as "+p.name, p.path)
+	if err != nil {
+		return fmt.Errorf("problem attaching the partition %s: %s", p.path, err)
+	}
+	w.attached[p.name] = true
+	return nil
+}
+
+// schemas are the names of the databases on the connection holding games.
+func (w *partitionWriter) schemas() []string {
+	schemas := []string{"main"}
+	for name := range w.attached {
+		schemas = append(schemas, name)
+	}
+	sort.Strings(schemas[1:])
+	return schemas
+}
+
+// insert stores a game and its moves in the partition for its timestamp. The
+// values are those of insertGameQuery("games", false), without the id. A
+// game from a year without an attached partition returns errStoreAgain, and
+// the partition is attached when the file's transaction is rolled back.
+func (w *partitionWriter) insert(tx *sql.Tx, timestamp string, values []interface{}, moves []moveRow) (int64, error) {
+	schema := "main"
+	if year := partitionYear(timestamp); year != "" {
+		schema = "y" + year
+	}
+	if schema != "main" && !w.attached[schema] {
+		if len(w.attached) >= maxPartitions {
+			return 0, fmt.Errorf(
+				"a game from %s would need an %dth partition, but sqlite only attaches %d databases to a connection; import the years separately into their own databases",
+				partitionYear(timestamp), maxPartitions+1, maxPartitions,
+			)
+		}
+		w.needed = append(w.needed, partitionYear(timestamp))
+		return 0, errStoreAgain
+	}
+	id := w.nextID
+	_, err := tx.Exec(insertGameQuery(schema+".games", true), append([]interface{}{id}, values...)...)
+	if err != nil {
+		return 0, err
+	}
+	err = storeMoves(tx, schema+".moves", id, moves)
+	if err != nil {
+		return 0, err
+	}
+	w.nextID++
+	return id, nil
+}
+
+// commit keeps the ids handed out to the file just stored.
+func (w *partitionWriter) commit() {
+	w.fileID = w.nextID
+}
+
+// forget hands out the ids of a file which wasn't stored again.
+func (w *partitionWriter) forget() {
+	w.nextID = w.fileID
+}
+
+// attachNeeded attaches and records the partitions a file rolled back
+// needed.
+func (w *partitionWriter) attachNeeded() error {
+	needed := w.needed
+	w.needed = nil
+	for _, year := range needed {
+		p := partition{name: "y" + year, path: partitionPath(w.dbPath, year)}
+		if w.attached[p.name] {
+			continue
+		}
+		if err := w.attach(p); err != nil {
+			return err
+		}
+		_, err := w.conn.ExecContext(context.Background(),
+			"insert or ignore into partitions (name, path) values (?, ?)",
+			p.name, filepath.Base(p.path),
+		)
+		if err != nil {
+			return fmt.Errorf("problem recording the partition %s: %s", p.path, err)
+		}
+	}
+	return nil
+}
+
+// removeDB deletes the database at dbPath along with any partitions it has.
+func removeDB(dbPath string) error {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	var parts []partition
+	var hasPartitions bool
+	err = db.QueryRow("select count(*) > 0 from sqlite_master where type = 'table' and name = 'partitions'").Scan(&hasPartitions)
+	if err == nil && hasPartitions {
+		parts, err = listPartitions(db, dbPath)
+	}
+	db.Close()
+	if err != nil {
+		return err
+	}
+	for _, p := range parts {
+		err := os.Remove(p.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(dbPath)
+}
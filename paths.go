@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const appName = "sgflib"
+
+// dataDir is where the database lives by default: $XDG_DATA_HOME on Unix,
+// Application Support on macOS and the local AppData folder on Windows.
+func dataDir() string {
+	home, _ := os.UserHomeDir()
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("LocalAppData"); dir != "" {
+			return filepath.Join(dir, appName)
+		}
+		return filepath.Join(home, "AppData", "Local", appName)
+	case "darwin", "ios":
+		return filepath.Join(home, "Library", "Application Support", appName)
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" && filepath.IsAbs(dir) {
+		return filepath.Join(dir, appName)
+	}
+	return filepath.Join(home, ".local", "share", appName)
+}
+
+// queryDir is where the sql command's query templates are kept, next to the
+// default configuration file.
+func queryDir() string {
+	if path := defaultConfigPath(); path != "" {
+		return filepath.Join(filepath.Dir(path), "queries")
+	}
+	return filepath.Join(dataDir(), "queries")
+}
+
+func defaultDBPath() string {
+	if config.DBPath != "" {
+		return config.DBPath
+	}
+	return filepath.Join(dataDir(), "games.db")
+}
+
+// legacyDBPath is where the database was kept before the XDG directories
+// were used.
+func legacyDBPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, "go-games.db")
+}
+
+// sqliteSidecars are the suffixes of the files sqlite keeps next to a
+// database, which hold committed changes of its own until they're written
+// back.
+var sqliteSidecars = []string{"-wal", "-shm", "-journal"}
+
+// migrateLegacyDB moves a database, along with the files sqlite keeps next
+// to it, from the old default location to the new one, when dbPath is the
+// default and nothing is there yet. A database another run holds the lock on
+// is left where it is.
+func migrateLegacyDB(dbPath string) error {
+	if config.DBPath != "" || dbPath != defaultDBPath() {
+		return nil
+	}
+	old := legacyDBPath()
+	if old == "" {
+		return nil
+	}
+	oldExists, err := exists(old)
+	if err != nil || !oldExists {
+		return err
+	}
+	currentExists, err := exists(dbPath)
+	if err != nil || currentExists {
+		return err
+	}
+	unlock, err := acquireLock(old, 0)
+	if err != nil {
+		return fmt.Errorf("%s can't be moved to %s yet: %s", old, dbPath, err)
+	}
+	defer unlock()
+
+	log.Println("Moving the database from", old, "to", dbPath)
+	err = os.MkdirAll(filepath.Dir(dbPath), 0755)
+	if err != nil {
+		return err
+	}
+	// the sidecars go first, so the database is never found without them
+	var moved []string
+	for _, suffix := range append(sqliteSidecars, "") {
+		found, err := exists(old + suffix)
+		if err == nil && found {
+			err = moveFile(old+suffix, dbPath+suffix)
+		}
+		if err != nil {
+			for _, s := range moved {
+				moveFile(dbPath+s, old+s)
+			}
+			return err
+		}
+		if found {
+			moved = append(moved, suffix)
+		}
+	}
+	return nil
+}
+
+// moveFile renames a file, or copies and removes it when the locations are
+// on different devices.
+func moveFile(from, to string) error {
+	if os.Rename(from, to) == nil {
+		return nil
+	}
+	err := copyFile(from, to)
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
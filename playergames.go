@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+type gameOutcome int
+
+const (
+	outcomeUnknown gameOutcome = iota
+	outcomeWin
+	outcomeLoss
+	outcomeJigo
+	outcomeVoid
+)
+
+func (o gameOutcome) String() string {
+	switch o {
+	case outcomeWin:
+		return "win"
+	case outcomeLoss:
+		return "loss"
+	case outcomeJigo:
+		return "jigo"
+	case outcomeVoid:
+		return "void"
+	}
+	return "unknown"
+}
+
+// decided is whether the game had a winner.
+func (o gameOutcome) decided() bool {
+	return o == outcomeWin || o == outcomeLoss
+}
+
+// The values of the games.result column.
+const (
+	resultWin     = "win"
+	resultForfeit = "forfeit"
+	resultJigo    = "jigo"
+	resultVoid    = "void"
+	resultUnknown = "unknown"
+)
+
+// resultType classifies a game's ending for the games.result column from its
+// RE property and the winner read from it by winnerColor.
+func resultType(re, winnerColor string) string {
+	switch resultMethod(re) {
+	case "draw":
+		return resultJigo
+	case "void":
+		return resultVoid
+	case "forfeit":
+		if winnerColor != "" {
+			return resultForfeit
+		}
+	}
+	if winnerColor == "B" || winnerColor == "W" {
+		return resultWin
+	}
+	return resultUnknown
+}
+
+// playerGame is a game seen from one player's side of the board.
+type playerGame struct {
+	id        int64
+	timestamp string
+	color     stone
+	opponent  string
+	// rank and opponentRank are as recorded in the game, if they were
+	rank, opponentRank rankValue
+	// speed is blitz, live, correspondence or empty when unknown
+	speed   string
+	outcome gameOutcome
+	// root is nil when the game was imported without its SGF text
+	root *sgfNode
+}
+
+// playerGames returns the games played by any of the named players, taken as
+// accounts of the same person, which match the filter, oldest first. Players
+// are matched, and opponents named, by the names they go by in name_aliases.
+func playerGames(db *sql.DB, names []string, filter *gameFilter) ([]playerGame, error) {
+	own, err := canonicalNames(db, names)
+	if err != nil {
+		return nil, err
+	}
+	named, nameArgs := playersNamed(names)
+	where, args := filter.where()
+	rows, err := db.Query(`
+		select g.id, coalesce(g.timestamp, ''),
+			coalesce(b.canonical_name, b.name, '(unknown)'), coalesce(w.canonical_name, w.name, '(unknown)'),
+			coalesce(g.black_id, 0), coalesce(g.white_id, 0), g.winner_id, coalesce(g.result, ''), g.sgf,
+			g.black_rank, coalesce(g.black_rank_uncertain, 0), g.white_rank, coalesce(g.white_rank_uncertain, 0),
+			coalesce(g.speed, '')
+		from games g
+		left join players b on b.id = g.black_id
+		left join players w on w.id = g.white_id
+		where (g.black_id in (`+named+`) or g.white_id in (`+named+`)) and `+where+`
+		order by g.timestamp, g.id`,
+		append(append(nameArgs, nameArgs...), args...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var games []playerGame
+	for rows.Next() {
+		var (
+			g                playerGame
+			blackName        string
+			whiteName        string
+			blackID, whiteID int64
+			winnerID         sql.NullInt64
+			result           string
+			source           sql.NullString
+			ranks            [2]sql.NullFloat64
+			uncertain        [2]bool
+		)
+		err := rows.Scan(
+			&g.id, &g.timestamp, &blackName, &whiteName, &blackID, &whiteID, &winnerID, &result, &source,
+			&ranks[0], &uncertain[0], &ranks[1], &uncertain[1], &g.speed,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ownID := blackID
+		g.rank = rankValue{ranks[0].Float64, uncertain[0], ranks[0].Valid}
+		g.opponentRank = rankValue{ranks[1].Float64, uncertain[1], ranks[1].Valid}
+		if own[blackName] {
+			g.color, g.opponent = black, whiteName
+		} else {
+			g.color, g.opponent, ownID = white, blackName, whiteID
+			g.rank, g.opponentRank = g.opponentRank, g.rank
+		}
+		switch {
+		case result == resultJigo:
+			g.outcome = outcomeJigo
+		case result == resultVoid:
+			g.outcome = outcomeVoid
+		case winnerID.Valid && winnerID.Int64 == ownID:
+			g.outcome = outcomeWin
+		case winnerID.Valid:
+			g.outcome = outcomeLoss
+		}
+		if source.Valid {
+			if trees, err := readCollection([]byte(source.String)); err == nil && len(trees) > 0 {
+				g.root = trees[0].root
+			}
+		}
+		games = append(games, g)
+	}
+	return games, rows.Err()
+}
+
+// resultMethod classifies how an RE property says the game ended.
+func resultMethod(re string) string {
+	re = strings.ToUpper(strings.TrimSpace(re))
+	switch {
+	case re == "":
+		return "unknown"
+	case re == "0" || re == "DRAW" || re == "JIGO":
+		return "draw"
+	case re == "VOID":
+		return "void"
+	case re == "?":
+		return "unknown"
+	}
+	i := strings.Index(re, "+")
+	if i < 0 {
+		return "unknown"
+	}
+	switch reason := re[i+1:]; {
+	case reason == "":
+		return "unspecified"
+	case strings.HasPrefix(reason, "R"):
+		return "resignation"
+	case strings.HasPrefix(reason, "T"):
+		return "time"
+	case strings.HasPrefix(reason, "F"):
+		return "forfeit"
+	default:
+		return "points"
+	}
+}
+
+// openingPoint names the first move a player made by its distance from the
+// two nearest edges, such as "4-4" or "3-4".
+func openingPoint(root *sgfNode, color stone) string {
+	size := boardSize(root)
+	id := "B"
+	if color == white {
+		id = "W"
+	}
+	for _, n := range root.mainLine() {
+		vs, ok := n.props[id]
+		if !ok {
+			continue
+		}
+		p, ok := parsePoint(vs[0], size)
+		if !ok {
+			return "pass"
+		}
+		line := func(v int) int {
+			if v < size-1-v {
+				return v + 1
+			}
+			return size - v
+		}
+		a, b := line(p.x), line(p.y)
+		if a > b {
+			a, b = b, a
+		}
+		if size%2 == 1 && p.x == size/2 && p.y == size/2 {
+			return "tengen"
+		}
+		return fmt.Sprintf("%d-%d", a, b)
+	}
+	return "none"
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+)
+
+const playersUsage = `usage:
+  players find [-db-path PATH] [-limit N] NAME
+  players alias [-db-path PATH] ALIAS NAME
+  players unalias [-db-path PATH] ALIAS
+  players aliases [-db-path PATH] [NAME]
+  players dupes [-db-path PATH] [-limit N] [-min-score S] [-list]
+  players unmerge [-db-path PATH] [-network NETWORK] NAME
+
+find lists the players whose names are closest to NAME, allowing for typos
+and differences in spelling between servers. Players are matched under the
+name they were recorded with, the name they go by and its aliases, and
+MATCHED shows the one which matched when it isn't the recorded name.
+
+alias makes players recorded as ALIAS go by NAME in queries and statistics,
+as the romanized and native forms of professionals' names already do.
+Aliases match without regard to case, spaces or punctuation. unalias drops
+one, and aliases lists them, or those of NAME.
+
+dupes looks for players who are likely the same person recorded twice, by
+how alike their names are and whether they share networks, opponents and
+playing days, and asks about each pair in turn: merge one into the other,
+dismiss them as different people, or skip them for now. Merging moves the
+games and profile of one player to the other, removes the merged player and
+records their name on their network as merged, so games imported under it
+later go to the kept player too. It adds no alias, so the kept player's
+other networks aren't affected. Dismissed pairs aren't suggested again. With
+-list the pairs are only listed.
+
+unmerge undoes the merges of NAME, or only its merge on -network: NAME is a
+player again, with the games whose SGF text records them under it, and
+later imports keep them apart. The profile the merge moved stays with the
+kept player until enrich looks it up again.`
+
+func playersCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, playersUsage)
+		os.Exit(2)
+	}
+	// the number of names each subcommand takes, at least and at most
+	arity := map[string][2]int{"find": {1, 1}, "alias": {2, 2}, "unalias": {1, 1}, "aliases": {0, 1}, "dupes": {0, 0}, "unmerge": {1, 1}}
+	want, ok := arity[args[0]]
+	if !ok {
+		fmt.Fprintln(os.Stderr, playersUsage)
+		os.Exit(2)
+	}
+
+	// a pair of duplicates needs more than a near match for a name
+	defaultMinScore := 0.3
+	if args[0] == "dupes" {
+		defaultMinScore = 0.6
+	}
+
+	fs := flag.NewFlagSet("players "+args[0], flag.ExitOnError)
+	var (
+		dbPath   = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to use")
+		limit    = fs.Int("limit", 10, "The most players, or pairs of them, to list")
+		minScore = fs.Float64("min-score", defaultMinScore, "The lowest similarity, from 0 to 1, worth listing")
+		list     = fs.Bool("list", false, "Only list the likely duplicates without asking about them")
+		network  = fs.String("network", "", "The network of the merged name to unmerge (all of them if empty)")
+	)
+	fs.Parse(args[1:])
+
+	if fs.NArg() < want[0] || fs.NArg() > want[1] {
+		fmt.Fprintln(os.Stderr, playersUsage)
+		os.Exit(2)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "find":
+		err = findPlayers(db, fs.Arg(0), *limit, *minScore)
+	case "alias":
+		err = addAlias(db, fs.Arg(0), fs.Arg(1))
+	case "unalias":
+		var found bool
+		found, err = removeAlias(db, fs.Arg(0))
+		if err == nil && !found {
+			log.Printf("%s has no alias\n", fs.Arg(0))
+		}
+	case "aliases":
+		query := "select alias, name, source from name_aliases order by name, alias"
+		var queryArgs []interface{}
+		if fs.NArg() == 1 {
+			var name string
+			name, err = canonicalName(db, fs.Arg(0))
+			if err != nil {
+				break
+			}
+			query = "select alias, name, source from name_aliases where name = ? order by alias"
+			queryArgs = []interface{}{name}
+		}
+		err = printQuery(db, query, queryArgs)
+	case "dupes":
+		var pairs []dupePair
+		pairs, err = findDupes(db, *minScore)
+		if err != nil {
+			break
+		}
+		if len(pairs) > *limit {
+			pairs = pairs[:*limit]
+		}
+		if len(pairs) == 0 {
+			fmt.Println("no likely duplicates")
+		} else if *list {
+			err = printDupes(pairs)
+		} else {
+			err = reviewDupes(db, *dbPath, pairs)
+		}
+	case "unmerge":
+		var moved int
+		moved, err = unmergePlayer(db, fs.Arg(0), *network)
+		if err == nil {
+			fmt.Printf("unmerged %s, moving %d games back\n", fs.Arg(0), moved)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+type playerMatch struct {
+	name, network, rank string
+	games               int
+	score               float64
+	// matched is the name the player scored best under: the recorded one,
+	// the one they go by or another form of that
+	matched string
+}
+
+// findPlayers lists the players closest to query under any of their names,
+// so a search in one script or romanization finds players recorded in
+// another which has an alias.
+func findPlayers(db *sql.DB, query string, limit int, minScore float64) error {
+	rows, err := db.Query(`
+		select p.name, coalesce(p.network, ''), coalesce(pp.rank, ''),
+			(select count(*) from games g where g.black_id = p.id or g.white_id = p.id),
+			` + indexedNames("p") + `
+		from players p
+		left join player_profiles pp on pp.player_id = p.id
+		where p.is_guest = 0`,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var matches []playerMatch
+	for rows.Next() {
+		var (
+			m     playerMatch
+			names string
+		)
+		if err := rows.Scan(&m.name, &m.network, &m.rank, &m.games, &names); err != nil {
+			return err
+		}
+		m.matched = m.name
+		m.score = nameSimilarity(query, m.name)
+		for _, name := range strings.Split(names, "\n") {
+			if score := nameSimilarity(query, name); score > m.score {
+				m.score, m.matched = score, name
+			}
+		}
+		if m.score >= minScore {
+			matches = append(matches, m)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].games > matches[j].games
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tNETWORK\tRANK\tGAMES\tSCORE\tMATCHED")
+	for _, m := range matches {
+		matched := "-"
+		if m.matched != m.name {
+			matched = m.matched
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%.2f\t%s\n", m.name, m.network, m.rank, m.games, m.score, matched)
+	}
+	return tw.Flush()
+}
+
+// normalizeName lower cases a name and drops everything but letters and
+// digits, so "Lee Sedol", "lee_sedol" and "LeeSedol" compare equal.
+func normalizeName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// nameSimilarity scores how alike two names are from 0 to 1, taking the
+// better of their edit distance and their share of trigrams. Edit distance
+// catches typos in short names and trigrams catch reordered or partial ones.
+func nameSimilarity(a, b string) float64 {
+	a, b = normalizeName(a), normalizeName(b)
+	if a == "" || b == "" {
+		return 0
+	}
+	if a == b {
+		return 1
+	}
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	edit := 1 - float64(levenshtein(ra, rb))/float64(longest)
+
+	ta, tb := trigrams(a), trigrams(b)
+	var shared int
+	for t := range ta {
+		if tb[t] {
+			shared++
+		}
+	}
+	tri := float64(shared) / float64(len(ta)+len(tb)-shared)
+
+	score := edit
+	if tri > score {
+		score = tri
+	}
+	// a name found inside the other is a strong hint, as with "hikaru" and
+	// "hikaru1987"
+	if strings.Contains(b, a) || strings.Contains(a, b) {
+		score = (score + 1) / 2
+	}
+	return score
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(first int, rest ...int) int {
+	m := first
+	for _, v := range rest {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// trigrams returns the three letter sequences of a name, padded so that the
+// start and end of the name count too.
+func trigrams(s string) map[string]bool {
+	r := []rune("  " + s + " ")
+	t := make(map[string]bool)
+	for i := 0; i+3 <= len(r); i++ {
+		t[string(r[i:i+3])] = true
+	}
+	return t
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// What an import does with the games a policy matches: rejected games are
+// only logged, while quarantined ones are kept for review.
+const (
+	policyReject     = "reject"
+	policyQuarantine = "quarantine"
+)
+
+// importPolicy is a rule from the policies table of the configuration file
+// which holds games back from an import. It matches a game when every
+// condition it sets holds, and sets at least one.
+type importPolicy struct {
+	name   string
+	action string
+	// shorterThan matches games with fewer main line moves
+	shorterThan int
+	// bot matches games with a computer player
+	bot bool
+	// speed matches games of a gameSpeed
+	speed string
+	// unrated matches games whose name, event or comment mark them as free
+	// or unrated
+	unrated bool
+	// unknownPlayer matches games missing either player's name
+	unknownPlayer bool
+	network       string
+}
+
+// setPolicy reads one setting of a policy from the configuration file.
+func (c *Config) setPolicy(name, key string, v interface{}) error {
+	p := c.Policies[name]
+	if p == nil {
+		p = &importPolicy{name: name}
+		c.Policies[name] = p
+	}
+	var ok bool
+	switch key {
+	case "action":
+		p.action, ok = v.(string)
+		ok = ok && (p.action == policyReject || p.action == policyQuarantine)
+	case "shorter_than":
+		var n int64
+		n, ok = v.(int64)
+		p.shorterThan = int(n)
+		ok = ok && n > 0
+	case "bot":
+		p.bot, ok = v.(bool)
+	case "speed":
+		p.speed, ok = v.(string)
+		ok = ok && (p.speed == speedBlitz || p.speed == speedLive || p.speed == speedCorrespondence)
+	case "unrated":
+		p.unrated, ok = v.(bool)
+	case "unknown_player":
+		p.unknownPlayer, ok = v.(bool)
+	case "network":
+		p.network, ok = v.(string)
+	default:
+		return fmt.Errorf("unknown setting policies.%s.%s", name, key)
+	}
+	if !ok {
+		return fmt.Errorf("policies.%s.%s has the wrong type or value", name, key)
+	}
+	return nil
+}
+
+// checkPolicies makes sure every policy has an action and a condition.
+func (c *Config) checkPolicies() error {
+	for _, p := range c.Policies {
+		if p.action == "" {
+			return fmt.Errorf("policy %s needs an action, %q or %q", p.name, policyReject, policyQuarantine)
+		}
+		if p.shorterThan == 0 && !p.bot && p.speed == "" && !p.unrated && !p.unknownPlayer && p.network == "" {
+			return fmt.Errorf("policy %s has no conditions, so it would hold back every game", p.name)
+		}
+	}
+	return nil
+}
+
+// heldBack returns the first policy, by name, matching a game read from a
+// file, along with why it matched.
+func (c *Config) heldBack(r result) (*importPolicy, string, bool) {
+	names := make([]string, 0, len(c.Policies))
+	for name := range c.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if reason, ok := c.Policies[name].match(r); ok {
+			return c.Policies[name], reason, true
+		}
+	}
+	return nil, "", false
+}
+
+func (p *importPolicy) match(r result) (string, bool) {
+	var reasons []string
+	if p.network != "" {
+		if !strings.EqualFold(r.network, p.network) {
+			return "", false
+		}
+		reasons = append(reasons, "played on "+r.network)
+	}
+	if p.unknownPlayer {
+		if r.black != "" && r.white != "" {
+			return "", false
+		}
+		reasons = append(reasons, "a player is unknown")
+	}
+	if p.bot {
+		if !config.isBot(r.black) && !config.isBot(r.white) {
+			return "", false
+		}
+		reasons = append(reasons, "against a bot")
+	}
+	if p.shorterThan > 0 {
+		var moves int
+		if r.root != nil {
+			for _, n := range r.root.mainLine() {
+				if n.get("B") != "" || n.get("W") != "" {
+					moves++
+				}
+			}
+		}
+		if moves >= p.shorterThan {
+			return "", false
+		}
+		reasons = append(reasons, fmt.Sprintf("%d moves", moves))
+	}
+	if p.speed != "" {
+		if gameSpeed(r.root) != p.speed {
+			return "", false
+		}
+		reasons = append(reasons, p.speed)
+	}
+	if p.unrated {
+		if r.root == nil {
+			return "", false
+		}
+		text := strings.ToLower(strings.Join([]string{r.root.get("GN"), r.root.get("EV"), r.root.get("GC")}, " "))
+		if !containsAny(text, unratedWords) {
+			return "", false
+		}
+		reasons = append(reasons, "unrated")
+	}
+	return strings.Join(reasons, ", "), true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+func hashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFile hashes a file without reading it into memory, matching hashData.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// knownFiles returns the hashes of every file imported so far, by path.
+func knownFiles(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query("select path, hash from files")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	known := make(map[string]string)
+	for rows.Next() {
+		var path, hash string
+		if err := rows.Scan(&path, &hash); err != nil {
+			return nil, err
+		}
+		known[path] = hash
+	}
+	return known, rows.Err()
+}
+
+// checkpoints returns the last file completed in each directory by an
+// interrupted import.
+func checkpoints(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query("select dir, path from import_checkpoints")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	last := make(map[string]string)
+	for rows.Next() {
+		var dir, path string
+		if err := rows.Scan(&dir, &path); err != nil {
+			return nil, err
+		}
+		last[dir] = path
+	}
+	return last, rows.Err()
+}
+
+// walkProgress tracks which walked files have been completed. Files finish
+// out of order since several are processed at once, so a directory's
+// checkpoint only advances past files once every earlier file in it is done.
+type walkProgress struct {
+	mu   sync.Mutex
+	dirs map[string]*dirProgress
+}
+
+type dirProgress struct {
+	pending []string
+	done    map[string]bool
+}
+
+func newWalkProgress() *walkProgress {
+	return &walkProgress{dirs: make(map[string]*dirProgress)}
+}
+
+// started records that a file has been handed out for processing. Files must
+// be started in walk order.
+func (w *walkProgress) started(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dir := filepath.Dir(path)
+	d := w.dirs[dir]
+	if d == nil {
+		d = &dirProgress{done: make(map[string]bool)}
+		w.dirs[dir] = d
+	}
+	d.pending = append(d.pending, path)
+}
+
+// finished records that a file is done and returns the new checkpoint for
+// its directory, if it moved.
+func (w *walkProgress) finished(path string) (string, string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dir := filepath.Dir(path)
+	d := w.dirs[dir]
+	if d == nil {
+		return "", "", false
+	}
+	d.done[path] = true
+	var last string
+	for len(d.pending) > 0 && d.done[d.pending[0]] {
+		last = d.pending[0]
+		delete(d.done, last)
+		d.pending = d.pending[1:]
+	}
+	if last == "" {
+		return "", "", false
+	}
+	if len(d.pending) == 0 {
+		delete(w.dirs, dir)
+	}
+	return dir, last, true
+}
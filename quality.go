@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The phases of a game the quality of its moves is summed over.
+const (
+	phaseOpening = "opening"
+	phaseMiddle  = "middle"
+	phaseEndgame = "endgame"
+)
+
+var gamePhases = []string{phaseOpening, phaseMiddle, phaseEndgame}
+
+// gamePhase places a move in a phase of the game. On 19x19 the first 50
+// moves are the opening and those after the 150th the endgame, and the
+// limits shrink with the area of smaller boards.
+func gamePhase(move, size int) string {
+	area := float64(size*size) / 361
+	switch {
+	case float64(move) <= 50*area:
+		return phaseOpening
+	case float64(move) <= 150*area:
+		return phaseMiddle
+	}
+	return phaseEndgame
+}
+
+// moveQuality is the points one side of a game lost in a phase of it.
+type moveQuality struct {
+	color, phase string
+	moves        int
+	pointsLost   float64
+}
+
+// moveLoss is the points a move of the main line lost.
+type moveLoss struct {
+	move   int
+	color  string
+	points float64
+}
+
+// moveLosses returns the points each move with evaluations of the positions
+// before and after it lost, which is the drop in its player's score lead.
+// Moves which seem to gain points lose none, as the gain is the engine
+// misjudging the position before.
+func moveLosses(root *sgfNode, evaluations []evaluation) []moveLoss {
+	leads := make(map[int]float64)
+	for _, ev := range evaluations {
+		leads[ev.moveNumber] = ev.scoreLead
+	}
+	var losses []moveLoss
+	var n int
+	// the moves are counted as analyze counts them
+	for _, node := range root.mainLine() {
+		for _, color := range []string{"B", "W"} {
+			if _, ok := node.props[color]; !ok {
+				continue
+			}
+			n++
+			before, ok := leads[n-1]
+			after, ok2 := leads[n]
+			if !ok || !ok2 {
+				continue
+			}
+			lost := before - after
+			if color == "W" {
+				lost = -lost
+			}
+			if lost < 0 {
+				lost = 0
+			}
+			losses = append(losses, moveLoss{n, color, lost})
+		}
+	}
+	return losses
+}
+
+// gameMoveQuality sums the points each side lost with their moves in each
+// phase.
+func gameMoveQuality(root *sgfNode, evaluations []evaluation) []moveQuality {
+	size := boardSize(root)
+	byKey := make(map[[2]string]int)
+	var qualities []moveQuality
+	for _, l := range moveLosses(root, evaluations) {
+		key := [2]string{l.color, gamePhase(l.move, size)}
+		i, ok := byKey[key]
+		if !ok {
+			i = len(qualities)
+			byKey[key] = i
+			qualities = append(qualities, moveQuality{color: l.color, phase: key[1]})
+		}
+		qualities[i].moves++
+		qualities[i].pointsLost += l.points
+	}
+	return qualities
+}
+
+// storeMoveQuality replaces the move quality stored for a game.
+func storeMoveQuality(db queryer, id int64, qualities []moveQuality) error {
+	_, err := db.Exec("delete from move_quality where game_id = ?", id)
+	if err != nil {
+		return err
+	}
+	for _, q := range qualities {
+		_, err = db.Exec(
+			"insert into move_quality (game_id, color, phase, moves, points_lost) values (?, ?, ?, ?, ?)",
+			id, q.color, q.phase, q.moves, q.pointsLost,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summarizeAnalyzed stores the move quality of the games analyzed before it
+// was kept, returning how many games it summarized.
+func summarizeAnalyzed(db *sql.DB) (int, error) {
+	rows, err := db.Query(`
+		select id, sgf from games
+		where sgf is not null
+			and id in (select game_id from evaluations)
+			and id not in (select game_id from move_quality)`,
+	)
+	if err != nil {
+		return 0, err
+	}
+	sources := make(map[int64]string)
+	for rows.Next() {
+		var (
+			id     int64
+			source string
+		)
+		if err := rows.Scan(&id, &source); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sources[id] = source
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var summarized int
+	for id, source := range sources {
+		games, err := readCollection([]byte(source))
+		if err != nil || len(games) == 0 {
+			continue
+		}
+		evaluations, err := storedEvaluations(db, id)
+		if err != nil {
+			return summarized, err
+		}
+		qualities := gameMoveQuality(games[0].root, evaluations)
+		err = retryBusy(func() error {
+			tx, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			if err := storeMoveQuality(tx, id, qualities); err != nil {
+				return err
+			}
+			return tx.Commit()
+		})
+		if err != nil {
+			return summarized, err
+		}
+		summarized++
+	}
+	return summarized, nil
+}
+
+// storedEvaluations returns the evaluations of a game with a score lead.
+func storedEvaluations(db queryer, id int64) ([]evaluation, error) {
+	rows, err := db.Query(`
+		select move_number, winrate, score_lead, coalesce(visits, 0), coalesce(best_move, '')
+		from evaluations
+		where game_id = ? and score_lead is not null
+		order by move_number`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var evaluations []evaluation
+	for rows.Next() {
+		var ev evaluation
+		if err := rows.Scan(&ev.moveNumber, &ev.winrate, &ev.scoreLead, &ev.visits, &ev.bestMove); err != nil {
+			return nil, err
+		}
+		evaluations = append(evaluations, ev)
+	}
+	return evaluations, rows.Err()
+}
+
+// qualityTally adds up the points lost over a number of moves.
+type qualityTally struct {
+	moves int
+	lost  float64
+}
+
+func (t *qualityTally) add(moves int, lost float64) {
+	t.moves += moves
+	t.lost += lost
+}
+
+// average is the points lost per move.
+func (t qualityTally) average() float64 {
+	return t.lost / float64(t.moves)
+}
+
+func (t qualityTally) String() string {
+	if t.moves == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", t.average())
+}
+
+// qualityMonth is the quality of a player's moves over the games of a month.
+type qualityMonth struct {
+	month  string
+	games  int
+	all    qualityTally
+	phases map[string]*qualityTally
+}
+
+// monthlyQuality sums the quality of the moves of the player the games are
+// seen from by month, oldest first. Games without a date or without the
+// engine's analysis are left out, and the number of them is returned.
+func monthlyQuality(db *sql.DB, games []playerGame) ([]*qualityMonth, int, error) {
+	var (
+		months  []*qualityMonth
+		skipped int
+	)
+	for _, g := range games {
+		month := dateOf(g.timestamp)
+		if len(month) < 7 {
+			skipped++
+			continue
+		}
+		month = month[:7]
+		color := "B"
+		if g.color == white {
+			color = "W"
+		}
+		rows, err := db.Query("select phase, moves, points_lost from move_quality where game_id = ? and color = ?", g.id, color)
+		if err != nil {
+			return nil, 0, err
+		}
+		var m *qualityMonth
+		for rows.Next() {
+			var (
+				phase string
+				moves int
+				lost  float64
+			)
+			if err := rows.Scan(&phase, &moves, &lost); err != nil {
+				rows.Close()
+				return nil, 0, err
+			}
+			if m == nil {
+				// games are oldest first, so a new month goes at the end
+				if len(months) == 0 || months[len(months)-1].month != month {
+					months = append(months, &qualityMonth{month: month, phases: make(map[string]*qualityTally)})
+				}
+				m = months[len(months)-1]
+				m.games++
+			}
+			if m.phases[phase] == nil {
+				m.phases[phase] = &qualityTally{}
+			}
+			m.phases[phase].add(moves, lost)
+			m.all.add(moves, lost)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, 0, err
+		}
+		if m == nil {
+			skipped++
+		}
+	}
+	return months, skipped, nil
+}
+
+// qualityChart plots the points lost per move by month, over all moves or
+// those of one phase.
+func qualityChart(player string, months []*qualityMonth, phase string) lineChart {
+	title := fmt.Sprintf("%s: points lost per move by month", player)
+	if phase != "" {
+		title = fmt.Sprintf("%s: points lost per move by month (%s)", player, phase)
+	}
+	c := lineChart{
+		title:   title,
+		formatY: func(v float64) string { return fmt.Sprintf("%.1f", v) },
+	}
+	for _, m := range months {
+		t, err := time.Parse("2006-01", m.month)
+		if err != nil {
+			continue
+		}
+		tally := &m.all
+		if phase != "" {
+			tally = m.phases[phase]
+		}
+		if tally == nil || tally.moves == 0 {
+			continue
+		}
+		c.points = append(c.points, chartPoint{t, tally.average()})
+	}
+	return c
+}
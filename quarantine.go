@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apiarian/sgf-library-to-sqlite/extract"
+)
+
+const quarantineUsage = `usage:
+  quarantine list [-db-path PATH] [-policy NAME] [-action reject|quarantine]
+  quarantine show [-db-path PATH] ENTRY_ID
+  quarantine accept [-db-path PATH] ENTRY_ID...
+  quarantine reject [-db-path PATH] ENTRY_ID...
+
+The quarantine holds the games imports kept out of the library: those
+matching the policies in the config file, and with -quarantine-incomplete
+those with fields which couldn't be read. show prints an entry's SGF text.
+accept imports entries as games, whatever the policies say, and reject
+deletes them for good.`
+
+func quarantineCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, quarantineUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "list", "show", "accept", "reject":
+	default:
+		fmt.Fprintln(os.Stderr, quarantineUsage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("quarantine "+args[0], flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to use")
+		policy = fs.String("policy", "", "Only list the entries held back by this policy")
+		action = fs.String("action", "", "Only list the entries with this action, reject or quarantine")
+	)
+	fs.Parse(args[1:])
+
+	var ids []int64
+	for _, a := range fs.Args() {
+		id, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			log.Fatalf("%q is not an entry id\n", a)
+		}
+		ids = append(ids, id)
+	}
+	if (args[0] == "list") != (len(ids) == 0) || (args[0] == "show" && len(ids) != 1) {
+		fmt.Fprintln(os.Stderr, quarantineUsage)
+		os.Exit(2)
+	}
+
+	// accepting imports, which needs the store rather than the query view
+	if args[0] == "accept" {
+		err := acceptQuarantined(*dbPath, ids)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "list":
+		err = listQuarantine(db, *policy, *action)
+	case "show":
+		var source sql.NullString
+		err = db.QueryRow("select sgf from quarantine where id = ?", ids[0]).Scan(&source)
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("there is no quarantine entry with id %d", ids[0])
+		}
+		if err == nil {
+			fmt.Println(source.String)
+		}
+	case "reject":
+		for _, id := range ids {
+			var res sql.Result
+			res, err = db.Exec("delete from quarantine where id = ?", id)
+			if err != nil {
+				break
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				log.Printf("there is no quarantine entry with id %d\n", id)
+			}
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func listQuarantine(db *sql.DB, policy, action string) error {
+	rows, err := db.Query(`
+		select id, held, policy, action, path, game_index, coalesce(reason, '')
+		from quarantine
+		where (? = '' or policy = ?) and (? = '' or action = ?)
+		order by id`,
+		policy, policy, action, action,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tHELD\tPOLICY\tACTION\tFILE\tREASON")
+	for rows.Next() {
+		var (
+			id, index                          int64
+			held, policy, action, path, reason string
+		)
+		if err := rows.Scan(&id, &held, &policy, &action, &path, &index, &reason); err != nil {
+			return err
+		}
+		if index > 0 {
+			path = fmt.Sprintf("%s (game %d)", path, index+1)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", id, dateOf(held), policy, action, path, reason)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// acceptQuarantined imports the entries as games, skipping the policies, and
+// takes them out of the quarantine. Entries whose SGF text no longer parses
+// are left where they are.
+func acceptQuarantined(dbPath string, ids []int64) error {
+	unlock, err := acquireLock(dbPath, 0)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	db, err := sql.Open("sqlite3", sqliteDSN(dbPath))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = migrate(db)
+	if err != nil {
+		return err
+	}
+	err = extract.Prepare(db)
+	if err != nil {
+		return err
+	}
+	st, err := newSQLiteStore(db, dbPath, false)
+	if err != nil {
+		return err
+	}
+	defer st.close()
+
+	im := &importer{
+		store:        st,
+		extractDB:    st,
+		refresh:      true,
+		summary:      newImportSummary(),
+		networkZones: make(map[string]*time.Location),
+		now:          func() string { return time.Now().Format(time.RFC3339) },
+		skipPolicies: true,
+	}
+	for _, id := range ids {
+		var (
+			path   string
+			index  int
+			source sql.NullString
+		)
+		err := db.QueryRow("select path, game_index, sgf from quarantine where id = ?", id).Scan(&path, &index, &source)
+		if err == sql.ErrNoRows {
+			log.Printf("there is no quarantine entry with id %d\n", id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		games := process(path, []byte(source.String))
+		if !source.Valid || games[0].err != nil {
+			log.Printf("entry %d has no SGF text which can be imported, leaving it in quarantine\n", id)
+			continue
+		}
+		for i := range games {
+			games[i].index = index + i
+		}
+		im.importFile(fileResult{path: path, games: games, partial: true})
+		_, err = db.Exec("delete from quarantine where id = ?", id)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("accepted %d games\n", im.summary.GamesInserted+im.summary.GamesUpdated)
+	return nil
+}
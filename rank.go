@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// parseRank converts rank strings like "5k", "2d" or "9p" to a number on a
+// single scale where 1k is 0, 1d is 1 and each stone of strength is 1.
+// Professional ranks are closer together than amateur ones, so 1p is placed
+// at 7d and 9p a little under 10d. See normalizeRank for the forms read.
+func parseRank(s string) (float64, bool) {
+	r := normalizeRank(s)
+	return r.value, r.known
+}
+
+// rankValue is a rank on parseRank's scale.
+type rankValue struct {
+	value float64
+	// uncertain ranks were marked with a ?, as KGS does for ranks it hasn't
+	// settled yet
+	uncertain bool
+	known     bool
+}
+
+// number is the value of a rank's numeric column.
+func (r rankValue) number() interface{} {
+	if !r.known {
+		return nil
+	}
+	return r.value
+}
+
+// args are the values of a rank's number and uncertainty columns.
+func (r rankValue) args() []interface{} {
+	if !r.known {
+		return []interface{}{nil, nil}
+	}
+	return []interface{}{r.value, r.uncertain}
+}
+
+// rankUnits are the words and letters servers use for kyu, dan and
+// professional ranks.
+var rankUnits = map[string]byte{
+	"k": 'k', "kyu": 'k', "級": 'k', "급": 'k',
+	"d": 'd', "dan": 'd', "段": 'd', "단": 'd',
+	"p": 'p', "pro": 'p', "プロ": 'p', "프로": 'p',
+}
+
+// normalizeRank reads the ranks written in BR and WR by the various servers
+// and programs: "5k", "18k?", "2d", "6 dan", "5級", "初段", "P9" and so on.
+func normalizeRank(s string) rankValue {
+	var r rankValue
+	s = strings.ToLower(strings.TrimSpace(s))
+	r.uncertain = strings.Contains(s, "?")
+	s = strings.Map(func(c rune) rune {
+		switch {
+		case c == '?' || c == '*' || unicode.IsSpace(c):
+			return -1
+		case c >= '０' && c <= '９':
+			return '0' + c - '０'
+		}
+		return c
+	}, s)
+	// 初段 is first dan
+	if strings.HasPrefix(s, "初") {
+		s = "1" + strings.TrimPrefix(s, "初")
+	}
+
+	// the unit may come before the number, as in P9
+	digits := strings.IndexFunc(s, unicode.IsDigit)
+	if digits < 0 {
+		return rankValue{}
+	}
+	prefix, rest := s[:digits], s[digits:]
+	end := strings.IndexFunc(rest, func(c rune) bool { return !unicode.IsDigit(c) })
+	if end < 0 {
+		end = len(rest)
+	}
+	n, err := strconv.Atoi(rest[:end])
+	if err != nil || n < 1 || (prefix != "" && end < len(rest)) {
+		return rankValue{}
+	}
+	unit, ok := rankUnits[prefix+rest[end:]]
+	if !ok {
+		return rankValue{}
+	}
+	switch unit {
+	case 'k':
+		r.value = float64(1 - n)
+	case 'd':
+		r.value = float64(n)
+	case 'p':
+		r.value = 7 + float64(n-1)/3
+	}
+	r.known = true
+	return r
+}
+
+// formatRank is the inverse of parseRank, rounding to the nearest amateur
+// rank.
+func formatRank(v float64) string {
+	r := int(math.Floor(v + 0.5))
+	if r <= 0 {
+		return fmt.Sprintf("%dk", 1-r)
+	}
+	return fmt.Sprintf("%dd", r)
+}
+
+// maxStrengthBucket is the rank difference, in stones, beyond which
+// opponents are grouped together.
+const maxStrengthBucket = 3
+
+// strengthBucket rounds the difference between an opponent's rank and a
+// player's to whole stones, capped at maxStrengthBucket either way, so
+// positive buckets are stronger opponents.
+func strengthBucket(diff float64) int {
+	b := int(math.Floor(diff + 0.5))
+	if b > maxStrengthBucket {
+		return maxStrengthBucket
+	}
+	if b < -maxStrengthBucket {
+		return -maxStrengthBucket
+	}
+	return b
+}
+
+// strengthLabel describes a strength bucket, like "2 stones stronger".
+func strengthLabel(b int) string {
+	n := b
+	if n < 0 {
+		n = -n
+	}
+	amount := fmt.Sprintf("%d stones", n)
+	switch {
+	case n == 0:
+		return "even"
+	case n == maxStrengthBucket:
+		amount = fmt.Sprintf("%d+ stones", n)
+	case n == 1:
+		amount = "1 stone"
+	}
+	if b > 0 {
+		return amount + " stronger"
+	}
+	return amount + " weaker"
+}
+
+// rankRange is a flag.Value holding a range of ranks like "5k-1d", in either
+// order, or a single rank, with its bounds on parseRank's scale.
+type rankRange struct {
+	text      string
+	low, high float64
+}
+
+func (r *rankRange) String() string {
+	return r.text
+}
+
+func (r *rankRange) Set(s string) error {
+	parts := strings.SplitN(s, "-", 2)
+	low, ok := parseRank(parts[0])
+	high := low
+	if ok && len(parts) == 2 {
+		high, ok = parseRank(parts[1])
+	}
+	if !ok {
+		return fmt.Errorf("%q is not a rank or range of ranks", s)
+	}
+	if high < low {
+		low, high = high, low
+	}
+	*r = rankRange{text: s, low: low, high: high}
+	return nil
+}
+
+// backfillRanks fills in the rank columns of games stored before they were
+// added, reading BR and WR from the stored SGF text as the import does for
+// the game's network, and of the profiles.
+func backfillRanks(tx *sql.Tx) error {
+	networks, err := storedNetworks(tx)
+	if err != nil {
+		return err
+	}
+	ranks := make(map[int64][2]rankValue)
+	err = visitStoredGames(tx, func(id int64, root *sgfNode) {
+		network := networks[id]
+		ranks[id] = [2]rankValue{networkRank(network, root.get("BR")), networkRank(network, root.get("WR"))}
+	})
+	if err != nil {
+		return err
+	}
+	for id, r := range ranks {
+		if !r[0].known && !r[1].known {
+			continue
+		}
+		args := append(append(r[0].args(), r[1].args()...), id)
+		_, err := tx.Exec(`
+			update games set black_rank = ?, black_rank_uncertain = ?, white_rank = ?, white_rank_uncertain = ?
+			where id = ?`,
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("select player_id, rank from player_profiles where rank is not null")
+	if err != nil {
+		return err
+	}
+	profiles := make(map[int64]rankValue)
+	for rows.Next() {
+		var (
+			id   int64
+			rank string
+		)
+		if err := rows.Scan(&id, &rank); err != nil {
+			rows.Close()
+			return err
+		}
+		profiles[id] = normalizeRank(rank)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, r := range profiles {
+		_, err := tx.Exec("update player_profiles set rank_value = ? where player_id = ?", r.number(), id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestNormalizeRank(t *testing.T) {
+	for _, c := range []struct {
+		s         string
+		value     float64
+		uncertain bool
+	}{
+		{"5k", -4, false},
+		{"1k", 0, false},
+		{"18k?", -17, true},
+		{"2d", 2, false},
+		{"6 dan", 6, false},
+		{"3 Kyu", -2, false},
+		{"5級", -4, false},
+		{"初段", 1, false},
+		{"２段", 2, false},
+		{"4단", 4, false},
+		{"P9", 7 + 8.0/3, false},
+		{"1p", 7, false},
+		{"9プロ", 7 + 8.0/3, false},
+		{"3d*", 3, false},
+	} {
+		r := normalizeRank(c.s)
+		if !r.known || r.value != c.value || r.uncertain != c.uncertain {
+			t.Errorf("normalizeRank(%q) = %+v, want %v (uncertain %v)", c.s, r, c.value, c.uncertain)
+		}
+	}
+	for _, s := range []string{"", "-", "?", "0k", "5x", "p9d", "abc"} {
+		if r := normalizeRank(s); r.known {
+			t.Errorf("normalizeRank(%q) = %+v, want an unknown rank", s, r)
+		}
+	}
+}
+
+func TestNetworkRank(t *testing.T) {
+	for _, c := range []struct {
+		network, s string
+		value      float64
+	}{
+		// Fox writes its professionals as P9段
+		{"Fox", "P9段", 7 + 8.0/3},
+		{"fox", "p1段", 7},
+		{"Fox", "5段", 5},
+		{"KGS", "3k?", -2},
+		{"somewhere", "2d", 2},
+	} {
+		r := networkRank(c.network, c.s)
+		if !r.known || r.value != c.value {
+			t.Errorf("networkRank(%q, %q) = %+v, want %v", c.network, c.s, r, c.value)
+		}
+	}
+	// other networks don't read P9段 as a professional rank
+	if r := networkRank("OGS", "P9段"); r.known {
+		t.Errorf(`networkRank("OGS", "P9段") = %+v, want an unknown rank`, r)
+	}
+}
+
+func TestFormatRank(t *testing.T) {
+	for v, want := range map[float64]string{-4: "5k", 0: "1k", 0.4: "1k", 0.6: "1d", 3: "3d"} {
+		if got := formatRank(v); got != want {
+			t.Errorf("formatRank(%v) = %q, want %q", v, got, want)
+		}
+	}
+}
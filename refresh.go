@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+)
+
+// contentKey identifies a game by its players, date and main line, which
+// stay the same when a file is edited to fix a comment or a result, or when
+// games are added to it or taken out of it ahead of this one.
+func contentKey(root *sgfNode) string {
+	if root == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, p := range []string{"PB", "PW", "DT"} {
+		b.WriteString(root.get(p))
+		b.WriteByte(0)
+	}
+	for _, node := range root.mainLine() {
+		for _, color := range []string{"B", "W"} {
+			if _, ok := node.props[color]; ok {
+				b.WriteString(color + node.get(color) + ";")
+			}
+		}
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// backfillContentKeys records the content keys of the games stored before
+// they were.
+func backfillContentKeys(tx *sql.Tx) error {
+	keys := make(map[int64]string)
+	err := visitStoredGames(tx, func(id int64, root *sgfNode) {
+		keys[id] = contentKey(root)
+	})
+	if err != nil {
+		return err
+	}
+	for id, key := range keys {
+		if _, err := tx.Exec("update games set content_key = ? where id = ?", key, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileGame is a game stored from a file.
+type fileGame struct {
+	id int64
+	// index is -1 for games imported before their index was recorded
+	index int
+	key   string
+}
+
+// matchStored pairs the games read from a changed file with the games stored
+// from it before, returning the ids of the stored games by their position in
+// fr.games. A game is matched by its content key first, wherever it was in
+// the file, and otherwise by its place in the file, as long as the game
+// stored there isn't still in the file somewhere else; a game whose moves
+// were edited is still updated that way. Unless fr holds only some of the
+// file's games, the stored games left unmatched are reported as gone from
+// the file.
+func (im *importer) matchStored(fr fileResult, f *fileImport) (map[int]int64, error) {
+	stored, err := im.store.fileGames(fr.path)
+	if err != nil || len(stored) == 0 {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for _, r := range fr.games {
+		if r.err == nil {
+			keys[contentKey(r.root)] = true
+		}
+	}
+	taken := make(map[int64]bool)
+	matches := make(map[int]int64)
+	match := func(i int, ok func(g fileGame) bool) {
+		for _, g := range stored {
+			if !taken[g.id] && ok(g) {
+				taken[g.id] = true
+				matches[i] = g.id
+				return
+			}
+		}
+	}
+	for i, r := range fr.games {
+		if r.err != nil {
+			continue
+		}
+		key := contentKey(r.root)
+		match(i, func(g fileGame) bool { return g.key == key })
+	}
+	for i, r := range fr.games {
+		if _, ok := matches[i]; ok || r.err != nil {
+			continue
+		}
+		match(i, func(g fileGame) bool { return g.index == r.index && !keys[g.key] })
+	}
+	if fr.partial {
+		return matches, nil
+	}
+	for _, g := range stored {
+		if taken[g.id] {
+			continue
+		}
+		f.logf("%s: game %d is no longer in the file; delete it if it's gone\n", fr.path, g.id)
+		f.summary.GamesMissing++
+	}
+	return matches, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tally counts the outcomes of a set of games.
+type tally struct {
+	games, wins, losses, jigo, void int
+}
+
+func (t *tally) add(g playerGame) {
+	t.games++
+	switch g.outcome {
+	case outcomeWin:
+		t.wins++
+	case outcomeLoss:
+		t.losses++
+	case outcomeJigo:
+		t.jigo++
+	case outcomeVoid:
+		t.void++
+	}
+}
+
+// winRate is the share of decided games which were won.
+func (t tally) winRate() string {
+	if t.wins+t.losses == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", 100*float64(t.wins)/float64(t.wins+t.losses))
+}
+
+func (t tally) row(label string) []string {
+	return []string{label, fmt.Sprint(t.games), fmt.Sprint(t.wins), fmt.Sprint(t.losses), fmt.Sprint(t.jigo), fmt.Sprint(t.void), t.winRate()}
+}
+
+// tallyBy groups games by a key, returning the keys in order of decreasing
+// game count.
+func tallyBy(games []playerGame, key func(playerGame) string) ([]string, map[string]*tally) {
+	tallies := make(map[string]*tally)
+	var keys []string
+	for _, g := range games {
+		k := key(g)
+		if tallies[k] == nil {
+			tallies[k] = &tally{}
+			keys = append(keys, k)
+		}
+		tallies[k].add(g)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return tallies[keys[i]].games > tallies[keys[j]].games
+	})
+	return keys, tallies
+}
+
+// tallyByStrength groups games by the strengthBucket of the opponent,
+// returning the number of games left out for lacking either rank.
+func tallyByStrength(games []playerGame) (map[int]*tally, int) {
+	tallies := make(map[int]*tally)
+	var unranked int
+	for _, g := range games {
+		if !g.rank.known || !g.opponentRank.known {
+			unranked++
+			continue
+		}
+		b := strengthBucket(g.opponentRank.value - g.rank.value)
+		if tallies[b] == nil {
+			tallies[b] = &tally{}
+		}
+		tallies[b].add(g)
+	}
+	return tallies, unranked
+}
+
+func writeMarkdownTable(w io.Writer, header []string, rows [][]string) {
+	fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+	fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(header)))
+	for _, r := range rows {
+		for i := range r {
+			r[i] = strings.Replace(r[i], "|", `\|`, -1)
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(r, " | "))
+	}
+	fmt.Fprintln(w)
+}
+
+func reportCommand(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	var (
+		dbPath  = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		outPath = fs.String("o", "", "The file to write the report to (defaults to standard output)")
+		filter  gameFilter
+	)
+	filter.register(fs)
+	fs.Parse(args)
+
+	names, err := filter.perspective()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	games, err := playerGames(db, names, &filter)
+	if err != nil {
+		log.Fatalf("error reading games: %s\n", err)
+	}
+
+	out := os.Stdout
+	if *outPath != "" {
+		out, err = os.Create(*outPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+	err = writeReport(out, db, &filter, games)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func writeReport(w io.Writer, db *sql.DB, filter *gameFilter, games []playerGame) error {
+	fmt.Fprintf(w, "# Go report for %s\n\n", strings.Join(filter.names(), ", "))
+	period := "all games"
+	switch {
+	case filter.since != "" && filter.until != "":
+		period = fmt.Sprintf("games from %s to %s", filter.since, filter.until)
+	case filter.since != "":
+		period = "games since " + filter.since
+	case filter.until != "":
+		period = "games until " + filter.until
+	}
+	fmt.Fprintf(w, "Covering %s, generated %s.\n\n", period, time.Now().Format("2006-01-02"))
+
+	if len(games) == 0 {
+		fmt.Fprintln(w, "No games found.")
+		return nil
+	}
+
+	var all, asBlack, asWhite tally
+	for _, g := range games {
+		all.add(g)
+		if g.color == black {
+			asBlack.add(g)
+		} else {
+			asWhite.add(g)
+		}
+	}
+	header := []string{"", "Games", "Wins", "Losses", "Jigo", "Void", "Win rate"}
+	fmt.Fprint(w, "## Summary\n\n")
+	writeMarkdownTable(w, header, [][]string{
+		all.row("All games"),
+		asBlack.row("As Black"),
+		asWhite.row("As White"),
+	})
+
+	fmt.Fprint(w, "## By month\n\n")
+	months, byMonth := tallyBy(games, func(g playerGame) string {
+		if len(g.timestamp) < 7 {
+			return "undated"
+		}
+		return g.timestamp[:7]
+	})
+	sort.Strings(months)
+	var rows [][]string
+	for _, m := range months {
+		rows = append(rows, byMonth[m].row(m))
+	}
+	header[0] = "Month"
+	writeMarkdownTable(w, header, rows)
+
+	fmt.Fprint(w, "## By speed\n\n")
+	rows = nil
+	speeds, bySpeed := tallyBy(games, func(g playerGame) string {
+		if g.speed == "" {
+			return "unknown"
+		}
+		return g.speed
+	})
+	for _, s := range speeds {
+		rows = append(rows, bySpeed[s].row(s))
+	}
+	header[0] = "Speed"
+	writeMarkdownTable(w, header, rows)
+
+	fmt.Fprint(w, "## Most frequent opponents\n\n")
+	opponents, byOpponent := tallyBy(games, func(g playerGame) string { return g.opponent })
+	rows = nil
+	for i, o := range opponents {
+		if i == 10 {
+			break
+		}
+		rows = append(rows, byOpponent[o].row(o))
+	}
+	header[0] = "Opponent"
+	writeMarkdownTable(w, header, rows)
+
+	fmt.Fprint(w, "## By opponent rank\n\n")
+	ranks, byRank := tallyBy(games, func(g playerGame) string {
+		if !g.opponentRank.known {
+			return "unknown"
+		}
+		return formatRank(g.opponentRank.value)
+	})
+	// strongest first, with the unranked last
+	sort.SliceStable(ranks, func(i, j int) bool {
+		ri, iok := parseRank(ranks[i])
+		rj, jok := parseRank(ranks[j])
+		if iok != jok {
+			return iok
+		}
+		return ri > rj
+	})
+	rows = nil
+	for _, r := range ranks {
+		rows = append(rows, byRank[r].row(r))
+	}
+	header[0] = "Opponent rank"
+	writeMarkdownTable(w, header, rows)
+
+	fmt.Fprint(w, "## By rank difference\n\n")
+	fmt.Fprint(w, "How much stronger the opponent was, by the ranks recorded in the games.\n\n")
+	differences, _ := tallyByStrength(games)
+	rows = nil
+	for d := maxStrengthBucket; d >= -maxStrengthBucket; d-- {
+		if t := differences[d]; t != nil {
+			rows = append(rows, t.row(strengthLabel(d)))
+		}
+	}
+	header[0] = "Opponent"
+	writeMarkdownTable(w, header, rows)
+
+	fmt.Fprint(w, "## Openings\n\n")
+	fmt.Fprint(w, "The point of the first stone played, by distance from the nearest edges.\n\n")
+	for _, color := range []stone{black, white} {
+		var colored []playerGame
+		for _, g := range games {
+			if g.color == color && g.root != nil {
+				colored = append(colored, g)
+			}
+		}
+		points, byPoint := tallyBy(colored, func(g playerGame) string { return openingPoint(g.root, color) })
+		rows = nil
+		for _, p := range points {
+			rows = append(rows, byPoint[p].row(p))
+		}
+		header[0] = "First move as Black"
+		if color == white {
+			header[0] = "First move as White"
+		}
+		writeMarkdownTable(w, header, rows)
+	}
+
+	fmt.Fprint(w, "## Results\n\n")
+	methods, byMethod := tallyBy(games, func(g playerGame) string {
+		if g.root == nil {
+			return "unknown"
+		}
+		return resultMethod(g.root.get("RE"))
+	})
+	rows = nil
+	for _, m := range methods {
+		rows = append(rows, byMethod[m].row(m))
+	}
+	header[0] = "Ended by"
+	writeMarkdownTable(w, header, rows)
+
+	fmt.Fprint(w, "## Notable games\n\n")
+	fmt.Fprint(w, "Games which have been tagged or have notes.\n\n")
+	rows = nil
+	for _, g := range games {
+		var tags, notes string
+		err := db.QueryRow(`
+			select
+				coalesce((select group_concat(t.name, ', ') from game_tags gt join tags t on t.id = gt.tag_id where gt.game_id = ?), ''),
+				coalesce((select group_concat(n.body, ' / ') from notes n where n.game_id = ?), '')`,
+			g.id,
+			g.id,
+		).Scan(&tags, &notes)
+		if err != nil {
+			return err
+		}
+		if tags == "" && notes == "" {
+			continue
+		}
+		notes = strings.Replace(notes, "\n", " ", -1)
+		rows = append(rows, []string{fmt.Sprint(g.id), dateOf(g.timestamp), g.opponent, g.outcome.String(), tags, notes})
+	}
+	if len(rows) == 0 {
+		fmt.Fprintln(w, "None.")
+	} else {
+		writeMarkdownTable(w, []string{"Game", "Date", "Opponent", "Result", "Tags", "Notes"}, rows)
+	}
+	return nil
+}
+
+// dateOf trims a stored timestamp down to its date.
+func dateOf(timestamp string) string {
+	if len(timestamp) > 10 {
+		return timestamp[:10]
+	}
+	return timestamp
+}
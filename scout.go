@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const scoutUsage = `usage:
+  scout [-db-path PATH] [-o FILE] -opponent NAME [-opponent NAME...] [FILTERS]
+
+scout writes a Markdown report on an opponent from the games played against
+them: the first moves they favor, how long the games run and how they win.
+Give -opponent once for each of their accounts. The games are those of
+-player, or the self names in the config file, and the other filters apply
+as well.`
+
+func scoutCommand(args []string) {
+	fs := flag.NewFlagSet("scout", flag.ExitOnError)
+	var (
+		dbPath    = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		outPath   = fs.String("o", "", "The file to write the report to (defaults to standard output)")
+		opponents stringList
+		filter    gameFilter
+	)
+	fs.Var(&opponents, "opponent", "The opponent to report on (repeatable, for their other accounts)")
+	filter.register(fs)
+	fs.Parse(args)
+
+	if len(opponents) == 0 || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, scoutUsage)
+		os.Exit(2)
+	}
+
+	names, err := filter.perspective()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	all, err := playerGames(db, names, &filter)
+	if err != nil {
+		log.Fatalf("error reading games: %s\n", err)
+	}
+	// opponents are named by the names they go by, whichever form was given
+	wanted, err := canonicalNames(db, opponents)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var games []playerGame
+	for _, g := range all {
+		if wanted[g.opponent] {
+			games = append(games, g)
+		}
+	}
+
+	out := os.Stdout
+	if *outPath != "" {
+		out, err = os.Create(*outPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+	err = writeScoutingReport(out, db, []string(opponents), games)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// gameLengths returns the number of main line moves stored for each game,
+// leaving out the games without stored moves.
+func gameLengths(db *sql.DB, games []playerGame) (map[int64]int, error) {
+	lengths := make(map[int64]int)
+	for _, g := range games {
+		var n sql.NullInt64
+		err := db.QueryRow("select max(move_number) from moves where game_id = ? and main_line = 1", g.id).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n.Valid {
+			lengths[g.id] = int(n.Int64)
+		}
+	}
+	return lengths, nil
+}
+
+// lengthRow summarizes the lengths of a set of games.
+func lengthRow(label string, games []playerGame, lengths map[int64]int) []string {
+	var ns []int
+	for _, g := range games {
+		if n, ok := lengths[g.id]; ok {
+			ns = append(ns, n)
+		}
+	}
+	if len(ns) == 0 {
+		return []string{label, "0", "-", "-", "-"}
+	}
+	sort.Ints(ns)
+	median := float64(ns[len(ns)/2])
+	if len(ns)%2 == 0 {
+		median = float64(ns[len(ns)/2-1]+ns[len(ns)/2]) / 2
+	}
+	return []string{label, fmt.Sprint(len(ns)), fmt.Sprintf("%g", median), fmt.Sprint(ns[0]), fmt.Sprint(ns[len(ns)-1])}
+}
+
+// resultMargin is the score an RE property gives for a game won on points.
+func resultMargin(re string) (float64, bool) {
+	i := strings.Index(re, "+")
+	if i < 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(re[i+1:]), 64)
+	return v, err == nil
+}
+
+func writeScoutingReport(w io.Writer, db *sql.DB, opponents []string, games []playerGame) error {
+	fmt.Fprintf(w, "# Scouting report on %s\n\n", strings.Join(opponents, ", "))
+	if len(games) == 0 {
+		fmt.Fprintln(w, "No games found against them.")
+		return nil
+	}
+	fmt.Fprintf(w, "From %d games played between %s and %s, generated %s.\n\n",
+		len(games), dateOf(games[0].timestamp), dateOf(games[len(games)-1].timestamp), time.Now().Format("2006-01-02"))
+
+	var all, asBlack, asWhite tally
+	var wins, losses []playerGame
+	for _, g := range games {
+		all.add(g)
+		if g.color == black {
+			asBlack.add(g)
+		} else {
+			asWhite.add(g)
+		}
+		switch g.outcome {
+		case outcomeWin:
+			wins = append(wins, g)
+		case outcomeLoss:
+			losses = append(losses, g)
+		}
+	}
+	header := []string{"", "Games", "Wins", "Losses", "Jigo", "Void", "Win rate"}
+	fmt.Fprint(w, "## My record against them\n\n")
+	writeMarkdownTable(w, header, [][]string{
+		all.row("All games"),
+		asBlack.row("As Black"),
+		asWhite.row("As White"),
+	})
+
+	fmt.Fprint(w, "## Their openings\n\n")
+	fmt.Fprint(w, "The point of their first stone, with my results when they played it.\n\n")
+	for _, color := range []stone{black, white} {
+		// their color is the opposite of mine
+		var colored []playerGame
+		for _, g := range games {
+			if g.color == color.opponent() && g.root != nil {
+				colored = append(colored, g)
+			}
+		}
+		points, byPoint := tallyBy(colored, func(g playerGame) string { return openingPoint(g.root, color) })
+		var rows [][]string
+		for _, p := range points {
+			rows = append(rows, byPoint[p].row(p))
+		}
+		header[0] = "Their first move as Black"
+		if color == white {
+			header[0] = "Their first move as White"
+		}
+		writeMarkdownTable(w, header, rows)
+	}
+
+	fmt.Fprint(w, "## Game length\n\n")
+	fmt.Fprint(w, "Main line moves, for the games with stored moves.\n\n")
+	lengths, err := gameLengths(db, games)
+	if err != nil {
+		return err
+	}
+	writeMarkdownTable(w, []string{"", "Games", "Median", "Shortest", "Longest"}, [][]string{
+		lengthRow("All games", games, lengths),
+		lengthRow("My wins", wins, lengths),
+		lengthRow("My losses", losses, lengths),
+	})
+
+	fmt.Fprint(w, "## How they beat me\n\n")
+	if len(losses) == 0 {
+		fmt.Fprintln(w, "They haven't.")
+		return nil
+	}
+	type method struct {
+		games, margins int
+		margin         float64
+	}
+	byMethod := make(map[string]*method)
+	var methods []string
+	for _, g := range losses {
+		m, re := "unknown", ""
+		if g.root != nil {
+			re = g.root.get("RE")
+			m = resultMethod(re)
+		}
+		if byMethod[m] == nil {
+			byMethod[m] = &method{}
+			methods = append(methods, m)
+		}
+		byMethod[m].games++
+		if v, ok := resultMargin(re); ok && m == "points" {
+			byMethod[m].margins++
+			byMethod[m].margin += v
+		}
+	}
+	sort.SliceStable(methods, func(i, j int) bool { return byMethod[methods[i]].games > byMethod[methods[j]].games })
+	var rows [][]string
+	for _, name := range methods {
+		m := byMethod[name]
+		margin := "-"
+		if m.margins > 0 {
+			margin = fmt.Sprintf("%.1f", m.margin/float64(m.margins))
+		}
+		rows = append(rows, []string{name, fmt.Sprint(m.games), fmt.Sprintf("%.0f%%", 100*float64(m.games)/float64(len(losses))), margin})
+	}
+	writeMarkdownTable(w, []string{"Ended by", "Games", "Share", "Average margin"}, rows)
+
+	// the openings of the games they won, whichever color they had
+	openings, byOpening := tallyBy(losses, func(g playerGame) string {
+		if g.root == nil {
+			return "unknown"
+		}
+		color := "Black"
+		if g.color == black {
+			color = "White"
+		}
+		return openingPoint(g.root, g.color.opponent()) + " as " + color
+	})
+	rows = nil
+	for _, o := range openings {
+		rows = append(rows, []string{o, fmt.Sprint(byOpening[o].games)})
+	}
+	writeMarkdownTable(w, []string{"Their first move", "Wins"}, rows)
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const searchUsage = `usage:
+  search [-db-path PATH] [-limit N] [filters] TEXT...
+
+search finds the games whose player names, event, round, game name, place,
+comments or notes contain every word of TEXT, like "Shusaku castle game".
+TEXT may use sqlite's full text query syntax, such as OR, "exact phrases" and
+prefix* matches. The first search after an import indexes the new games.`
+
+func searchCommand(args []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		limit  = fs.Int("limit", 50, "The most games to list")
+		filter gameFilter
+	)
+	filter.register(fs)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, searchUsage)
+		os.Exit(2)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	err = updateSearchIndex(db)
+	if err != nil {
+		log.Fatalf("error updating the search index: %s\n", err)
+	}
+	err = search(db, strings.Join(fs.Args(), " "), &filter, *limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func search(db *sql.DB, text string, filter *gameFilter, limit int) error {
+	where, args := filter.where()
+	rows, err := db.Query(`
+		select g.id, coalesce(g.timestamp, ''), coalesce(b.name, '(unknown)'), coalesce(w.name, '(unknown)'),
+			snippet(search, '[', ']', '...', -1, 8)
+		from search
+		join games g on g.id = search.docid
+		left join players b on b.id = g.black_id
+		left join players w on w.id = g.white_id
+		where search match ? and `+where+`
+		order by g.timestamp desc, g.id desc
+		limit ?`,
+		append(append([]interface{}{text}, args...), limit)...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tDATE\tBLACK\tWHITE\tMATCH")
+	for rows.Next() {
+		var (
+			id                                int64
+			timestamp, black, white, matching string
+		)
+		if err := rows.Scan(&id, &timestamp, &black, &white, &matching); err != nil {
+			return err
+		}
+		matching = strings.Join(strings.Fields(matching), " ")
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", id, dateOf(timestamp), black, white, matching)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// searchBatch is how many games are indexed per transaction.
+const searchBatch = 500
+
+// updateSearchIndex drops the rows of deleted games from the search index and
+// adds the games missing from it.
+func updateSearchIndex(db *sql.DB) error {
+	_, err := db.Exec("delete from search where docid not in (select id from games)")
+	if err != nil {
+		return err
+	}
+	var indexed int
+	for {
+		entries, err := unindexedGames(db)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			_, err := tx.Exec(
+				"insert into search (docid, players, event, comments) values (?, ?, ?, ?)",
+				e.id, e.players, e.event, e.comments,
+			)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		indexed += len(entries)
+		log.Println("indexed", indexed, "games for searching")
+	}
+	return nil
+}
+
+// indexedNames is the expression for the names a player is indexed under:
+// the one they were recorded under, the one they go by and every other form
+// of that.
+func indexedNames(player string) string {
+	return fmt.Sprintf(`coalesce(%[1]s.name || char(10) || coalesce(%[1]s.canonical_name, '') || char(10) ||
+			coalesce((select group_concat(a.alias, char(10)) from name_aliases a where a.name = %[1]s.canonical_name), ''), '')`, player)
+}
+
+type searchEntry struct {
+	id                       int64
+	players, event, comments string
+}
+
+// unindexedGames reads the text to index of a batch of the games missing from
+// the search index.
+func unindexedGames(db *sql.DB) ([]searchEntry, error) {
+	rows, err := db.Query(`
+		select g.id, `+indexedNames("b")+`, `+indexedNames("w")+`, coalesce(g.sgf, ''),
+			coalesce(g.game_name, ''), coalesce(g.place, ''), coalesce(g.game_comment, ''),
+			coalesce((select group_concat(n.body, char(10)) from notes n where n.game_id = g.id), '')
+		from games g
+		left join players b on b.id = g.black_id
+		left join players w on w.id = g.white_id
+		where g.id not in (select docid from search)
+		limit ?`,
+		searchBatch,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []searchEntry
+	for rows.Next() {
+		var (
+			e                                   searchEntry
+			black, white, source                string
+			gameName, place, gameComment, notes string
+		)
+		err := rows.Scan(&e.id, &black, &white, &source, &gameName, &place, &gameComment, &notes)
+		if err != nil {
+			return nil, err
+		}
+		e.players = strings.TrimSpace(black + "\n" + white)
+		event := []string{gameName, place}
+		comments := []string{gameComment}
+		// the event, round and move comments are only kept in the SGF text
+		if games, err := readCollection([]byte(source)); err == nil && len(games) > 0 {
+			root := games[0].root
+			event = append(event, root.get("EV"), root.get("RO"))
+			var walk func(n *sgfNode)
+			walk = func(n *sgfNode) {
+				comments = append(comments, n.get("C"))
+				for _, c := range n.children {
+					walk(c)
+				}
+			}
+			walk(root)
+		}
+		comments = append(comments, notes)
+		e.event = joinNonEmpty(event)
+		e.comments = joinNonEmpty(comments)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func joinNonEmpty(values []string) string {
+	var kept []string
+	for _, v := range values {
+		if v != "" {
+			kept = append(kept, v)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const serveUsage = `usage:
+  serve [-db-path PATH] [-addr HOST:PORT] [-reload-every DURATION]
+
+serve answers read-only HTTP requests about the library:
+
+  /healthz          whether the library can be read, and when the last
+                    import finished
+  /games            the games matching the filters given as query
+                    parameters, named like the command line filters, e.g.
+                    /games?player=apiarian&since=2024&limit=50
+  /games/ID.sgf     a game's SGF text
+  /query?sql=...    the rows of any read-only query, as JSON
+
+The database is switched to write-ahead logging, and each request reads from
+its own snapshot, so long queries and imports don't wait for each other.
+The server reopens the library when an import adds a partition, and when
+it's sent SIGHUP; requests already running finish on the library as it was.
+
+serve never migrates the library, and only serves one with the schema it
+was built for: run another command, like import, to migrate an older
+library first. When the library is migrated while it's being served, the
+server goes on answering from the connections it has until it's restarted.`
+
+func serveCommand(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to serve")
+		addr   = fs.String("addr", "localhost:8080", "The address to listen on")
+		every  = fs.Duration("reload-every", 30*time.Second, "How often to check whether the library needs reopening")
+	)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, serveUsage)
+		os.Exit(2)
+	}
+
+	lib := &servedLibrary{path: *dbPath}
+	err := lib.reload()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lib.close()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		tick := time.NewTicker(*every)
+		defer tick.Stop()
+		for {
+			var err error
+			select {
+			case <-hup:
+				log.Println("reopening the library")
+				err = lib.reload()
+			case <-tick.C:
+				err = lib.reloadIfChanged()
+			}
+			if err != nil {
+				log.Printf("error reopening the library: %s\n", err)
+			}
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", lib.serveHealth)
+	mux.HandleFunc("/games", lib.snapshot(serveGames))
+	mux.HandleFunc("/games/", lib.snapshot(serveGame))
+	mux.HandleFunc("/query", lib.snapshot(serveQuery))
+	log.Printf("serving %s on http://%s\n", *dbPath, *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+// servedLibrary holds the read-only connections the server answers from,
+// swapping them for new ones when the library changes shape.
+type servedLibrary struct {
+	path string
+	// pool holds the current *servedPool
+	pool atomic.Value
+	// reloading keeps reloads from running at once
+	reloading sync.Mutex
+}
+
+// servedPool is a pool of read-only connections, which is closed once it has
+// been replaced and the requests using it have finished.
+type servedPool struct {
+	db *sql.DB
+	// fingerprint is the schema version and partitions db was opened with
+	fingerprint string
+
+	mu      sync.Mutex
+	users   int
+	retired bool
+}
+
+// use counts a request using the pool, returning false when it has been
+// replaced already.
+func (p *servedPool) use() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.retired {
+		return false
+	}
+	p.users++
+	return true
+}
+
+func (p *servedPool) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users--
+	if p.retired && p.users == 0 {
+		p.db.Close()
+	}
+}
+
+// retire closes the pool once the requests using it have finished.
+func (p *servedPool) retire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retired = true
+	if p.users == 0 {
+		p.db.Close()
+	}
+}
+
+// acquire returns the current pool, which the caller must call done on.
+func (l *servedLibrary) acquire() *servedPool {
+	for {
+		p := l.pool.Load().(*servedPool)
+		if p.use() {
+			return p
+		}
+	}
+}
+
+// libraryFingerprint identifies the schema version and partitions of the
+// database, which the read-only connections are set up for.
+func libraryFingerprint(db queryer, path string) (string, error) {
+	var version int
+	err := db.QueryRow("pragma main.user_version").Scan(&version)
+	if err != nil {
+		return "", err
+	}
+	parts, err := listPartitions(db, path)
+	if err != nil {
+		return "", err
+	}
+	names := []string{strconv.Itoa(version)}
+	for _, p := range parts {
+		names = append(names, p.name)
+	}
+	return strings.Join(names, " "), nil
+}
+
+// reload checks the database has the schema serve was built for, switches
+// it and its partitions to write-ahead logging and opens a new read-only
+// pool on it.
+func (l *servedLibrary) reload() error {
+	l.reloading.Lock()
+	defer l.reloading.Unlock()
+
+	found, err := exists(l.path)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("could not find a database at %s", l.path)
+	}
+	mainDB, err := sql.Open("sqlite3", sqliteDSN(l.path))
+	if err != nil {
+		return err
+	}
+	defer mainDB.Close()
+	var version int
+	err = mainDB.QueryRow("pragma main.user_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("problem reading the schema version: %s", err)
+	}
+	switch {
+	case version < len(migrations):
+		return fmt.Errorf("the library's schema is at version %d, older than the %d served; run import to migrate it", version, len(migrations))
+	case version > len(migrations):
+		return fmt.Errorf("the library's schema is at version %d, newer than the %d served; serve it with a newer build", version, len(migrations))
+	}
+	parts, err := listPartitions(mainDB, l.path)
+	if err != nil {
+		return err
+	}
+	files := []string{l.path}
+	for _, p := range parts {
+		files = append(files, p.path)
+	}
+	// the journal mode is kept in the file, so imports use it as well
+	for _, f := range files {
+		err := setWAL(f)
+		if err != nil {
+			return fmt.Errorf("problem switching %s to write-ahead logging: %s", f, err)
+		}
+	}
+	fingerprint, err := libraryFingerprint(mainDB, l.path)
+	if err != nil {
+		return err
+	}
+
+	d := &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if len(parts) > 0 {
+				err := attachPartitions(conn, parts)
+				if err != nil {
+					return err
+				}
+			}
+			_, err := conn.Exec("pragma query_only = on", nil)
+			return err
+		},
+	}
+	snapshots := sql.OpenDB(dsnConnector{dsn: readDSN(l.path), driver: d})
+
+	old, _ := l.pool.Load().(*servedPool)
+	l.pool.Store(&servedPool{db: snapshots, fingerprint: fingerprint})
+	if old != nil {
+		old.retire()
+	}
+	return nil
+}
+
+// reloadIfChanged reloads the library when an import has added a partition
+// or migrated the schema since it was opened.
+func (l *servedLibrary) reloadIfChanged() error {
+	p := l.acquire()
+	fingerprint, err := libraryFingerprint(p.db, l.path)
+	changed := fingerprint != p.fingerprint
+	p.done()
+	if err != nil || !changed {
+		return err
+	}
+	log.Println("the library has changed, reopening it")
+	return l.reload()
+}
+
+func (l *servedLibrary) close() {
+	l.pool.Load().(*servedPool).retire()
+}
+
+func setWAL(path string) error {
+	db, err := sql.Open("sqlite3", partitionDSN(path))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var mode string
+	return db.QueryRow("pragma journal_mode = wal").Scan(&mode)
+}
+
+// snapshot runs a handler in a read transaction, which sees the library as
+// it was when the transaction first read from it.
+func (l *servedLibrary) snapshot(h func(w http.ResponseWriter, r *http.Request, tx *sql.Tx) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := l.acquire()
+		defer p.done()
+		tx, err := p.db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true})
+		if err == nil {
+			err = h(w, r, tx)
+			tx.Rollback()
+		}
+		if err != nil {
+			code := http.StatusInternalServerError
+			if e, ok := err.(httpError); ok {
+				code = e.code
+			}
+			http.Error(w, err.Error(), code)
+		}
+	}
+}
+
+// httpError is an error with the status code to answer it with.
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e httpError) Error() string { return e.msg }
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (l *servedLibrary) serveHealth(w http.ResponseWriter, r *http.Request) {
+	health := struct {
+		Status     string  `json:"status"`
+		Error      string  `json:"error,omitempty"`
+		Games      int64   `json:"games"`
+		LastImport *string `json:"last_import"`
+	}{Status: "ok"}
+
+	p := l.acquire()
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	err := p.db.QueryRowContext(ctx, `
+		select (select count(*) from games), (select max(finished) from import_runs)`,
+	).Scan(&health.Games, &health.LastImport)
+	cancel()
+	p.done()
+	if err != nil {
+		health.Status, health.Error = "error", err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, health)
+}
+
+// serveGames lists the games matching the filters in the query parameters.
+func serveGames(w http.ResponseWriter, r *http.Request, tx *sql.Tx) error {
+	fs := flag.NewFlagSet("games", flag.ContinueOnError)
+	var filter gameFilter
+	filter.register(fs)
+	limit := fs.Int("limit", 100, "")
+	for name, values := range r.URL.Query() {
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return httpError{http.StatusBadRequest, fmt.Sprintf("bad parameter %s: %s", name, err)}
+			}
+		}
+	}
+
+	where, args := filter.where()
+	rows, err := tx.QueryContext(r.Context(), `
+		select g.id, coalesce(g.timestamp, ''), coalesce(b.name, ''), coalesce(w.name, ''),
+			coalesce(g.result, ''),
+			case when g.winner_id = g.black_id then 'B' when g.winner_id = g.white_id then 'W' else '' end
+		from games g
+		left join players b on b.id = g.black_id
+		left join players w on w.id = g.white_id
+		where `+where+`
+		order by g.timestamp desc, g.id desc
+		limit ?`,
+		append(args, *limit)...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	type game struct {
+		ID     int64  `json:"id"`
+		Date   string `json:"date"`
+		Black  string `json:"black"`
+		White  string `json:"white"`
+		Result string `json:"result"`
+		Winner string `json:"winner"`
+	}
+	games := []game{}
+	for rows.Next() {
+		var g game
+		if err := rows.Scan(&g.ID, &g.Date, &g.Black, &g.White, &g.Result, &g.Winner); err != nil {
+			return err
+		}
+		g.Date = dateOf(g.Date)
+		games = append(games, g)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writeJSON(w, games)
+}
+
+func serveGame(w http.ResponseWriter, r *http.Request, tx *sql.Tx) error {
+	name := strings.TrimPrefix(r.URL.Path, "/games/")
+	id, err := strconv.ParseInt(strings.TrimSuffix(name, ".sgf"), 10, 64)
+	if err != nil || !strings.HasSuffix(name, ".sgf") {
+		return httpError{http.StatusNotFound, "no such game"}
+	}
+	data, err := gameSGF(tx, id, sgfNormalization{})
+	if err != nil {
+		return httpError{http.StatusNotFound, err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/x-go-sgf")
+	_, err = w.Write(data)
+	return err
+}
+
+// serveQuery runs a query on connections which can't write.
+func serveQuery(w http.ResponseWriter, r *http.Request, tx *sql.Tx) error {
+	query := r.URL.Query().Get("sql")
+	if query == "" {
+		return httpError{http.StatusBadRequest, "the sql parameter is missing"}
+	}
+	rows, err := tx.QueryContext(r.Context(), query)
+	if err != nil {
+		return httpError{http.StatusBadRequest, err.Error()}
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	result := struct {
+		Columns []string        `json:"columns"`
+		Rows    [][]interface{} `json:"rows"`
+	}{Columns: columns, Rows: [][]interface{}{}}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return writeJSON(w, result)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// sgfNormalization picks the clean-ups the export commands make to the games
+// they write.
+type sgfNormalization struct {
+	// utf8 re-encodes games written in another character set as UTF-8
+	utf8 bool
+	// fillInfo adds the RE and DT properties from the database to the games
+	// missing them
+	fillInfo bool
+	// stripVariations keeps only the main line
+	stripVariations bool
+	// sortProperties writes properties in sgfPropertyOrder
+	sortProperties bool
+}
+
+func (n *sgfNormalization) register(fs *flag.FlagSet) {
+	fs.BoolVar(&n.utf8, "utf8", false, "Re-encode games to UTF-8 from the character set named by their CA property")
+	fs.BoolVar(&n.fillInfo, "fill-info", false, "Fill in missing RE and DT properties from the database")
+	fs.BoolVar(&n.stripVariations, "strip-variations", false, "Keep only the main line of each game")
+	fs.BoolVar(&n.sortProperties, "sort-properties", false, "Write the properties of each node in a standard order")
+	fs.Var(normalizeAll{n}, "normalize", "Make all of the above clean-ups")
+}
+
+// any is whether any clean-up was asked for.
+func (n sgfNormalization) any() bool {
+	return n.utf8 || n.fillInfo || n.stripVariations || n.sortProperties
+}
+
+// normalizeAll is the -normalize flag, which turns on every clean-up.
+type normalizeAll struct{ n *sgfNormalization }
+
+func (a normalizeAll) IsBoolFlag() bool { return true }
+
+func (a normalizeAll) String() string { return "false" }
+
+func (a normalizeAll) Set(s string) error {
+	if s != "true" {
+		return nil
+	}
+	*a.n = sgfNormalization{utf8: true, fillInfo: true, stripVariations: true, sortProperties: true}
+	return nil
+}
+
+// sgfPropertyOrder is the order sortProperties writes properties in: the
+// game information first, then the move and its timing, then everything
+// else alphabetically, with comments last.
+var sgfPropertyOrder = []string{
+	"FF", "GM", "CA", "AP", "SZ", "KM", "HA", "RU", "TM", "OT",
+	"PB", "BR", "BT", "PW", "WR", "WT", "DT", "EV", "RO", "PC", "GN", "RE",
+	"B", "W", "BL", "WL", "OB", "OW", "AB", "AW", "AE",
+}
+
+// toUTF8 re-encodes SGF text from the character set named by its CA
+// property, or ISO-8859-1 when it has none and isn't already UTF-8, as the
+// SGF specification makes it the default.
+func toUTF8(source string) (string, error) {
+	games, err := readCollection([]byte(source))
+	if err != nil || len(games) == 0 {
+		return "", fmt.Errorf("problem reading the SGF text: %v", err)
+	}
+	charset := strings.TrimSpace(games[0].root.get("CA"))
+	if charset == "" && utf8.ValidString(source) {
+		return source, nil
+	}
+	if charset == "" {
+		charset = "iso-8859-1"
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return "", fmt.Errorf("unknown character set %q", charset)
+	}
+	if name, _ := htmlindex.Name(enc); name == "utf-8" {
+		return source, nil
+	}
+	decoded, err := enc.NewDecoder().String(source)
+	if err != nil {
+		return "", fmt.Errorf("problem decoding the %s text: %s", charset, err)
+	}
+	return decoded, nil
+}
+
+// normalize makes the clean-ups other than re-encoding to the game tree
+// rooted at root, stored as game id.
+func (n sgfNormalization) normalize(db queryer, id int64, root *sgfNode) error {
+	if n.utf8 {
+		root.set("CA", "UTF-8")
+	}
+	if n.fillInfo {
+		err := fillGameInfo(db, id, root)
+		if err != nil {
+			return err
+		}
+	}
+	if n.stripVariations {
+		for c := root; len(c.children) > 0; c = c.children[0] {
+			c.children = c.children[:1]
+		}
+	}
+	if n.sortProperties {
+		var walk func(c *sgfNode)
+		walk = func(c *sgfNode) {
+			sortProperties(c)
+			for _, child := range c.children {
+				walk(child)
+			}
+		}
+		walk(root)
+	}
+	return nil
+}
+
+// fillGameInfo sets a game's RE and DT properties, when it has none, from
+// its result and timestamp in the database.
+func fillGameInfo(db queryer, id int64, root *sgfNode) error {
+	var (
+		result, timestamp, zone string
+		winner                  sql.NullString
+	)
+	err := db.QueryRow(`
+		select coalesce(g.result, ''), coalesce(g.timestamp, ''), coalesce(g.timezone, ''),
+			case when g.winner_id = g.black_id then 'B' when g.winner_id = g.white_id then 'W' end
+		from games g
+		where g.id = ?`,
+		id,
+	).Scan(&result, &timestamp, &zone, &winner)
+	if err != nil {
+		return err
+	}
+
+	if root.get("RE") == "" {
+		switch {
+		case result == resultJigo:
+			root.set("RE", "0")
+		case result == resultVoid:
+			root.set("RE", "Void")
+		case result == resultForfeit && winner.Valid:
+			root.set("RE", winner.String+"+F")
+		case winner.Valid:
+			root.set("RE", winner.String+"+")
+		}
+	}
+
+	if root.get("DT") == "" && timestamp != "" {
+		date := dateOf(timestamp)
+		if t, err := time.Parse(time.RFC3339, timestamp); err == nil && zone != "" {
+			if loc, err := time.LoadLocation(zone); err == nil {
+				date = t.In(loc).Format("2006-01-02")
+			}
+		}
+		root.set("DT", date)
+	}
+	return nil
+}
+
+func sortProperties(n *sgfNode) {
+	position := func(id string) int {
+		for i, o := range sgfPropertyOrder {
+			if o == id {
+				return i
+			}
+		}
+		if id == "C" {
+			return len(sgfPropertyOrder) + 1
+		}
+		return len(sgfPropertyOrder)
+	}
+	sort.SliceStable(n.order, func(i, j int) bool {
+		pi, pj := position(n.order[i]), position(n.order[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return n.order[i] < n.order[j]
+	})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// sgfNode is a node of a game tree as read by readCollection, the only SGF
+// parser the import uses. It keeps every property with its values in the
+// order they were written, so games can be written back out as they came.
+type sgfNode struct {
+	props    map[string][]string
+	order    []string
+	children []*sgfNode
+}
+
+// sgfGame is one GameTree of a collection along with its source text.
+type sgfGame struct {
+	root *sgfNode
+	raw  []byte
+}
+
+func newSGFNode() *sgfNode {
+	return &sgfNode{props: make(map[string][]string)}
+}
+
+// get returns the first value of a property, or "" when it is missing.
+func (n *sgfNode) get(id string) string {
+	if vs := n.props[id]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// set replaces the values of a property, keeping its position if it was
+// already present.
+func (n *sgfNode) set(id string, values ...string) {
+	if _, ok := n.props[id]; !ok {
+		n.order = append(n.order, id)
+	}
+	n.props[id] = values
+}
+
+// del removes a property from the node.
+func (n *sgfNode) del(id string) {
+	if _, ok := n.props[id]; !ok {
+		return
+	}
+	delete(n.props, id)
+	for i, o := range n.order {
+		if o == id {
+			n.order = append(n.order[:i], n.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// mainLine returns the nodes following the first variation at every branch,
+// starting with n itself.
+func (n *sgfNode) mainLine() []*sgfNode {
+	var line []*sgfNode
+	for c := n; c != nil; {
+		line = append(line, c)
+		if len(c.children) == 0 {
+			break
+		}
+		c = c.children[0]
+	}
+	return line
+}
+
+// readCollection reads every GameTree in data. Text outside of the game trees
+// is ignored, as some servers add headers to their downloads.
+func readCollection(data []byte) ([]sgfGame, error) {
+	p := sgfReader{data: data}
+	var games []sgfGame
+	for {
+		start := bytes.IndexByte(data[p.pos:], '(')
+		if start < 0 {
+			break
+		}
+		p.pos += start
+		begin := p.pos
+		root, err := p.gameTree()
+		if err != nil {
+			return games, err
+		}
+		games = append(games, sgfGame{root: root, raw: data[begin:p.pos]})
+	}
+	return games, nil
+}
+
+// splitGameTrees reads a collection from r one GameTree at a time, calling fn
+// with the text of each, so that a large collection never has to be held in
+// memory whole. Like readCollection it ignores text outside of the game trees.
+func splitGameTrees(r io.Reader, fn func(raw []byte) error) error {
+	br := bufio.NewReader(r)
+	var (
+		buf     []byte
+		depth   int
+		inValue bool
+		escaped bool
+	)
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			if depth > 0 {
+				return errors.New("unexpected end of data")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if depth == 0 && b != '(' {
+			continue
+		}
+		buf = append(buf, b)
+		switch {
+		case inValue && escaped:
+			escaped = false
+		case inValue && b == '\\':
+			escaped = true
+		case inValue && b == ']':
+			inValue = false
+		case inValue:
+		case b == '[':
+			inValue = true
+		case b == '(':
+			depth++
+		case b == ')':
+			depth--
+			if depth == 0 {
+				if err := fn(buf); err != nil {
+					return err
+				}
+				buf = nil
+			}
+		}
+	}
+}
+
+type sgfReader struct {
+	data []byte
+	pos  int
+}
+
+func (p *sgfReader) skipSpace() {
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *sgfReader) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at byte %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// gameTree reads "(" sequence gametree* ")" and returns the first node of the
+// sequence.
+func (p *sgfReader) gameTree() (*sgfNode, error) {
+	if p.pos >= len(p.data) || p.data[p.pos] != '(' {
+		return nil, p.errorf("expected (")
+	}
+	p.pos++
+
+	var first, last *sgfNode
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("unexpected end of data")
+		}
+		if p.data[p.pos] != ';' {
+			break
+		}
+		p.pos++
+		n, err := p.properties()
+		if err != nil {
+			return nil, err
+		}
+		if first == nil {
+			first = n
+		} else {
+			last.children = append(last.children, n)
+		}
+		last = n
+	}
+	if first == nil {
+		return nil, p.errorf("game tree without any nodes")
+	}
+
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("unexpected end of data")
+		}
+		switch p.data[p.pos] {
+		case '(':
+			child, err := p.gameTree()
+			if err != nil {
+				return nil, err
+			}
+			last.children = append(last.children, child)
+		case ')':
+			p.pos++
+			return first, nil
+		default:
+			return nil, p.errorf("unexpected %q", p.data[p.pos])
+		}
+	}
+}
+
+func (p *sgfReader) properties() (*sgfNode, error) {
+	n := newSGFNode()
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return n, nil
+		}
+		c := p.data[p.pos]
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z') {
+			return n, nil
+		}
+		// old FF[3] files spell identifiers like AddBlack; only the capitals
+		// are significant
+		var id []byte
+		for p.pos < len(p.data) {
+			c := p.data[p.pos]
+			if c >= 'A' && c <= 'Z' {
+				id = append(id, c)
+			} else if !(c >= 'a' && c <= 'z') {
+				break
+			}
+			p.pos++
+		}
+		var values []string
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.data) || p.data[p.pos] != '[' {
+				break
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		if len(values) == 0 {
+			return nil, p.errorf("property %s without a value", id)
+		}
+		key := string(id)
+		n.set(key, append(n.props[key], values...)...)
+	}
+}
+
+func (p *sgfReader) value() (string, error) {
+	p.pos++ // the opening [
+	var b strings.Builder
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		switch c {
+		case ']':
+			p.pos++
+			return b.String(), nil
+		case '\\':
+			p.pos++
+			if p.pos >= len(p.data) {
+				break
+			}
+			// an escaped line break is a soft line break and is removed
+			switch p.data[p.pos] {
+			case '\n':
+				p.pos++
+				if p.pos < len(p.data) && p.data[p.pos] == '\r' {
+					p.pos++
+				}
+				continue
+			case '\r':
+				p.pos++
+				if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+					p.pos++
+				}
+				continue
+			}
+			b.WriteByte(p.data[p.pos])
+			p.pos++
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", p.errorf("unterminated property value")
+}
+
+// writeGameTree serializes a game tree starting at n.
+func writeGameTree(buf *bytes.Buffer, n *sgfNode) {
+	buf.WriteByte('(')
+	for {
+		writeNode(buf, n)
+		if len(n.children) != 1 {
+			break
+		}
+		n = n.children[0]
+	}
+	for _, c := range n.children {
+		buf.WriteByte('\n')
+		writeGameTree(buf, c)
+	}
+	buf.WriteByte(')')
+}
+
+func writeNode(buf *bytes.Buffer, n *sgfNode) {
+	buf.WriteByte(';')
+	for _, id := range n.order {
+		buf.WriteString(id)
+		for _, v := range n.props[id] {
+			buf.WriteByte('[')
+			buf.WriteString(escapeSGFValue(v))
+			buf.WriteByte(']')
+		}
+	}
+}
+
+func escapeSGFValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	return strings.Replace(v, "]", `\]`, -1)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCollectionEscapes(t *testing.T) {
+	games, err := readCollection([]byte(`(;GM[1]C[a \] b \\ c \: d]GN[soft\
+break]PC[keep
+line])`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 1 {
+		t.Fatalf("read %d games, want 1", len(games))
+	}
+	root := games[0].root
+	for id, want := range map[string]string{
+		"C":  `a ] b \ c : d`,
+		"GN": "softbreak",
+		"PC": "keep\nline",
+	} {
+		if got := root.get(id); got != want {
+			t.Errorf("%s is %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestReadCollectionVariations(t *testing.T) {
+	games, err := readCollection([]byte("(;GM[1];B[aa](;W[bb];B[cc])(;W[dd]))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := games[0].root
+	var line []string
+	for _, n := range root.mainLine()[1:] {
+		for _, color := range []string{"B", "W"} {
+			if v, ok := n.props[color]; ok {
+				line = append(line, color+v[0])
+			}
+		}
+	}
+	if want := []string{"Baa", "Wbb", "Bcc"}; !reflect.DeepEqual(line, want) {
+		t.Errorf("the main line is %q, want %q", line, want)
+	}
+	b := root.children[0]
+	if len(b.children) != 2 {
+		t.Fatalf("the first move has %d children, want 2", len(b.children))
+	}
+	if got := b.children[1].get("W"); got != "dd" {
+		t.Errorf("the variation starts with W[%s], want W[dd]", got)
+	}
+}
+
+func TestReadCollectionGames(t *testing.T) {
+	data := "junk before (;GM[1]PB[a]) between\n(;GM[1]PB[b]C[(not a tree)])"
+	games, err := readCollection([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 2 {
+		t.Fatalf("read %d games, want 2", len(games))
+	}
+	wantRaw := []string{"(;GM[1]PB[a])", "(;GM[1]PB[b]C[(not a tree)])"}
+	for i, g := range games {
+		if string(g.raw) != wantRaw[i] {
+			t.Errorf("game %d's text is %q, want %q", i, g.raw, wantRaw[i])
+		}
+	}
+	if games[1].root.get("PB") != "b" {
+		t.Errorf("the second game's PB is %q", games[1].root.get("PB"))
+	}
+
+	// splitGameTrees finds the same game trees as they're read
+	var split []string
+	err = splitGameTrees(strings.NewReader(data), func(raw []byte) error {
+		split = append(split, string(raw))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(split, wantRaw) {
+		t.Errorf("splitGameTrees found %q, want %q", split, wantRaw)
+	}
+}
+
+func TestReadCollectionMalformed(t *testing.T) {
+	for _, data := range []string{
+		"(;GM[1]C[unterminated",
+		"(;GM[1]",
+		"()",
+		"(;GM[1]B)",
+		"(;GM[1] x)",
+	} {
+		if _, err := readCollection([]byte(data)); err == nil {
+			t.Errorf("reading %q succeeded", data)
+		}
+	}
+	if games, err := readCollection([]byte("no games here")); err != nil || len(games) != 0 {
+		t.Errorf("reading text without games returned %d games and %v", len(games), err)
+	}
+	err := splitGameTrees(strings.NewReader("(;GM[1](;B[aa])"), func([]byte) error { return nil })
+	if err == nil {
+		t.Error("splitGameTrees read an unterminated game tree")
+	}
+}
+
+func TestWriteGameTreeRoundTrip(t *testing.T) {
+	source := `(;GM[1]C[a \] b];B[aa](;W[bb])(;W[cc]))`
+	games, err := readCollection([]byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	writeGameTree(&buf, games[0].root)
+	again, err := readCollection(buf.Bytes())
+	if err != nil {
+		t.Fatalf("reading %q: %s", buf.String(), err)
+	}
+	if !reflect.DeepEqual(again[0].root, games[0].root) {
+		t.Errorf("%q doesn't read back as %q", buf.String(), source)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+func showCommand(args []string) {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	var (
+		dbPath  = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		move    = fs.Int("move", -1, "The move to show the position after (defaults to the final position)")
+		diagram = fs.Int("diagram", 0, "Print a numbered diagram of this many opening moves instead of a position")
+	)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: show [-db-path PATH] [-move N | -diagram N] GAME_ID")
+		os.Exit(2)
+	}
+	ids, err := parseGameIDs(fs.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	root, err := loadGameTree(db, ids[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, l := range gameInfoLines(root) {
+		fmt.Println(l)
+	}
+	fmt.Println()
+
+	if *diagram > 0 {
+		for _, l := range renderDiagram(root, *diagram) {
+			fmt.Println(l)
+		}
+		return
+	}
+
+	n := *move
+	if n < 0 {
+		n = math.MaxInt32
+	}
+	b, played := position(root, n)
+	status := fmt.Sprintf("after move %d", played)
+	if b.last != nil {
+		status += ", last played at " + pointName(*b.last, b.size)
+	}
+	fmt.Println(status)
+	for _, l := range b.render() {
+		fmt.Println(l)
+	}
+}
+
+// renderDiagram draws the first moves of the main line with their numbers on
+// the stones. Moves played where a numbered stone has been captured, and
+// passes, are listed under the board as is usual in printed diagrams.
+func renderDiagram(root *sgfNode, moves int) []string {
+	size := boardSize(root)
+	start, _ := position(root, 0)
+	numbers := make(map[point]int)
+	var notes []string
+	var first stone
+	var played int
+	for _, n := range root.mainLine() {
+		if played >= moves {
+			break
+		}
+		for _, c := range []struct {
+			id string
+			s  stone
+		}{{"B", black}, {"W", white}} {
+			vs, ok := n.props[c.id]
+			if !ok {
+				continue
+			}
+			played++
+			if first == empty {
+				first = c.s
+			}
+			p, ok := parsePoint(vs[0], size)
+			if !ok {
+				notes = append(notes, fmt.Sprintf("%d: pass", played))
+				continue
+			}
+			if earlier, ok := numbers[p]; ok {
+				notes = append(notes, fmt.Sprintf("%d at %d", played, earlier))
+			} else if start.at(p) != empty {
+				notes = append(notes, fmt.Sprintf("%d at %s", played, pointName(p, size)))
+			} else {
+				numbers[p] = played
+			}
+		}
+	}
+
+	var lines []string
+	header := "   "
+	for x := 0; x < size && x < len(columnLabels); x++ {
+		header += fmt.Sprintf("%3c", columnLabels[x])
+	}
+	lines = append(lines, header)
+	for y := 0; y < size; y++ {
+		var line strings.Builder
+		fmt.Fprintf(&line, "%2d ", size-y)
+		for x := 0; x < size; x++ {
+			p := point{x, y}
+			if n, ok := numbers[p]; ok {
+				fmt.Fprintf(&line, "%3d", n)
+				continue
+			}
+			switch start.at(p) {
+			case black:
+				line.WriteString("  ●")
+			case white:
+				line.WriteString("  ○")
+			default:
+				line.WriteString("  ·")
+			}
+		}
+		fmt.Fprintf(&line, " %d", size-y)
+		lines = append(lines, line.String())
+	}
+	lines = append(lines, header)
+
+	if first != empty {
+		colors := "Black plays the odd numbers, White the even ones"
+		if first == white {
+			colors = "White plays the odd numbers, Black the even ones"
+		}
+		lines = append(lines, "", fmt.Sprintf("moves 1-%d. %s.", played, colors))
+	}
+	if len(notes) > 0 {
+		lines = append(lines, strings.Join(notes, ", "))
+	}
+	return lines
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var urlPattern = regexp.MustCompile(`https?://[^\s\]\[<>"]+`)
+
+// sourceURL looks for a link back to the server's record of a game in the
+// properties servers put them in, such as OGS's "PC[OGS: https://...]". Links
+// which look like they point at a particular game are preferred over links to
+// the server's front page.
+func sourceURL(root *sgfNode) string {
+	if root == nil {
+		return ""
+	}
+	var first string
+	for _, id := range []string{"PC", "SO", "GC", "GN", "EV"} {
+		for _, v := range root.props[id] {
+			for _, u := range urlPattern.FindAllString(v, -1) {
+				u = strings.TrimRight(u, ".,;:)")
+				if first == "" {
+					first = u
+				}
+				if looksLikeGameURL(u) {
+					return u
+				}
+			}
+		}
+	}
+	return first
+}
+
+func looksLikeGameURL(u string) bool {
+	path := u[strings.Index(u, "//")+2:]
+	i := strings.Index(path, "/")
+	if i < 0 {
+		return false
+	}
+	path = path[i:]
+	return strings.Contains(path, "game") || strings.ContainsAny(path, "0123456789")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The speeds a game can be classified as.
+const (
+	speedBlitz          = "blitz"
+	speedLive           = "live"
+	speedCorrespondence = "correspondence"
+)
+
+// A blitz game has at most blitzSeconds of main time and blitzMoveSeconds
+// of overtime per move, and a correspondence game at least
+// correspondenceSeconds of either.
+const (
+	blitzSeconds          = 10 * 60
+	blitzMoveSeconds      = 30
+	correspondenceSeconds = 12 * 60 * 60
+)
+
+var (
+	// byo-yomi like "5x30 byo-yomi": periods of a number of seconds
+	byoYomiOvertime = regexp.MustCompile(`(\d+)\s*x\s*(\d+)`)
+	// Canadian like "25/600 Canadian": a number of stones in some seconds
+	canadianOvertime = regexp.MustCompile(`(\d+)\s*/\s*(\d+)`)
+	// Fischer and simple increments like "fischer 30" or "30 seconds per move"
+	incrementOvertime = regexp.MustCompile(`(\d+)`)
+)
+
+// gameSpeed classifies a game as blitz, live or correspondence from its time
+// settings (TM and OT), or failing those the time left recorded with the
+// moves (BL and WL), or failing those whether it was played over several
+// days (DT). It returns "" when there is nothing to go on.
+func gameSpeed(root *sgfNode) string {
+	if root == nil {
+		return ""
+	}
+	main, mainOK := parseSeconds(root.get("TM"))
+	perMove, overtimeOK := parseOvertime(root.get("OT"))
+	if !mainOK {
+		// the most time left seen is about the main time
+		for _, n := range root.mainLine() {
+			for _, id := range []string{"BL", "WL"} {
+				if left, ok := parseSeconds(n.get(id)); ok && left > main {
+					main, mainOK = left, true
+				}
+			}
+		}
+	}
+	switch {
+	case mainOK || overtimeOK:
+		if main >= correspondenceSeconds || perMove >= correspondenceSeconds {
+			return speedCorrespondence
+		}
+		if main <= blitzSeconds && perMove <= blitzMoveSeconds {
+			return speedBlitz
+		}
+		return speedLive
+	case strings.Contains(root.get("DT"), ","):
+		// several dates are only listed for games played over several days
+		return speedCorrespondence
+	}
+	return ""
+}
+
+func parseSeconds(v string) (float64, bool) {
+	s, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	return s, err == nil && s >= 0
+}
+
+// parseOvertime reads the longest time an OT property allows for a single
+// move once the main time is used up.
+func parseOvertime(ot string) (float64, bool) {
+	ot = strings.ToLower(ot)
+	if m := byoYomiOvertime.FindStringSubmatch(ot); m != nil {
+		period, _ := strconv.ParseFloat(m[2], 64)
+		return period, true
+	}
+	if m := canadianOvertime.FindStringSubmatch(ot); m != nil {
+		period, _ := strconv.ParseFloat(m[2], 64)
+		return period, true
+	}
+	if m := incrementOvertime.FindStringSubmatch(ot); m != nil {
+		increment, _ := strconv.ParseFloat(m[1], 64)
+		if strings.Contains(ot, "min") {
+			increment *= 60
+		} else if strings.Contains(ot, "hour") {
+			increment *= 60 * 60
+		} else if strings.Contains(ot, "day") {
+			increment *= 24 * 60 * 60
+		}
+		return increment, true
+	}
+	return 0, false
+}
+
+// backfillSpeeds classifies the games stored before speeds were.
+func backfillSpeeds(tx *sql.Tx) error {
+	speeds := make(map[int64]string)
+	err := visitStoredGames(tx, func(id int64, root *sgfNode) {
+		if speed := gameSpeed(root); speed != "" {
+			speeds[id] = speed
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for id, speed := range speeds {
+		if _, err := tx.Exec("update games set speed = ? where id = ?", speed, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
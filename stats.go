@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const statsUsage = `usage:
+  stats places [-db-path PATH] [FILTERS]
+  stats quality [-db-path PATH] [FILTERS]
+  stats results [-db-path PATH] [FILTERS]
+  stats strength [-db-path PATH] [FILTERS]
+  stats timing [-db-path PATH] [FILTERS]
+
+places groups games by their venue or server (the PC property).
+results counts games by how they ended: win, forfeit, jigo, void or unknown.
+strength shows a player's results by how much stronger or weaker their
+opponents were, going by the ranks recorded in the games. It is for -player,
+or the self names in the config file.
+timing shows how many seconds a player took per move and how often they
+played with under 30 seconds left, by the speed of the game, going by the
+time left recorded with the moves (BL and WL). It is for the same player,
+and counts only the moves made in main time, or under Fischer time, as the
+time left in byo-yomi and Canadian overtime is of the period.
+quality shows the points the same player lost per move by month, in each
+phase of the game and overall, going by the engine's analysis of the games
+by the worker command.`
+
+// statsViews are the groupings the stats command can show.
+var statsViews = map[string]func(db *sql.DB, filter *gameFilter, tw *tabwriter.Writer) error{
+	"places":   placeStats,
+	"quality":  qualityStats,
+	"results":  resultStats,
+	"strength": strengthStats,
+	"timing":   timingStats,
+}
+
+func statsCommand(args []string) {
+	if len(args) == 0 || statsViews[args[0]] == nil {
+		fmt.Fprintln(os.Stderr, statsUsage)
+		os.Exit(2)
+	}
+	view := statsViews[args[0]]
+
+	fs := flag.NewFlagSet("stats "+args[0], flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		filter gameFilter
+	)
+	filter.register(fs)
+	fs.Parse(args[1:])
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	err = view(db, &filter, tw)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tw.Flush()
+}
+
+func placeStats(db *sql.DB, filter *gameFilter, tw *tabwriter.Writer) error {
+	where, args := filter.where()
+	rows, err := db.Query(`
+		select coalesce(g.place, '(unknown)'), count(*), coalesce(min(g.timestamp), ''), coalesce(max(g.timestamp), '')
+		from games g
+		where `+where+`
+		group by g.place
+		order by count(*) desc, g.place`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	fmt.Fprintln(tw, "PLACE\tGAMES\tFIRST\tLAST")
+	for rows.Next() {
+		var (
+			place, first, last string
+			count              int
+		)
+		if err := rows.Scan(&place, &count, &first, &last); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", place, count, dateOf(first), dateOf(last))
+	}
+	return rows.Err()
+}
+
+func resultStats(db *sql.DB, filter *gameFilter, tw *tabwriter.Writer) error {
+	where, args := filter.where()
+	rows, err := db.Query(`
+		select coalesce(g.result, 'unknown'), count(*)
+		from games g
+		where `+where+`
+		group by coalesce(g.result, 'unknown')
+		order by count(*) desc`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	fmt.Fprintln(tw, "RESULT\tGAMES")
+	for rows.Next() {
+		var (
+			result string
+			count  int
+		)
+		if err := rows.Scan(&result, &count); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%d\n", result, count)
+	}
+	return rows.Err()
+}
+
+func strengthStats(db *sql.DB, filter *gameFilter, tw *tabwriter.Writer) error {
+	names, err := filter.perspective()
+	if err != nil {
+		return err
+	}
+	games, err := playerGames(db, names, filter)
+	if err != nil {
+		return err
+	}
+	tallies, unranked := tallyByStrength(games)
+	fmt.Fprintln(tw, "OPPONENT\tGAMES\tWINS\tLOSSES\tJIGO\tVOID\tWIN RATE")
+	for b := maxStrengthBucket; b >= -maxStrengthBucket; b-- {
+		if t := tallies[b]; t != nil {
+			fmt.Fprintln(tw, strings.Join(t.row(strengthLabel(b)), "\t"))
+		}
+	}
+	if unranked > 0 {
+		fmt.Fprintf(tw, "(%d games without both ranks left out)\n", unranked)
+	}
+	return nil
+}
+
+func qualityStats(db *sql.DB, filter *gameFilter, tw *tabwriter.Writer) error {
+	names, err := filter.perspective()
+	if err != nil {
+		return err
+	}
+	games, err := playerGames(db, names, filter)
+	if err != nil {
+		return err
+	}
+	months, skipped, err := monthlyQuality(db, games)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(tw, "MONTH\tGAMES\tMOVES\tOPENING\tMIDDLE\tENDGAME\tALL")
+	for _, m := range months {
+		cells := []string{m.month, fmt.Sprint(m.games), fmt.Sprint(m.all.moves)}
+		for _, phase := range gamePhases {
+			if t := m.phases[phase]; t != nil {
+				cells = append(cells, t.String())
+			} else {
+				cells = append(cells, "-")
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(append(cells, m.all.String()), "\t"))
+	}
+	if skipped > 0 {
+		fmt.Fprintf(tw, "(%d games without a date or analysis left out)\n", skipped)
+	}
+	return nil
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// store is where an import keeps what it reads: players, games with their
+// moves, and its own progress through the files. sqliteStore is the real one;
+// memoryStore keeps everything in maps so the import pipeline can run without
+// a database, which bench uses to time the reading apart from the storing and
+// the tests use to check what an import stores.
+type store interface {
+	// knownFiles returns the hash of every file imported so far, by path.
+	knownFiles() (map[string]string, error)
+	recordFile(path, hash, imported string) error
+	// checkpoints returns the last file finished in each directory by an
+	// interrupted import.
+	checkpoints() (map[string]string, error)
+	checkpoint(dir, path string) error
+	clearCheckpoints() error
+	// recordRun records an import which ran to the end.
+	recordRun(summary *importSummary) error
+
+	// begin starts storing the games of a file. Everything stored until
+	// commit, the file's hash included, is written together, or not at all
+	// when rollback is called instead.
+	begin() error
+	commit() error
+	rollback() error
+
+	// playerID returns the id of a player, adding them if they are new.
+	playerID(name, network string) (id int64, created bool, err error)
+	// fileGames returns the games stored from a file.
+	fileGames(path string) ([]fileGame, error)
+	insertGame(g *storedGame) (int64, error)
+	updateGame(id int64, g *storedGame) error
+	// holdBack records a game an import policy kept out of the games.
+	holdBack(h heldGame) error
+}
+
+// errStoreAgain is returned by a store which has to get ready for one of a
+// file's games outside of the file's transaction, as by attaching a new
+// partition. It does so when the transaction is rolled back, and the file is
+// then stored again from the start.
+var errStoreAgain = errors.New("the file has to be stored again")
+
+// heldGame is a game held back from an import by a policy.
+type heldGame struct {
+	path    string
+	index   int
+	network string
+	sgf     string
+	policy  string
+	action  string
+	reason  string
+	held    string
+}
+
+// storedGame is a game as it is stored, with the ids of its players.
+type storedGame struct {
+	blackID, whiteID, winnerID sql.NullInt64
+	result                     string
+	timestamp, timezone        string
+	path                       string
+	index                      int
+	sgf, sourceURL             string
+	blackRank, whiteRank       rankValue
+	speed                      string
+	teaching                   bool
+	contentKey                 string
+	// info holds the values of the infoColumns, by column
+	info  map[string]string
+	moves []moveRow
+}
+
+// values are the arguments of insertGameQuery(table, false) for the game.
+func (g *storedGame) values() []interface{} {
+	values := []interface{}{
+		g.blackID,
+		g.whiteID,
+		g.winnerID,
+		g.result,
+		nullIfEmpty(g.timestamp),
+		nullIfEmpty(g.timezone),
+		g.path,
+		g.index,
+		nullIfEmpty(g.sgf),
+		nullIfEmpty(g.sourceURL),
+	}
+	values = append(values, g.blackRank.args()...)
+	values = append(values, g.whiteRank.args()...)
+	values = append(values, nullIfEmpty(g.speed), g.teaching, nullIfEmpty(g.contentKey))
+	for _, c := range infoColumns {
+		values = append(values, nullIfEmpty(g.info[c.column]))
+	}
+	return values
+}
+
+// sqliteStore stores imports in the sqlite database, routing games to their
+// partitions when the database is partitioned. Files are stored on a
+// connection of their own, which the partitions are attached to.
+type sqliteStore struct {
+	db              *sql.DB
+	fileConn        *sql.Conn
+	getPlayerIdSmt  *sql.Stmt
+	insertPlayerSmt *sql.Stmt
+	insertGameSmt   *sql.Stmt
+	recordFileSmt   *sql.Stmt
+	checkpointSmt   *sql.Stmt
+	holdBackSmt     *sql.Stmt
+	// partitions takes the games instead of insertGameSmt when the database is
+	// partitioned
+	partitions *partitionWriter
+	// tx is the transaction of the file being stored, if any
+	tx *sql.Tx
+	// player ids by name and network
+	playerIdCache map[string]int64
+	// filePlayers are the keys of the players added by the file being
+	// stored, which are forgotten if it's rolled back
+	filePlayers []string
+}
+
+func newSQLiteStore(db *sql.DB, dbPath string, partition bool) (*sqliteStore, error) {
+	s := &sqliteStore{db: db, playerIdCache: make(map[string]int64)}
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		// players merged into others are found under their old names
+		{&s.getPlayerIdSmt, `
+			select id from players where name = ?1 and network = ?2
+			union all
+			select player_id from player_merges where name = ?1 and network = ?2
+			limit 1`},
+		{&s.insertPlayerSmt, "insert into players (name, network, is_guest, is_bot, canonical_name) values (?, ?, ?, ?, ?)"},
+		{&s.insertGameSmt, insertGameQuery("games", false)},
+		{&s.recordFileSmt, "insert or replace into files (path, hash, imported) values (?, ?, ?)"},
+		{&s.checkpointSmt, "insert or replace into import_checkpoints (dir, path) values (?, ?)"},
+		{&s.holdBackSmt, `
+			insert or replace into quarantine (path, game_index, network, sgf, policy, action, reason, held)
+			values (?, ?, ?, ?, ?, ?, ?, ?)`},
+	}
+	for _, st := range statements {
+		var err error
+		*st.stmt, err = db.Prepare(st.query)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("problem preparing %q: %s", st.query, err)
+		}
+	}
+
+	ctx := context.Background()
+	var err error
+	s.fileConn, err = db.Conn(ctx)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	existing, err := listPartitions(db, dbPath)
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("problem reading the partitions: %s", err)
+	}
+	if partition || len(existing) > 0 {
+		// the partitions' games refer to players in the main database
+		_, err = s.fileConn.ExecContext(ctx, "pragma foreign_keys = off")
+		if err == nil {
+			s.partitions, err = newPartitionWriter(dbPath, s.fileConn, existing)
+		}
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("problem opening the partitions: %s", err)
+		}
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) close() {
+	if s.tx != nil {
+		s.tx.Rollback()
+	}
+	for _, stmt := range []*sql.Stmt{s.getPlayerIdSmt, s.insertPlayerSmt, s.insertGameSmt, s.recordFileSmt, s.checkpointSmt, s.holdBackSmt} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	if s.fileConn != nil {
+		s.fileConn.Close()
+	}
+}
+
+func (s *sqliteStore) begin() error {
+	if s.tx != nil {
+		return errors.New("a file is already being stored")
+	}
+	tx, err := s.fileConn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	s.tx = tx
+	return nil
+}
+
+func (s *sqliteStore) commit() error {
+	tx := s.tx
+	s.tx = nil
+	if err := tx.Commit(); err != nil {
+		s.forgetFile()
+		return err
+	}
+	s.filePlayers = nil
+	if s.partitions != nil {
+		s.partitions.commit()
+	}
+	return nil
+}
+
+func (s *sqliteStore) rollback() error {
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.tx = nil
+	}
+	s.forgetFile()
+	if s.partitions != nil {
+		return s.partitions.attachNeeded()
+	}
+	return nil
+}
+
+// forgetFile drops what the store remembers of a file which wasn't stored.
+func (s *sqliteStore) forgetFile() {
+	for _, key := range s.filePlayers {
+		delete(s.playerIdCache, key)
+	}
+	s.filePlayers = nil
+	if s.partitions != nil {
+		s.partitions.forget()
+	}
+}
+
+// conn is where the store writes: the transaction of the file being stored,
+// or the database between files.
+func (s *sqliteStore) conn() queryer {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+// stmt returns a prepared statement to run on conn.
+func (s *sqliteStore) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if s.tx != nil {
+		return s.tx.Stmt(stmt)
+	}
+	return stmt
+}
+
+// Exec and QueryRow let extractors write in the transaction of the file
+// being stored.
+func (s *sqliteStore) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.conn().Exec(query, args...)
+}
+
+func (s *sqliteStore) QueryRow(query string, args ...interface{}) *sql.Row {
+	return s.conn().QueryRow(query, args...)
+}
+
+func (s *sqliteStore) knownFiles() (map[string]string, error) {
+	return knownFiles(s.db)
+}
+
+func (s *sqliteStore) recordFile(path, hash, imported string) error {
+	_, err := s.stmt(s.recordFileSmt).Exec(path, hash, imported)
+	return err
+}
+
+func (s *sqliteStore) checkpoints() (map[string]string, error) {
+	return checkpoints(s.db)
+}
+
+func (s *sqliteStore) checkpoint(dir, path string) error {
+	return retryBusy(func() error {
+		_, err := s.stmt(s.checkpointSmt).Exec(dir, path)
+		return err
+	})
+}
+
+func (s *sqliteStore) clearCheckpoints() error {
+	_, err := execRetry(s.db, "delete from import_checkpoints")
+	return err
+}
+
+func (s *sqliteStore) recordRun(summary *importSummary) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	_, err = execRetry(s.db,
+		"insert into import_runs (started, finished, summary) values (?, ?, ?)",
+		summary.Started.UTC().Format(time.RFC3339),
+		summary.Finished.UTC().Format(time.RFC3339),
+		string(data),
+	)
+	return err
+}
+
+func (s *sqliteStore) playerID(name, network string) (int64, bool, error) {
+	key := name + "\x00" + network
+	if id, ok := s.playerIdCache[key]; ok {
+		return id, false, nil
+	}
+	var id int64
+	err := s.stmt(s.getPlayerIdSmt).QueryRow(name, network).Scan(&id)
+	if err == nil {
+		s.playerIdCache[key] = id
+		return id, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, fmt.Errorf("problem reading the id of %s, %s: %s", name, network, err)
+	}
+	canonical, err := canonicalName(s.conn(), name)
+	if err != nil {
+		return 0, false, fmt.Errorf("problem reading the aliases of %s: %s", name, err)
+	}
+	res, err := s.stmt(s.insertPlayerSmt).Exec(name, network, name == guestName, config.isBot(name), canonical)
+	if err != nil {
+		return 0, false, fmt.Errorf("problem inserting %s, %s: %s", name, network, err)
+	}
+	id, err = res.LastInsertId()
+	if err != nil {
+		return 0, false, fmt.Errorf("problem extracting the last insert id for %s, %s: %s", name, network, err)
+	}
+	s.playerIdCache[key] = id
+	s.filePlayers = append(s.filePlayers, key)
+	return id, true, nil
+}
+
+func (s *sqliteStore) holdBack(h heldGame) error {
+	_, err := s.stmt(s.holdBackSmt).Exec(h.path, h.index, nullIfEmpty(h.network), nullIfEmpty(h.sgf), h.policy, h.action, nullIfEmpty(h.reason), h.held)
+	return err
+}
+
+// gameSchemas are the databases on the store's connection games may be
+// stored in.
+func (s *sqliteStore) gameSchemas() []string {
+	if s.partitions != nil {
+		return s.partitions.schemas()
+	}
+	return []string{"main"}
+}
+
+func (s *sqliteStore) fileGames(path string) ([]fileGame, error) {
+	var games []fileGame
+	for _, schema := range s.gameSchemas() {
+		rows, err := s.conn().Query(
+			"select id, coalesce(game_index, -1), coalesce(content_key, '') from "+schema+".games where path = ? order by id",
+			path,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var g fileGame
+			if err := rows.Scan(&g.id, &g.index, &g.key); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			games = append(games, g)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return games, nil
+}
+
+func (s *sqliteStore) insertGame(g *storedGame) (int64, error) {
+	if s.partitions != nil {
+		return s.partitions.insert(s.tx, g.timestamp, g.values(), g.moves)
+	}
+	res, err := s.stmt(s.insertGameSmt).Exec(g.values()...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return id, storeMoves(s.conn(), "moves", id, g.moves)
+}
+
+// updateGame replaces the game in whichever file holds it, even when its
+// timestamp now belongs to another partition.
+func (s *sqliteStore) updateGame(id int64, g *storedGame) error {
+	for _, schema := range s.gameSchemas() {
+		res, err := s.conn().Exec(updateGameQuery(schema+".games"), append(g.values(), id)...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+		_, err = s.conn().Exec("delete from "+schema+".moves where game_id = ?", id)
+		if err != nil {
+			return err
+		}
+		// the game is indexed again with its new text by the next search
+		_, err = s.conn().Exec("delete from search where docid = ?", id)
+		if err != nil {
+			return err
+		}
+		// and its moves may have changed, so the worker analyzes it again
+		_, err = s.conn().Exec("delete from evaluations where game_id = ?", id)
+		if err != nil {
+			return err
+		}
+		_, err = s.conn().Exec("delete from move_quality where game_id = ?", id)
+		if err != nil {
+			return err
+		}
+		_, err = s.conn().Exec("delete from analysis_jobs where game_id = ?", id)
+		if err != nil {
+			return err
+		}
+		return storeMoves(s.conn(), schema+".moves", id, g.moves)
+	}
+	return fmt.Errorf("there is no game with id %d", id)
+}
+
+// memoryStore keeps an import in memory.
+type memoryStore struct {
+	files          map[string]string
+	dirCheckpoints map[string]string
+	players        map[string]int64
+	games          map[int64]*storedGame
+	held           []heldGame
+	lastPlayer     int64
+	lastGame       int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		files:          make(map[string]string),
+		dirCheckpoints: make(map[string]string),
+		players:        make(map[string]int64),
+		games:          make(map[int64]*storedGame),
+	}
+}
+
+func copyMap(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func (s *memoryStore) knownFiles() (map[string]string, error) {
+	return copyMap(s.files), nil
+}
+
+func (s *memoryStore) recordFile(path, hash, imported string) error {
+	s.files[path] = hash
+	return nil
+}
+
+func (s *memoryStore) begin() error {
+	return nil
+}
+
+func (s *memoryStore) commit() error {
+	return nil
+}
+
+// rollback leaves what was stored in place, as a memory store never fails
+// part way through a file.
+func (s *memoryStore) rollback() error {
+	return nil
+}
+
+func (s *memoryStore) checkpoints() (map[string]string, error) {
+	return copyMap(s.dirCheckpoints), nil
+}
+
+func (s *memoryStore) checkpoint(dir, path string) error {
+	s.dirCheckpoints[dir] = path
+	return nil
+}
+
+func (s *memoryStore) clearCheckpoints() error {
+	s.dirCheckpoints = make(map[string]string)
+	return nil
+}
+
+func (s *memoryStore) recordRun(summary *importSummary) error {
+	return nil
+}
+
+func (s *memoryStore) playerID(name, network string) (int64, bool, error) {
+	key := name + "\x00" + network
+	if id, ok := s.players[key]; ok {
+		return id, false, nil
+	}
+	s.lastPlayer++
+	s.players[key] = s.lastPlayer
+	return s.lastPlayer, true, nil
+}
+
+func (s *memoryStore) fileGames(path string) ([]fileGame, error) {
+	var games []fileGame
+	for id, g := range s.games {
+		if g.path == path {
+			games = append(games, fileGame{id: id, index: g.index, key: g.contentKey})
+		}
+	}
+	sort.Slice(games, func(i, j int) bool { return games[i].id < games[j].id })
+	return games, nil
+}
+
+func (s *memoryStore) insertGame(g *storedGame) (int64, error) {
+	s.lastGame++
+	s.games[s.lastGame] = g
+	return s.lastGame, nil
+}
+
+func (s *memoryStore) updateGame(id int64, g *storedGame) error {
+	if s.games[id] == nil {
+		return fmt.Errorf("there is no game with id %d", id)
+	}
+	s.games[id] = g
+	return nil
+}
+
+func (s *memoryStore) holdBack(h heldGame) error {
+	s.held = append(s.held, h)
+	return nil
+}
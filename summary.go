@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// importSummary counts what an import did.
+type importSummary struct {
+	Started        time.Time `json:"started"`
+	Finished       time.Time `json:"finished"`
+	Seconds        float64   `json:"seconds"`
+	FilesScanned   int       `json:"files_scanned"`
+	FilesUnchanged int       `json:"files_unchanged"`
+	GamesInserted  int       `json:"games_inserted"`
+	GamesUpdated   int       `json:"games_updated"`
+	// GamesMissing were stored from changed files which no longer have them
+	GamesMissing int `json:"games_missing"`
+	// GamesRejected and GamesQuarantined were held back by import policies
+	GamesRejected    int            `json:"games_rejected"`
+	GamesQuarantined int            `json:"games_quarantined"`
+	PlayersCreated   int            `json:"players_created"`
+	GamesFailed      int            `json:"games_failed"`
+	Failures         map[string]int `json:"failures_by_category"`
+	Warnings         map[string]int `json:"missing_fields"`
+	FilesPerSecond   float64        `json:"files_per_second"`
+	GamesPerSecond   float64        `json:"games_per_second"`
+}
+
+func newImportSummary() *importSummary {
+	return &importSummary{
+		Started:  time.Now(),
+		Failures: make(map[string]int),
+		Warnings: make(map[string]int),
+	}
+}
+
+func (s *importSummary) failed(category string) {
+	s.GamesFailed++
+	s.Failures[category]++
+}
+
+// heldBack counts a game held back by an import policy.
+func (s *importSummary) heldBack(action string) {
+	if action == policyReject {
+		s.GamesRejected++
+	} else {
+		s.GamesQuarantined++
+	}
+}
+
+// warned counts a game imported without one of its fields.
+func (s *importSummary) warned(field string) {
+	s.Warnings[field]++
+}
+
+// add adds the counts of games and players in o, as from storing one file.
+func (s *importSummary) add(o *importSummary) {
+	s.GamesInserted += o.GamesInserted
+	s.GamesUpdated += o.GamesUpdated
+	s.GamesMissing += o.GamesMissing
+	s.GamesRejected += o.GamesRejected
+	s.GamesQuarantined += o.GamesQuarantined
+	s.PlayersCreated += o.PlayersCreated
+	s.GamesFailed += o.GamesFailed
+	for category, n := range o.Failures {
+		s.Failures[category] += n
+	}
+	for field, n := range o.Warnings {
+		s.Warnings[field] += n
+	}
+}
+
+func (s *importSummary) finish() {
+	s.Finished = time.Now()
+	s.Seconds = s.Finished.Sub(s.Started).Seconds()
+	if s.Seconds > 0 {
+		s.FilesPerSecond = float64(s.FilesScanned) / s.Seconds
+		s.GamesPerSecond = float64(s.GamesInserted+s.GamesUpdated) / s.Seconds
+	}
+}
+
+func (s *importSummary) print(w io.Writer) {
+	fmt.Fprintf(w, "files scanned:      %d\n", s.FilesScanned)
+	fmt.Fprintf(w, "  unchanged:        %d (skipped as already imported)\n", s.FilesUnchanged)
+	fmt.Fprintf(w, "games inserted:     %d\n", s.GamesInserted)
+	fmt.Fprintf(w, "games updated:      %d\n", s.GamesUpdated)
+	if s.GamesMissing > 0 {
+		fmt.Fprintf(w, "  gone from files:  %d (listed above, and kept)\n", s.GamesMissing)
+	}
+	if s.GamesRejected+s.GamesQuarantined > 0 {
+		fmt.Fprintf(w, "games rejected:     %d\n", s.GamesRejected)
+		fmt.Fprintf(w, "games quarantined:  %d\n", s.GamesQuarantined)
+	}
+	fmt.Fprintf(w, "players created:    %d\n", s.PlayersCreated)
+	fmt.Fprintf(w, "games failed:       %d\n", s.GamesFailed)
+	printCounts(w, s.Failures)
+	if len(s.Warnings) > 0 {
+		fmt.Fprintf(w, "fields missing:\n")
+		printCounts(w, s.Warnings)
+	}
+	fmt.Fprintf(w, "time:               %s\n", time.Duration(s.Seconds*float64(time.Second)).Round(time.Millisecond))
+	fmt.Fprintf(w, "throughput:         %.1f files/s, %.1f games/s\n", s.FilesPerSecond, s.GamesPerSecond)
+}
+
+func printCounts(w io.Writer, counts map[string]int) {
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %-16s  %d\n", k+":", counts[k])
+	}
+}
+
+func (s *importSummary) writeJSON(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
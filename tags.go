@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+const tagUsage = `usage:
+  tag add [-db-path PATH] TAG GAME_ID...
+  tag remove [-db-path PATH] TAG GAME_ID...
+  tag list [-db-path PATH] [GAME_ID]`
+
+func tagCommand(args []string) {
+	if len(args) == 0 || (args[0] != "add" && args[0] != "remove" && args[0] != "list") {
+		fmt.Fprintln(os.Stderr, tagUsage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("tag "+args[0], flag.ExitOnError)
+	dbPath := fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to use")
+	fs.Parse(args[1:])
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "add", "remove":
+		if fs.NArg() < 2 {
+			log.Fatalf("tag %s needs a tag and at least one game id\n", args[0])
+		}
+		ids, err := parseGameIDs(fs.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if args[0] == "add" {
+			err = addTag(db, fs.Arg(0), ids)
+		} else {
+			err = removeTag(db, fs.Arg(0), ids)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "list":
+		if fs.NArg() > 1 {
+			log.Fatal("tag list takes at most one game id")
+		}
+		if fs.NArg() == 1 {
+			ids, err := parseGameIDs(fs.Args())
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = listGameTags(db, ids[0])
+		} else {
+			err = listTags(db)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func addTag(db *sql.DB, tag string, ids []int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("insert or ignore into tags (name) values (?)", tag)
+	if err != nil {
+		return fmt.Errorf("problem creating tag %q: %s", tag, err)
+	}
+	var tagID int64
+	err = tx.QueryRow("select id from tags where name = ?", tag).Scan(&tagID)
+	if err != nil {
+		return fmt.Errorf("problem finding tag %q: %s", tag, err)
+	}
+	for _, id := range ids {
+		var found int
+		err := tx.QueryRow("select count(*) from games where id = ?", id).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found == 0 {
+			return fmt.Errorf("there is no game with id %d", id)
+		}
+		_, err = tx.Exec("insert or ignore into game_tags (game_id, tag_id) values (?, ?)", id, tagID)
+		if err != nil {
+			return fmt.Errorf("problem tagging game %d: %s", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func removeTag(db *sql.DB, tag string, ids []int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		_, err := tx.Exec(
+			"delete from game_tags where game_id = ? and tag_id = (select id from tags where name = ?)",
+			id,
+			tag,
+		)
+		if err != nil {
+			return fmt.Errorf("problem untagging game %d: %s", id, err)
+		}
+	}
+	// drop tags which no longer mark any games
+	_, err = tx.Exec("delete from tags where id not in (select tag_id from game_tags)")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func listTags(db *sql.DB) error {
+	rows, err := db.Query(`
+		select t.name, count(gt.game_id)
+		from tags t
+		left join game_tags gt on gt.tag_id = t.id
+		group by t.id
+		order by t.name`,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name  string
+			count int
+		)
+		if err := rows.Scan(&name, &count); err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%d\n", name, count)
+	}
+	return rows.Err()
+}
+
+func listGameTags(db *sql.DB, id int64) error {
+	rows, err := db.Query(`
+		select t.name
+		from tags t
+		join game_tags gt on gt.tag_id = t.id
+		where gt.game_id = ?
+		order by t.name`,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		fmt.Println(name)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+var (
+	// teachingWords in the game's name, event or comment mark it as a
+	// teaching or review game on their own
+	teachingWords = []string{"teaching", "review", "lesson", "指導", "지도"}
+	// unratedWords mark a game which didn't count for either player's rank
+	unratedWords = []string{"free", "unrated", "not rated", "friendly"}
+)
+
+// A game is uneven when the rank gap not made up by handicap stones is at
+// least teachingRankGap, heavily commented when at least
+// teachingComments of its main line moves have comments, and explored when
+// at least teachingVariations of its nodes branch.
+const (
+	teachingRankGap    = 4
+	teachingComments   = 10
+	teachingVariations = 3
+)
+
+// isTeachingGame guesses whether a game was a teaching or review game rather
+// than a competitive one: its name, event or comment says so, or it has at
+// least two of an uneven pairing, an unrated marker, many comments and many
+// variations.
+func isTeachingGame(root *sgfNode, blackRank, whiteRank rankValue) bool {
+	if root == nil {
+		return false
+	}
+	text := strings.ToLower(strings.Join([]string{root.get("GN"), root.get("EV"), root.get("GC")}, " "))
+	if containsAny(text, teachingWords) {
+		return true
+	}
+
+	var signs int
+	if containsAny(text, unratedWords) {
+		signs++
+	}
+	if blackRank.known && whiteRank.known {
+		gap := whiteRank.value - blackRank.value
+		if gap < 0 {
+			gap = -gap
+		}
+		handicap, _ := strconv.Atoi(root.get("HA"))
+		if gap-float64(handicap) >= teachingRankGap {
+			signs++
+		}
+	}
+	var commented int
+	for _, n := range root.mainLine()[1:] {
+		if n.get("C") != "" {
+			commented++
+		}
+	}
+	if commented >= teachingComments {
+		signs++
+	}
+	var branches int
+	var walk func(n *sgfNode)
+	walk = func(n *sgfNode) {
+		if len(n.children) > 1 {
+			branches++
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(root)
+	if branches >= teachingVariations {
+		signs++
+	}
+	return signs >= 2
+}
+
+func containsAny(s string, words []string) bool {
+	for _, w := range words {
+		if strings.Contains(s, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// backfillTeaching flags the teaching games among those stored before they
+// were.
+func backfillTeaching(tx *sql.Tx) error {
+	networks, err := storedNetworks(tx)
+	if err != nil {
+		return err
+	}
+	var teaching []int64
+	err = visitStoredGames(tx, func(id int64, root *sgfNode) {
+		network := networks[id]
+		if isTeachingGame(root, networkRank(network, root.get("BR")), networkRank(network, root.get("WR"))) {
+			teaching = append(teaching, id)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range teaching {
+		if _, err := tx.Exec("update games set is_teaching = 1 where id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const sqlUsage = `usage:
+  sql [-db-path PATH] [-dir DIR] -name NAME [-param KEY=VALUE ...]
+  sql [-dir DIR] -list
+
+sql runs a query template, a file named NAME.sql in DIR holding a single
+select statement. The template refers to parameters as :KEY, and each value
+is bound to it by sqlite rather than pasted into the text, so values need no
+quoting or escaping. Comment lines starting with -- at the top of a template
+describe it in -list. For example, monthly-results.sql could hold:
+
+  -- wins and losses per month for :player
+  select substr(g.timestamp, 1, 7) as month,
+    sum(winner.name = :player) as wins,
+    sum(winner.name != :player) as losses
+  from games g
+  join players b on b.id = g.black_id
+  join players w on w.id = g.white_id
+  left join players winner on winner.id = g.winner_id
+  where :player in (b.name, w.name)
+  group by month order by month`
+
+func sqlCommand(args []string) {
+	fs := flag.NewFlagSet("sql", flag.ExitOnError)
+	var (
+		dbPath = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to read")
+		dir    = fs.String("dir", queryDir(), "The directory of query templates")
+		name   = fs.String("name", "", "The template to run")
+		list   = fs.Bool("list", false, "List the templates")
+		params stringList
+	)
+	fs.Var(&params, "param", "A parameter as KEY=VALUE (may be repeated)")
+	fs.Parse(args)
+
+	if (*name == "") == !*list || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, sqlUsage)
+		os.Exit(2)
+	}
+
+	if *list {
+		err := listTemplates(*dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	query, err := ioutil.ReadFile(filepath.Join(*dir, *name+".sql"))
+	if err != nil {
+		log.Fatalf("error reading the template: %s\n", err)
+	}
+	values := make(map[string]string)
+	for _, p := range params {
+		i := strings.Index(p, "=")
+		if i < 1 {
+			log.Fatalf("%q is not a KEY=VALUE parameter\n", p)
+		}
+		values[p[:i]] = p[i+1:]
+	}
+	var bound []interface{}
+	for _, key := range templateParams(string(query)) {
+		v, ok := values[key]
+		if !ok {
+			log.Fatalf("%s needs a value for the %s parameter\n", *name, key)
+		}
+		bound = append(bound, sql.Named(key, v))
+		delete(values, key)
+	}
+	for key := range values {
+		log.Fatalf("%s has no %s parameter\n", *name, key)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	err = printQuery(db, string(query), bound)
+	if err != nil {
+		log.Fatalf("error running %s: %s\n", *name, err)
+	}
+}
+
+// templateParams returns the names of the :KEY parameters in a query,
+// skipping quoted text and comments.
+func templateParams(query string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	isName := func(c byte) bool {
+		return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+	}
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				return names
+			}
+			i += end + 1
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return names
+			}
+			i += end
+		case c == ':' && i+1 < len(query) && isName(query[i+1]):
+			j := i + 1
+			for j < len(query) && isName(query[j]) {
+				j++
+			}
+			if name := query[i+1 : j]; !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+			i = j - 1
+		}
+	}
+	return names
+}
+
+// printQuery prints the rows of any query as a table.
+func printQuery(db *sql.DB, query string, args []interface{}) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		cells := make([]string, len(values))
+		for i, v := range values {
+			cells[i] = v.String
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// listTemplates prints the name and description of each template in dir.
+func listTemplates(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		fmt.Println("There are no query templates in", dir)
+		return nil
+	}
+	sort.Strings(paths)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPARAMETERS\tDESCRIPTION")
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var description []string
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "--") {
+				break
+			}
+			description = append(description, strings.TrimSpace(strings.TrimPrefix(line, "--")))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n",
+			strings.TrimSuffix(filepath.Base(path), ".sql"),
+			strings.Join(templateParams(string(data)), ", "),
+			strings.Join(description, " "),
+		)
+	}
+	return tw.Flush()
+}
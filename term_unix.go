@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// rawTerminal puts the terminal on standard input into raw mode, so keys are
+// read as they're pressed, returning the function putting it back. It
+// returns false when standard input isn't a terminal or stty isn't there.
+func rawTerminal() (func(), bool) {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil, false
+	}
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, false
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, false
+	}
+	return func() { stty(saved) }, true
+}
@@ -0,0 +1,7 @@
+package main
+
+// rawTerminal isn't supported on Windows, where browse reads commands a line
+// at a time.
+func rawTerminal() (func(), bool) {
+	return nil, false
+}
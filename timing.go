@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// pressureSeconds is how little time left counts as playing under pressure.
+const pressureSeconds = 30
+
+// moveTiming sums up the clock over a set of moves made in main time.
+type moveTiming struct {
+	games int
+	// moves have their time left recorded, and pressured had under
+	// pressureSeconds of it
+	moves, pressured int
+	// spent is the time taken over the spentMoves whose thinking time is
+	// known, those made after a move whose time left is known
+	spent      float64
+	spentMoves int
+}
+
+// addGame adds the main time moves of one game, by their time left in
+// order. main is the game's main time, if it is known, for the first move,
+// and increment what each move adds to the clock under Fischer time.
+func (t *moveTiming) addGame(timesLeft []float64, main float64, mainKnown bool, increment float64) {
+	if len(timesLeft) == 0 {
+		return
+	}
+	t.games++
+	prev, known := main, mainKnown
+	for _, left := range timesLeft {
+		t.moves++
+		if left < pressureSeconds {
+			t.pressured++
+		}
+		if spent := prev + increment - left; known && spent >= 0 {
+			t.spent += spent
+			t.spentMoves++
+		}
+		prev, known = left, true
+	}
+}
+
+func (t *moveTiming) row(label string) string {
+	perMove, pressured := "-", "-"
+	if t.spentMoves > 0 {
+		perMove = fmt.Sprintf("%.1f", t.spent/float64(t.spentMoves))
+	}
+	if t.moves > 0 {
+		pressured = fmt.Sprintf("%.1f%%", 100*float64(t.pressured)/float64(t.moves))
+	}
+	return fmt.Sprintf("%s\t%d\t%d\t%s\t%d\t%s", label, t.games, t.moves, perMove, t.pressured, pressured)
+}
+
+// timingStats shows how long a player took over their moves and how often
+// they were short of time, by the speed of the game. Only moves made in main
+// time count, since in byo-yomi and Canadian overtime the time left is of
+// the period rather than the game.
+func timingStats(db *sql.DB, filter *gameFilter, tw *tabwriter.Writer) error {
+	names, err := filter.perspective()
+	if err != nil {
+		return err
+	}
+	games, err := playerGames(db, names, filter)
+	if err != nil {
+		return err
+	}
+	var (
+		all     moveTiming
+		bySpeed = make(map[string]*moveTiming)
+	)
+	for _, g := range games {
+		if g.root == nil {
+			continue
+		}
+		color := "B"
+		if g.color == white {
+			color = "W"
+		}
+		increment := fischerIncrement(g.root.get("OT"))
+		timesLeft := mainTimeLeft(g.root, color, increment > 0)
+		main, mainKnown := parseSeconds(g.root.get("TM"))
+		speed := g.speed
+		if speed == "" {
+			speed = "unknown"
+		}
+		if bySpeed[speed] == nil {
+			bySpeed[speed] = &moveTiming{}
+		}
+		bySpeed[speed].addGame(timesLeft, main, mainKnown, increment)
+		all.addGame(timesLeft, main, mainKnown, increment)
+	}
+	if all.games == 0 {
+		fmt.Fprintln(tw, "No games with move times found.")
+		return nil
+	}
+	fmt.Fprintf(tw, "SPEED\tGAMES\tMAIN TIME MOVES\tSECONDS/MOVE\tUNDER %ds\tSHARE\n", pressureSeconds)
+	for _, speed := range []string{speedBlitz, speedLive, speedCorrespondence, "unknown"} {
+		if t := bySpeed[speed]; t != nil && t.games > 0 {
+			fmt.Fprintln(tw, t.row(speed))
+		}
+	}
+	fmt.Fprintln(tw, all.row("all"))
+	return nil
+}
+
+// fischerIncrement is what each move adds to the clock under the Fischer
+// time an OT property gives, or 0 for other overtime.
+func fischerIncrement(ot string) float64 {
+	ot = strings.ToLower(ot)
+	if !strings.Contains(ot, "fischer") && !strings.Contains(ot, "increment") {
+		return 0
+	}
+	increment, _ := parseOvertime(ot)
+	return increment
+}
+
+// mainTimeLeft returns the time left after each of a color's main line moves
+// made in main time, in order. Overtime starts with the first move with
+// periods or stones left recorded (OB or OW), or, without Fischer time,
+// whose clock went up.
+func mainTimeLeft(root *sgfNode, color string, fischer bool) []float64 {
+	var times []float64
+	for _, n := range root.mainLine() {
+		if _, ok := n.props[color]; !ok {
+			continue
+		}
+		if _, ok := n.props["O"+color]; ok {
+			break
+		}
+		left, ok := parseSeconds(n.get(color + "L"))
+		if !ok {
+			continue
+		}
+		if !fischer && len(times) > 0 && left > times[len(times)-1] {
+			break
+		}
+		times = append(times, left)
+	}
+	return times
+}
+
+// backfillMoveTimes records the time left after the moves of the games
+// stored before it was.
+func backfillMoveTimes(tx *sql.Tx) error {
+	type timedNode struct {
+		gameID int64
+		node   int
+		left   float64
+	}
+	var timed []timedNode
+	err := visitStoredGames(tx, func(id int64, root *sgfNode) {
+		for _, m := range gameMoves(root) {
+			if m.timed {
+				timed = append(timed, timedNode{id, m.node, m.timeLeft})
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, n := range timed {
+		_, err := tx.Exec("update moves set time_left = ? where game_id = ? and node = ?", n.left, n.gameID, n.node)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
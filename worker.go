@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const workerUsage = `usage:
+  worker [-db-path PATH] [-games N] [-delay DURATION] [-poll DURATION]
+         [-retry-failed] [-reanalyze]
+  worker -status [-db-path PATH]
+
+The worker analyzes the library's games with the engine in the config file,
+a game at a time at the lowest priority, and stores the engine's evaluation
+of every position of their main lines, along with the points each side lost
+per move in each phase of the game, which stats quality and chart -metric
+quality show. It queues every game it hasn't analyzed, newest first, and
+records how each got on, so it can be stopped and started again at any time.
+It stops when the queue is empty, unless -poll has it wait for more games to
+be imported. -status prints how many games are in each state.`
+
+// The states of an analysis job.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+func workerCommand(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	var (
+		dbPath      = fs.String("db-path", defaultDBPath(), "The path to the sqlite3 database to analyze")
+		status      = fs.Bool("status", false, "Print how many games are in each state and exit")
+		limit       = fs.Int("games", 0, "Stop after analyzing this many games (0 for no limit)")
+		delay       = fs.Duration("delay", 0, "How long to pause between games")
+		poll        = fs.Duration("poll", 0, "How often to look for new games once the queue is empty (0 to stop instead)")
+		retryFailed = fs.Bool("retry-failed", false, "Queue the games which failed to be analyzed again")
+		reanalyze   = fs.Bool("reanalyze", false, "Queue the games analyzed with another engine or number of visits again")
+	)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, workerUsage)
+		os.Exit(2)
+	}
+
+	db, err := openDB(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if *status {
+		err = printQuery(db, `
+			select coalesce(j.status, 'not queued') as status, count(*) as games
+			from games g
+			left join analysis_jobs j on j.game_id = g.id
+			where g.sgf is not null
+			group by 1
+			order by 1`,
+			nil,
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// one worker at a time, so a job left running was abandoned
+	unlock, err := acquireLock(*dbPath+".worker", 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer unlock()
+
+	engine := engineLabel()
+	_, err = execRetry(db, "update analysis_jobs set status = ? where status = ?", jobQueued, jobRunning)
+	if err == nil && *retryFailed {
+		_, err = execRetry(db, "update analysis_jobs set status = ?, error = null where status = ?", jobQueued, jobFailed)
+	}
+	if err == nil && *reanalyze {
+		_, err = execRetry(db, "update analysis_jobs set status = ? where status = ? and engine is not ?", jobQueued, jobDone, engine)
+	}
+	if err != nil {
+		log.Fatalf("error updating the queue: %s\n", err)
+	}
+	summarized, err := summarizeAnalyzed(db)
+	if err != nil {
+		log.Fatalf("error summarizing the analyzed games: %s\n", err)
+	}
+	if summarized > 0 {
+		log.Printf("summarized the move quality of %d analyzed games\n", summarized)
+	}
+
+	var e *analysisEngine
+	defer func() {
+		if e != nil {
+			e.close()
+		}
+	}()
+	var analyzed, failed int
+	for *limit == 0 || analyzed+failed < *limit {
+		queued, err := queueGames(db)
+		if err != nil {
+			log.Fatalf("error queueing games: %s\n", err)
+		}
+		if queued > 0 {
+			log.Printf("queued %d games\n", queued)
+		}
+
+		id, root, err := nextJob(db)
+		if err != nil {
+			log.Fatalf("error taking a game from the queue: %s\n", err)
+		}
+		if id == 0 {
+			if *poll == 0 {
+				break
+			}
+			time.Sleep(*poll)
+			continue
+		}
+		if root == nil {
+			err = finishJob(db, id, engine, nil, nil, fmt.Errorf("the game's SGF text can't be read"))
+			if err != nil {
+				log.Fatalf("error updating the queue: %s\n", err)
+			}
+			failed++
+			continue
+		}
+
+		if e == nil {
+			e, err = startEngine(config.Engine, config.EngineVisits)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		start := time.Now()
+		evaluations, analysisErr := e.analyze(root)
+		if analysisErr != nil {
+			log.Printf("error analyzing game %d: %s\n", id, analysisErr)
+			failed++
+			// the engine may be in no state to carry on, so start another
+			e.close()
+			e = nil
+		} else {
+			log.Printf("analyzed game %d, %d positions in %s\n", id, len(evaluations), time.Since(start).Round(time.Second))
+			analyzed++
+		}
+		err = finishJob(db, id, engine, root, evaluations, analysisErr)
+		if err != nil {
+			log.Fatalf("error storing the analysis of game %d: %s\n", id, err)
+		}
+		if *delay > 0 {
+			time.Sleep(*delay)
+		}
+	}
+	log.Printf("analyzed %d games, %d failed\n", analyzed, failed)
+}
+
+// engineLabel identifies the engine setup games are analyzed with, so
+// -reanalyze can find those analyzed with another.
+func engineLabel() string {
+	label := strings.Join(config.Engine, " ")
+	if config.EngineVisits > 0 {
+		label += fmt.Sprintf(" (%d visits)", config.EngineVisits)
+	}
+	return label
+}
+
+// queueGames adds the games stored with their SGF text which aren't in the
+// queue yet, returning how many there were.
+func queueGames(db *sql.DB) (int64, error) {
+	res, err := execRetry(db, `
+		insert or ignore into analysis_jobs (game_id, status, queued)
+		select id, ?, ? from games where sgf is not null and id not in (select game_id from analysis_jobs)`,
+		jobQueued,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// nextJob marks the newest queued game as running and returns it, or an id of
+// 0 when the queue is empty. The game tree is nil when it can't be read.
+func nextJob(db *sql.DB) (int64, *sgfNode, error) {
+	var (
+		id     int64
+		source string
+	)
+	err := db.QueryRow(`
+		select j.game_id, coalesce(g.sgf, '')
+		from analysis_jobs j
+		join games g on g.id = j.game_id
+		where j.status = ?
+		order by g.timestamp desc, g.id desc
+		limit 1`,
+		jobQueued,
+	).Scan(&id, &source)
+	if err == sql.ErrNoRows {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	_, err = execRetry(db,
+		"update analysis_jobs set status = ?, started = ?, attempts = attempts + 1 where game_id = ?",
+		jobRunning,
+		time.Now().UTC().Format(time.RFC3339),
+		id,
+	)
+	if err != nil {
+		return 0, nil, err
+	}
+	games, err := readCollection([]byte(source))
+	if err != nil || len(games) == 0 {
+		return id, nil, nil
+	}
+	return id, games[0].root, nil
+}
+
+// finishJob stores a game's evaluations, and the move quality summed from
+// them, and marks its job done, or marks it failed when the analysis didn't
+// work out.
+func finishJob(db *sql.DB, id int64, engine string, root *sgfNode, evaluations []evaluation, analysisErr error) error {
+	finished := time.Now().UTC().Format(time.RFC3339)
+	if analysisErr != nil {
+		_, err := execRetry(db,
+			"update analysis_jobs set status = ?, finished = ?, error = ? where game_id = ?",
+			jobFailed, finished, analysisErr.Error(), id,
+		)
+		return err
+	}
+	// the transaction is rolled back on failure, so it can be run again
+	return retryBusy(func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		_, err = tx.Exec("delete from evaluations where game_id = ?", id)
+		if err != nil {
+			return err
+		}
+		for _, ev := range evaluations {
+			_, err = tx.Exec(
+				"insert into evaluations (game_id, move_number, winrate, score_lead, visits, best_move) values (?, ?, ?, ?, ?, ?)",
+				id, ev.moveNumber, ev.winrate, ev.scoreLead, ev.visits, nullIfEmpty(ev.bestMove),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		err = storeMoveQuality(tx, id, gameMoveQuality(root, evaluations))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"update analysis_jobs set status = ?, finished = ?, engine = ?, error = null where game_id = ?",
+			jobDone, finished, engine, id,
+		)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}